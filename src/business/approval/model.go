@@ -0,0 +1,383 @@
+// Package approval will manage the M of N approval policy required before exposing critical secrets
+//
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+package approval
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/PeerVault/PeerVault-Service/database"
+	"github.com/PeerVault/PeerVault-Service/identity"
+	"github.com/op/go-logging"
+	"go.etcd.io/bbolt"
+	"strings"
+	"time"
+)
+
+type Error int
+
+func (k Error) Error() (msg string) {
+	switch k {
+	case ErrorPolicyNotFound:
+		msg = "No approval policy found for the namespace"
+	case ErrorRequestNotFound:
+		msg = "The approval request was not found"
+	case ErrorApprovalSignature:
+		msg = "The approval signature is not valid"
+	case ErrorApprovalValidity:
+		msg = "The approval validity must be positive"
+	case ErrorRequestExists:
+		msg = "The uuid is already used by a request of another requester"
+	}
+	return fmt.Sprintf("%s (%d)", msg, k)
+}
+
+const (
+	ActionExpose = "expose" // Secret value exposed to the local client
+	ActionShare = "share" // Secret shared with another peer
+
+	StatusPending = "pending"
+	StatusGranted = "granted"
+	StatusDenied = "denied"
+	StatusExpired = "expired"
+
+	ErrorPolicyNotFound = Error(1)
+	ErrorRequestNotFound = Error(2)
+	ErrorApprovalSignature = Error(3)
+	ErrorApprovalValidity = Error(4)
+	ErrorRequestExists = Error(5)
+)
+
+var (
+	log = logging.MustGetLogger("peerVaultLogger")
+)
+
+// Policy require Required approvals among the Approvers before exposing secrets of the Namespace
+type Policy struct {
+	Namespace string
+	Required int
+	Approvers []string // QmPeerId of the approvers
+}
+
+// Request collect the approvals for a single action on a key path
+type Request struct {
+	Uuid string
+	Requester string
+	Action string // ActionExpose | ActionShare
+	KeyPath string
+	Receiver string `json:",omitempty"` // Only for ActionShare
+	Namespace string // Namespace of the policy requiring the approvals
+	Expiration string
+	Approvals []Approval
+}
+
+// Approval is signed by the approver and is only valid until its expiration
+type Approval struct {
+	RequestUuid string
+	Approver string
+	Approved bool
+	Expiration string
+	Signature string
+}
+
+// Check if the secret namespace is covered by the policy namespace
+func (p Policy) MatchNamespace(namespace string) bool {
+	return namespace == p.Namespace || strings.HasPrefix(namespace, p.Namespace + ".")
+}
+
+func (p Policy) IsApprover(QmPeerId string) bool {
+	for _, approver := range p.Approvers {
+		if approver == QmPeerId {
+			return true
+		}
+	}
+	return false
+}
+
+// Payload of the approval covered by the signature, it binds the approval to the request subject
+func (a Approval) Payload(r Request) []byte {
+	a.Signature = ""
+	buf, _ := json.Marshal(struct {
+		Approval Approval
+		Requester string
+		Action string
+		KeyPath string
+		Receiver string
+		Namespace string
+	}{a, r.Requester, r.Action, r.KeyPath, r.Receiver, r.Namespace})
+	return buf
+}
+
+func (a *Approval) Sign(id identity.PeerIdentity, r Request) error {
+	a.Approver = id.Id
+	signature, err := id.Sign(a.Payload(r))
+	if err != nil {
+		return err
+	}
+	a.Signature = base64.StdEncoding.EncodeToString(signature)
+	return nil
+}
+
+func (a Approval) Verify(r Request) error {
+	signature, err := base64.StdEncoding.DecodeString(a.Signature)
+	if err != nil {
+		return err
+	}
+	valid, err := identity.Verify(a.Approver, a.Payload(r), signature)
+	if err != nil {
+		return err
+	}
+	if !valid || a.RequestUuid != r.Uuid {
+		return ErrorApprovalSignature
+	}
+	return nil
+}
+
+// Add or replace the approval given by an approver
+func (r *Request) AddApproval(a Approval) {
+	for i, existing := range r.Approvals {
+		if existing.Approver == a.Approver {
+			r.Approvals[i] = a
+			return
+		}
+	}
+	r.Approvals = append(r.Approvals, a)
+}
+
+// Status of the request against the policy, only the unexpired approvals are counted
+func (r Request) Status(p Policy, now time.Time) string {
+	if expiration, err := time.Parse(time.RFC3339, r.Expiration); err != nil || now.After(expiration) {
+		return StatusExpired
+	}
+	approved, declined := 0, 0
+	for _, a := range r.Approvals {
+		expiration, err := time.Parse(time.RFC3339, a.Expiration)
+		if err != nil || now.After(expiration) || !p.IsApprover(a.Approver) {
+			continue
+		}
+		if a.Approved {
+			approved++
+		} else {
+			declined++
+		}
+	}
+	if approved >= p.Required {
+		return StatusGranted
+	}
+	if len(p.Approvers) - declined < p.Required {
+		return StatusDenied
+	}
+	return StatusPending
+}
+
+func (p *Policy) Save() error {
+	return put("policy", p.Namespace, p)
+}
+
+func (p *Policy) Delete() error {
+	return del("policy", p.Namespace)
+}
+
+func FetchPolicy(namespace string) (Policy, error) {
+	p := &Policy{}
+	db, err := database.GetConnection()
+	if err != nil {
+		return *p, err
+	}
+	err = db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("policy"))
+		if b == nil {
+			return ErrorPolicyNotFound
+		}
+		buf := b.Get([]byte(namespace))
+		if buf == nil {
+			return ErrorPolicyNotFound
+		}
+		return json.Unmarshal(buf, p)
+	})
+	return *p, err
+}
+
+func FetchPolicies() ([]Policy, error) {
+	var policies []Policy
+	err := each("policy", func(v []byte) error {
+		var p Policy
+		if err := json.Unmarshal(v, &p); err != nil {
+			return err
+		}
+		policies = append(policies, p)
+		return nil
+	})
+	return policies, err
+}
+
+// Find the policy covering a secret namespace, the most specific one is returned
+func FetchPolicyOfNamespace(namespace string) (Policy, error) {
+	policies, err := FetchPolicies()
+	if err != nil {
+		return Policy{}, err
+	}
+	found := Policy{}
+	for _, p := range policies {
+		if p.MatchNamespace(namespace) && len(p.Namespace) > len(found.Namespace) {
+			found = p
+		}
+	}
+	if found.Namespace == "" {
+		return found, ErrorPolicyNotFound
+	}
+	return found, nil
+}
+
+// Find the policy covering a key path, the key never contains dot so the namespace is before the last one
+func FetchPolicyOfKeyPath(keyPath string) (Policy, error) {
+	i := strings.LastIndex(keyPath, ".")
+	if i < 0 {
+		return Policy{}, ErrorPolicyNotFound
+	}
+	return FetchPolicyOfNamespace(keyPath[:i])
+}
+
+func (r *Request) Save() error {
+	return put("approval", r.Uuid, r)
+}
+
+// Save a request received from its requester
+// The uuid is chosen by the requester, a request of another requester is never replaced
+func (r *Request) SaveReceived() error {
+	db, err := database.GetConnection()
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("approval"))
+		if err != nil {
+			return err
+		}
+		if previous := b.Get([]byte(r.Uuid)); previous != nil {
+			stored := Request{}
+			if err := json.Unmarshal(previous, &stored); err != nil {
+				return err
+			}
+			if stored.Requester != r.Requester {
+				return ErrorRequestExists
+			}
+		}
+		return b.Put([]byte(r.Uuid), buf)
+	})
+}
+
+func (r *Request) Delete() error {
+	return del("approval", r.Uuid)
+}
+
+func FetchRequest(uuid string) (Request, error) {
+	r := &Request{}
+	db, err := database.GetConnection()
+	if err != nil {
+		return *r, err
+	}
+	err = db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("approval"))
+		if b == nil {
+			return ErrorRequestNotFound
+		}
+		buf := b.Get([]byte(uuid))
+		if buf == nil {
+			return ErrorRequestNotFound
+		}
+		return json.Unmarshal(buf, r)
+	})
+	return *r, err
+}
+
+// List the requests sent by us and the requests received as approver
+func FetchRequests() ([]Request, error) {
+	var requests []Request
+	err := each("approval", func(v []byte) error {
+		var r Request
+		if err := json.Unmarshal(v, &r); err != nil {
+			return err
+		}
+		requests = append(requests, r)
+		return nil
+	})
+	return requests, err
+}
+
+// Find the latest request of the requester for the same action on the same key path
+func FindRequest(requester string, action string, keyPath string, receiver string) (Request, error) {
+	requests, err := FetchRequests()
+	if err != nil {
+		return Request{}, err
+	}
+	found := Request{}
+	for _, r := range requests {
+		if r.Requester != requester || r.Action != action || r.KeyPath != keyPath || r.Receiver != receiver {
+			continue
+		}
+		if found.Uuid == "" || r.Expiration > found.Expiration {
+			found = r
+		}
+	}
+	if found.Uuid == "" {
+		return found, ErrorRequestNotFound
+	}
+	return found, nil
+}
+
+func put(bucket string, key string, v interface{}) error {
+	db, err := database.GetConnection()
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			log.Debugf("bucket %s create error", bucket)
+			return err
+		}
+		return b.Put([]byte(key), buf)
+	})
+}
+
+func del(bucket string, key string) error {
+	db, err := database.GetConnection()
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+func each(bucket string, fn func(v []byte) error) error {
+	db, err := database.GetConnection()
+	if err != nil {
+		return err
+	}
+	return db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			return fn(v)
+		})
+	})
+}
@@ -0,0 +1,50 @@
+package approval
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRequestStatus(t *testing.T) {
+	now := time.Now().UTC()
+	valid := now.Add(time.Hour).Format(time.RFC3339)
+	expired := now.Add(-time.Hour).Format(time.RFC3339)
+	policy := Policy{
+		Namespace: "production",
+		Required: 2,
+		Approvers: []string{"QmA", "QmB", "QmC"},
+	}
+	request := Request{Uuid: "uuid", Expiration: valid}
+
+	if status := request.Status(policy, now); status != StatusPending {
+		t.Errorf("Request without approval must be pending, current: %s", status)
+	}
+
+	request.AddApproval(Approval{Approver: "QmA", Approved: true, Expiration: valid})
+	request.AddApproval(Approval{Approver: "QmD", Approved: true, Expiration: valid})
+	if status := request.Status(policy, now); status != StatusPending {
+		t.Errorf("Approval of a peer outside of the policy must be ignored, current: %s", status)
+	}
+
+	request.AddApproval(Approval{Approver: "QmB", Approved: true, Expiration: expired})
+	if status := request.Status(policy, now); status != StatusPending {
+		t.Errorf("Expired approval must be ignored, current: %s", status)
+	}
+
+	request.AddApproval(Approval{Approver: "QmB", Approved: true, Expiration: valid})
+	if status := request.Status(policy, now); status != StatusGranted {
+		t.Errorf("Request approved by 2 of 3 must be granted, current: %s", status)
+	}
+
+	request.Approvals = nil
+	request.AddApproval(Approval{Approver: "QmA", Approved: false, Expiration: valid})
+	request.AddApproval(Approval{Approver: "QmB", Approved: false, Expiration: valid})
+	if status := request.Status(policy, now); status != StatusDenied {
+		t.Errorf("Request declined by 2 of 3 must be denied, current: %s", status)
+	}
+
+	request.Expiration = expired
+	if status := request.Status(policy, now); status != StatusExpired {
+		t.Errorf("Request after its expiration must be expired, current: %s", status)
+	}
+}
@@ -0,0 +1,356 @@
+// Package backup will manage the encrypted backups of the vault stored on trusted contacts
+//
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/PeerVault/PeerVault-Service/business/secret"
+	"github.com/PeerVault/PeerVault-Service/database"
+	"github.com/op/go-logging"
+	"go.etcd.io/bbolt"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Error int
+
+func (k Error) Error() (msg string) {
+	switch k {
+	case ErrorBackupNotFound:
+		msg = "The backup was not found"
+	case ErrorQuotaExceeded:
+		msg = "The backup quota of the owner is exceeded"
+	case ErrorChunkCorrupted:
+		msg = "The backup chunks are missing or corrupted"
+	}
+	return fmt.Sprintf("%s (%d)", msg, k)
+}
+
+const (
+	ChunkSize = 256 * 1024 // Bytes of cipher text in each chunk
+
+	HolderStatusPending = "pending" // Chunks are being pushed to the holder
+	HolderStatusStored = "stored"
+	HolderStatusRefused = "refused"
+	HolderStatusError = "error"
+
+	ErrorBackupNotFound = Error(1)
+	ErrorQuotaExceeded = Error(2)
+	ErrorChunkCorrupted = Error(3)
+)
+
+var (
+	log = logging.MustGetLogger("peerVaultLogger")
+)
+
+// Snapshot of the vault, values are cipher with the vault key
+type Snapshot struct {
+	CreatedAt string
+	Secrets []secret.Secret
+}
+
+// Chunk of a snapshot cipher with the backup key
+type Chunk struct {
+	Uuid string
+	Index int
+	Total int
+	Data string
+	Hash string // sha256 of the whole cipher text, to detect a corrupted restore
+}
+
+// Backup sent by the owner to its holders
+type Backup struct {
+	Uuid string
+	CreatedAt string
+	Size int
+	Chunks int
+	Secrets int
+	Holders []Holder
+}
+
+type Holder struct {
+	PeerId string
+	Status string // HolderStatusPending | HolderStatusStored | HolderStatusRefused | HolderStatusError
+	Error string `json:",omitempty"`
+}
+
+// HeldChunk is a chunk stored for another owner, identified by its master public key
+type HeldChunk struct {
+	OwnerKey string
+	Sender string // QmPeerId of the device who sent the chunk
+	StoredAt string
+	Chunk Chunk
+}
+
+// Held summarize a backup stored for another owner
+type Held struct {
+	OwnerKey string
+	Sender string
+	Uuid string
+	Size int
+	Chunks int
+	Complete bool
+	StoredAt string
+}
+
+// Split the cipher text of a snapshot into chunks
+func Split(uuid string, cipherText []byte) []Chunk {
+	sum := sha256.Sum256(cipherText)
+	hash := hex.EncodeToString(sum[:])
+	total := (len(cipherText) + ChunkSize - 1) / ChunkSize
+	chunks := make([]Chunk, 0, total)
+	for i := 0; i < total; i++ {
+		end := (i + 1) * ChunkSize
+		if end > len(cipherText) {
+			end = len(cipherText)
+		}
+		chunks = append(chunks, Chunk{
+			Uuid: uuid,
+			Index: i,
+			Total: total,
+			Data: string(cipherText[i*ChunkSize:end]),
+			Hash: hash,
+		})
+	}
+	return chunks
+}
+
+// Join the chunks of a backup, every chunk must be present and the hash must match
+func Join(chunks []Chunk) ([]byte, error) {
+	if len(chunks) == 0 {
+		return nil, ErrorBackupNotFound
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].Index < chunks[j].Index
+	})
+	var b strings.Builder
+	for i, chunk := range chunks {
+		if chunk.Index != i || chunk.Total != len(chunks) || chunk.Uuid != chunks[0].Uuid || chunk.Hash != chunks[0].Hash {
+			return nil, ErrorChunkCorrupted
+		}
+		b.WriteString(chunk.Data)
+	}
+	cipherText := []byte(b.String())
+	sum := sha256.Sum256(cipherText)
+	if hex.EncodeToString(sum[:]) != chunks[0].Hash {
+		return nil, ErrorChunkCorrupted
+	}
+	return cipherText, nil
+}
+
+func (b *Backup) Save() error {
+	db, err := database.GetConnection()
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("backup"))
+		if err != nil {
+			log.Debug("bucket backup create error")
+			return err
+		}
+		return bucket.Put([]byte(b.Uuid), buf)
+	})
+}
+
+func FetchBackups() ([]Backup, error) {
+	var backups []Backup
+	db, err := database.GetConnection()
+	if err != nil {
+		return backups, err
+	}
+	err = db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("backup"))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			backup := Backup{}
+			if err := json.Unmarshal(v, &backup); err != nil {
+				return err
+			}
+			backups = append(backups, backup)
+			return nil
+		})
+	})
+	return backups, err
+}
+
+func heldKey(ownerKey string, uuid string, index int) []byte {
+	return []byte(fmt.Sprintf("%s/%s/%08d", ownerKey, uuid, index))
+}
+
+// Store a chunk for another owner, the bytes held for the owner cannot exceed the quota
+// Once a backup is complete, the previous backups of the owner are removed
+func HoldChunk(ownerKey string, sender string, chunk Chunk, quota int64) error {
+	db, err := database.GetConnection()
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("backupheld"))
+		if err != nil {
+			log.Debug("bucket backupheld create error")
+			return err
+		}
+		key := heldKey(ownerKey, chunk.Uuid, chunk.Index)
+		prefix := []byte(ownerKey + "/")
+
+		// The complete backup is kept until the new one is received, it is left out of the quota
+		// so a new backup can replace it, the backups never completed are counted
+		used := make(map[string]int64)
+		count := make(map[string]int)
+		total := make(map[string]int)
+		var previous [][]byte
+		c := b.Cursor()
+		for k, v := c.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, v = c.Next() {
+			if string(k) == string(key) {
+				continue
+			}
+			held := HeldChunk{}
+			if err := json.Unmarshal(v, &held); err != nil {
+				return err
+			}
+			used[held.Chunk.Uuid] += int64(len(held.Chunk.Data))
+			count[held.Chunk.Uuid]++
+			total[held.Chunk.Uuid] = held.Chunk.Total
+			if held.Chunk.Uuid != chunk.Uuid {
+				previous = append(previous, append([]byte{}, k...))
+			}
+		}
+		size := int64(len(chunk.Data))
+		for heldUuid, heldSize := range used {
+			if heldUuid != chunk.Uuid && count[heldUuid] >= total[heldUuid] {
+				continue
+			}
+			size += heldSize
+		}
+		if size > quota {
+			return ErrorQuotaExceeded
+		}
+		received := count[chunk.Uuid]
+
+		buf, err := json.Marshal(HeldChunk{
+			OwnerKey: ownerKey,
+			Sender: sender,
+			StoredAt: time.Now().UTC().Format(time.RFC3339),
+			Chunk: chunk,
+		})
+		if err != nil {
+			return err
+		}
+		if err := b.Put(key, buf); err != nil {
+			return err
+		}
+
+		if received + 1 < chunk.Total {
+			return nil
+		}
+		for _, k := range previous {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func eachHeldChunk(fn func(held HeldChunk)) error {
+	db, err := database.GetConnection()
+	if err != nil {
+		return err
+	}
+	return db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("backupheld"))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			held := HeldChunk{}
+			if err := json.Unmarshal(v, &held); err != nil {
+				return err
+			}
+			fn(held)
+			return nil
+		})
+	})
+}
+
+// Backups stored for other owners
+func FetchHeld() ([]Held, error) {
+	var helds []Held
+	index := make(map[string]int)
+	err := eachHeldChunk(func(chunk HeldChunk) {
+		key := chunk.OwnerKey + "/" + chunk.Chunk.Uuid
+		i, ok := index[key]
+		if !ok {
+			helds = append(helds, Held{
+				OwnerKey: chunk.OwnerKey,
+				Sender: chunk.Sender,
+				Uuid: chunk.Chunk.Uuid,
+			})
+			i = len(helds) - 1
+			index[key] = i
+		}
+		helds[i].Size += len(chunk.Chunk.Data)
+		helds[i].Chunks++
+		helds[i].Complete = helds[i].Chunks == chunk.Chunk.Total
+		if chunk.StoredAt > helds[i].StoredAt {
+			helds[i].StoredAt = chunk.StoredAt
+		}
+	})
+	return helds, err
+}
+
+// Chunk of a backup held for an owner, of the latest complete backup when the uuid is empty
+func FetchHeldChunk(ownerKey string, uuid string, index int) (Chunk, error) {
+	chunk := Chunk{}
+	if uuid == "" {
+		helds, err := FetchHeld()
+		if err != nil {
+			return chunk, err
+		}
+		storedAt := ""
+		for _, held := range helds {
+			if held.OwnerKey == ownerKey && held.Complete && held.StoredAt > storedAt {
+				uuid, storedAt = held.Uuid, held.StoredAt
+			}
+		}
+		if uuid == "" {
+			return chunk, ErrorBackupNotFound
+		}
+	}
+
+	db, err := database.GetConnection()
+	if err != nil {
+		return chunk, err
+	}
+	err = db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("backupheld"))
+		if b == nil {
+			return ErrorBackupNotFound
+		}
+		v := b.Get(heldKey(ownerKey, uuid, index))
+		if v == nil {
+			return ErrorBackupNotFound
+		}
+		held := HeldChunk{}
+		if err := json.Unmarshal(v, &held); err != nil {
+			return err
+		}
+		chunk = held.Chunk
+		return nil
+	})
+	return chunk, err
+}
@@ -0,0 +1,89 @@
+package backup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PeerVault/PeerVault-Service/database"
+	"go.etcd.io/bbolt"
+)
+
+func TestSplitJoin(t *testing.T) {
+	cipherText := []byte(strings.Repeat("a", ChunkSize * 2 + 10))
+	chunks := Split("uuid", cipherText)
+	if len(chunks) != 3 {
+		t.Fatalf("Cipher text must be split in 3 chunks, current: %d", len(chunks))
+	}
+
+	// Chunks may be returned in any order by the holder
+	chunks[0], chunks[2] = chunks[2], chunks[0]
+	joined, err := Join(chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(joined) != string(cipherText) {
+		t.Error("Joined chunks must be the original cipher text")
+	}
+
+	if _, err := Join(chunks[:2]); err != ErrorChunkCorrupted {
+		t.Errorf("Missing chunk must be detected, current: %v", err)
+	}
+	chunks[1].Data = "b" + chunks[1].Data[1:]
+	if _, err := Join(chunks); err != ErrorChunkCorrupted {
+		t.Errorf("Altered chunk must be detected, current: %v", err)
+	}
+}
+
+func TestHoldChunkReplaceBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peervault-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := bbolt.Open(filepath.Join(dir, "peervault.db"), 0600, &bbolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	database.SetConnection(db)
+
+	// The quota is below twice the size of a backup
+	cipherText := []byte(strings.Repeat("a", ChunkSize + 10))
+	quota := int64(len(cipherText) + len(cipherText) / 2)
+	for _, uuid := range []string{"first", "second"} {
+		for _, chunk := range Split(uuid, cipherText) {
+			if err := HoldChunk("owner", "QmSender", chunk, quota); err != nil {
+				t.Fatalf("Backup %s must replace the previous one, current: %v", uuid, err)
+			}
+		}
+	}
+
+	// A backup never completed is counted
+	third := Split("third", cipherText)
+	if err := HoldChunk("owner", "QmSender", third[0], quota); err != nil {
+		t.Fatal(err)
+	}
+	fourth := Split("fourth", cipherText)
+	if err := HoldChunk("owner", "QmSender", fourth[0], quota); err != ErrorQuotaExceeded {
+		t.Errorf("Backups never completed must be counted in the quota, current: %v", err)
+	}
+
+	// Chunks are returned one at a time, from the latest complete backup
+	chunk, err := FetchHeldChunk("owner", "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunk.Uuid != "second" || chunk.Index != 1 || chunk.Total != 2 {
+		t.Errorf("Latest complete backup must be returned, current: %s %d/%d", chunk.Uuid, chunk.Index, chunk.Total)
+	}
+	if _, err := FetchHeldChunk("owner", "first", 0); err != ErrorBackupNotFound {
+		t.Errorf("Backup replaced must not be returned anymore, current: %v", err)
+	}
+	if _, err := FetchHeldChunk("other", "", 0); err != ErrorBackupNotFound {
+		t.Errorf("Backup of another owner must not be returned, current: %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+// Package contact will manage the known peers of the owner
+//
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+package contact
+
+import (
+	"encoding/json"
+	"github.com/PeerVault/PeerVault-Service/business/owner"
+	"net/http"
+	"path"
+)
+
+// Controller Manage Contact
+// POST : Create or update a contact
+// GET : List contacts, or a single one with /contact/<QmPeerId>
+// DELETE : Remove a contact
+func Controller(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !owner.PasswordVerification(r, false) {
+		http.Error(w, "{\"error\": \"X-OWNER-CODE is required\"}", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		saveContact(w, r)
+	case http.MethodGet:
+		getContacts(w, r)
+	case http.MethodDelete:
+		deleteContact(w, r)
+	default:
+		http.Error(w, "Invalid request method.", 405)
+	}
+}
+
+func saveContact(w http.ResponseWriter, r *http.Request) {
+	c := &Contact{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&c)
+	if err != nil {
+		http.Error(w, "{\"error\": \"Payload must be struct of Contact\"}", http.StatusBadRequest)
+		return
+	}
+	if c.PeerId == "" {
+		http.Error(w, "{\"error\": \"PeerId is required\"}", http.StatusBadRequest)
+		return
+	}
+	if c.Trust != "" && !IsValidTrust(c.Trust) {
+		http.Error(w, "{\"error\": \"Trust must be unknown, known or trusted\"}", http.StatusBadRequest)
+		return
+	}
+
+	// Keep the exchange history of an existing contact, verification is only done by the verification protocol
+	// and a contact is only blocked with /contact/block
+	c.Verified = false
+	c.VerifiedAt = ""
+	c.Blocked = false
+	c.BlockedAt = ""
+	existing, err := FetchContact(c.PeerId)
+	if err == nil {
+		c.CreatedAt = existing.CreatedAt
+		c.LastExchange = existing.LastExchange
+		c.Verified = existing.Verified
+		c.VerifiedAt = existing.VerifiedAt
+		c.Blocked = existing.Blocked
+		c.BlockedAt = existing.BlockedAt
+	} else if err != ErrorContactNotFound {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+
+	err = c.Save()
+	if err == ErrorNicknameUsed {
+		http.Error(w, "{\"error\": \"Nickname is already used by another contact\"}", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+	resultJSON, _ := json.Marshal(c)
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write(resultJSON)
+}
+
+func getContacts(w http.ResponseWriter, r *http.Request) {
+	var result interface{}
+	var err error
+	if id := path.Base(r.URL.Path); id != "contact" {
+		result, err = FetchContact(id)
+	} else {
+		result, err = FetchContacts()
+	}
+	if err == ErrorContactNotFound {
+		http.Error(w, "{\"error\": \"Contact not found\"}", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+	resultJSON, _ := json.Marshal(result)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resultJSON)
+}
+
+func deleteContact(w http.ResponseWriter, r *http.Request) {
+	c := &Contact{
+		PeerId: path.Base(r.RequestURI),
+	}
+	if err := c.Delete(); err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,252 @@
+// Package contact will manage the known peers of the owner
+//
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+package contact
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/PeerVault/PeerVault-Service/database"
+	"github.com/op/go-logging"
+	"go.etcd.io/bbolt"
+	"time"
+)
+
+type Error int
+
+func (k Error) Error() (msg string) {
+	switch k {
+	case ErrorContactNotFound:
+		msg = "The contact was not found"
+	case ErrorNicknameUsed:
+		msg = "The nickname is already used by another contact"
+	}
+	return fmt.Sprintf("%s (%d)", msg, k)
+}
+
+const (
+	TrustUnknown = "unknown" // Added automatically after a share exchange
+	TrustKnown = "known"
+	TrustTrusted = "trusted"
+
+	ErrorContactNotFound = Error(1)
+	ErrorNicknameUsed = Error(2)
+)
+
+var (
+	log = logging.MustGetLogger("peerVaultLogger")
+)
+
+type Contact struct {
+	PeerId string // QmPeerId of the main device of the contact
+	Nickname string
+	Devices []string `json:",omitempty"` // QmPeerId of the other devices of the contact
+	Trust string // TrustUnknown | TrustKnown | TrustTrusted
+	Notes string
+	CreatedAt string
+	LastExchange string `json:",omitempty"` // Last share exchange completed with the contact
+	Verified bool // Short authentication string confirmed by both users
+	VerifiedAt string `json:",omitempty"`
+	BackupQuota int64 // Bytes of backups stored for the contact, only accepted from trusted contacts
+	Blocked bool // Connections and streams of the contact are refused
+	BlockedAt string `json:",omitempty"`
+}
+
+func IsValidTrust(trust string) bool {
+	return trust == TrustUnknown || trust == TrustKnown || trust == TrustTrusted
+}
+
+// Check if the peer is the contact or one of its devices
+func (c Contact) HasPeer(QmPeerId string) bool {
+	if c.PeerId == QmPeerId {
+		return true
+	}
+	for _, device := range c.Devices {
+		if device == QmPeerId {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Contact) Save() error {
+	if c.Nickname != "" {
+		existing, err := FetchContactByNickname(c.Nickname)
+		if err == nil && existing.PeerId != c.PeerId {
+			return ErrorNicknameUsed
+		}
+		if err != nil && err != ErrorContactNotFound {
+			return err
+		}
+	}
+	if c.CreatedAt == "" {
+		c.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	}
+	if c.Trust == "" {
+		c.Trust = TrustUnknown
+	}
+
+	db, err := database.GetConnection()
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("contact"))
+		if err != nil {
+			log.Debug("bucket contact create error")
+			return err
+		}
+		return b.Put([]byte(c.PeerId), buf)
+	})
+}
+
+func (c *Contact) Delete() error {
+	db, err := database.GetConnection()
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("contact"))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(c.PeerId))
+	})
+}
+
+// Record a share exchange completed with a peer, the peer is added to the contacts when unknown
+func Remember(QmPeerId string) error {
+	c, err := FetchContactOfPeer(QmPeerId)
+	if err == ErrorContactNotFound {
+		c = Contact{PeerId: QmPeerId, Trust: TrustUnknown}
+	} else if err != nil {
+		return err
+	}
+	c.LastExchange = time.Now().UTC().Format(time.RFC3339)
+	return c.Save()
+}
+
+// Mark the peer verified once both users confirmed the short authentication string
+func MarkVerified(QmPeerId string) (Contact, error) {
+	c, err := FetchContactOfPeer(QmPeerId)
+	if err == ErrorContactNotFound {
+		c = Contact{PeerId: QmPeerId, Trust: TrustUnknown}
+	} else if err != nil {
+		return c, err
+	}
+	c.Verified = true
+	c.VerifiedAt = time.Now().UTC().Format(time.RFC3339)
+	return c, c.Save()
+}
+
+// Block the peer, the peer is added to the contacts when unknown
+func Block(QmPeerId string) (Contact, error) {
+	c, err := FetchContactOfPeer(QmPeerId)
+	if err == ErrorContactNotFound {
+		c = Contact{PeerId: QmPeerId, Trust: TrustUnknown}
+	} else if err != nil {
+		return c, err
+	}
+	c.Blocked = true
+	c.BlockedAt = time.Now().UTC().Format(time.RFC3339)
+	return c, c.Save()
+}
+
+func Unblock(QmPeerId string) (Contact, error) {
+	c, err := FetchContactOfPeer(QmPeerId)
+	if err != nil {
+		return c, err
+	}
+	c.Blocked = false
+	c.BlockedAt = ""
+	return c, c.Save()
+}
+
+// Resolve a receiver given by nickname to its QmPeerId, any other value is returned as is
+func Resolve(receiver string) string {
+	c, err := FetchContactByNickname(receiver)
+	if err != nil {
+		return receiver
+	}
+	return c.PeerId
+}
+
+func FetchContact(QmPeerId string) (Contact, error) {
+	c := &Contact{}
+	db, err := database.GetConnection()
+	if err != nil {
+		return *c, err
+	}
+	err = db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("contact"))
+		if b == nil {
+			return ErrorContactNotFound
+		}
+		buf := b.Get([]byte(QmPeerId))
+		if buf == nil {
+			return ErrorContactNotFound
+		}
+		return json.Unmarshal(buf, c)
+	})
+	return *c, err
+}
+
+// Find the contact owning the peer, as main peer or as one of its devices
+func FetchContactOfPeer(QmPeerId string) (Contact, error) {
+	c, err := FetchContact(QmPeerId)
+	if err != ErrorContactNotFound {
+		return c, err
+	}
+	return findContact(func(c Contact) bool {
+		return c.HasPeer(QmPeerId)
+	})
+}
+
+func FetchContactByNickname(nickname string) (Contact, error) {
+	return findContact(func(c Contact) bool {
+		return c.Nickname == nickname
+	})
+}
+
+func FetchContacts() ([]Contact, error) {
+	db, err := database.GetConnection()
+	if err != nil {
+		return nil, err
+	}
+	var contacts []Contact
+
+	err = db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("contact"))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var c Contact
+			if err := json.Unmarshal(v, &c); err != nil {
+				return err
+			}
+			contacts = append(contacts, c)
+			return nil
+		})
+	})
+	return contacts, err
+}
+
+func findContact(match func(c Contact) bool) (Contact, error) {
+	contacts, err := FetchContacts()
+	if err != nil {
+		return Contact{}, err
+	}
+	for _, c := range contacts {
+		if match(c) {
+			return c, nil
+		}
+	}
+	return Contact{}, ErrorContactNotFound
+}
@@ -0,0 +1,252 @@
+// Package device will manage the devices linked to the same owner
+//
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+package device
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/PeerVault/PeerVault-Service/database"
+	"github.com/PeerVault/PeerVault-Service/identity"
+	"github.com/op/go-logging"
+	"go.etcd.io/bbolt"
+	"time"
+)
+
+type Error int
+
+func (k Error) Error() (msg string) {
+	switch k {
+	case ErrorDeviceListNotFound:
+		msg = "The device list was not found"
+	case ErrorDeviceListSignature:
+		msg = "The device list signature is not valid"
+	case ErrorDeviceNotLinked:
+		msg = "The device is not linked to the owner"
+	case ErrorNoMasterProof:
+		msg = "The device has no master proof, the seed of the owner must be proved first"
+	case ErrorDeviceRevoked:
+		msg = "The device has been revoked and cannot be linked again"
+	}
+	return fmt.Sprintf("%s (%d)", msg, k)
+}
+
+const (
+	ErrorDeviceListNotFound = Error(1)
+	ErrorDeviceListSignature = Error(2)
+	ErrorDeviceNotLinked = Error(3)
+	ErrorNoMasterProof = Error(4)
+	ErrorDeviceRevoked = Error(5)
+)
+
+var (
+	log = logging.MustGetLogger("peerVaultLogger")
+)
+
+type Device struct {
+	PeerId string
+	Name string
+	LinkedAt string
+	Proof identity.MasterProof
+}
+
+// DeviceList of the owner, signed by the device who made the last change
+type DeviceList struct {
+	MasterPubKey string
+	Devices []Device
+	Revoked []string // QmPeerId of the devices revoked
+	Version int
+	Signer string
+	Signature string
+}
+
+// Initial list of a device not linked yet, only the device itself
+func NewDeviceList(id identity.PeerIdentity) (DeviceList, error) {
+	if id.MasterProof == nil {
+		return DeviceList{}, ErrorNoMasterProof
+	}
+	l := DeviceList{
+		MasterPubKey: id.MasterProof.MasterPubKey,
+		Devices: []Device{{
+			PeerId: id.Id,
+			Name: id.Name,
+			LinkedAt: time.Now().UTC().Format(time.RFC3339),
+			Proof: *id.MasterProof,
+		}},
+	}
+	return l, l.Sign(id)
+}
+
+// Payload of the list covered by the signature
+func (l DeviceList) Payload() []byte {
+	l.Signature = ""
+	buf, _ := json.Marshal(l)
+	return buf
+}
+
+func (l *DeviceList) Sign(id identity.PeerIdentity) error {
+	l.Signer = id.Id
+	signature, err := id.Sign(l.Payload())
+	if err != nil {
+		return err
+	}
+	l.Signature = base64.StdEncoding.EncodeToString(signature)
+	return nil
+}
+
+// Verify the signature of the list and the master proof of every device
+func (l DeviceList) Verify() error {
+	signature, err := base64.StdEncoding.DecodeString(l.Signature)
+	if err != nil {
+		return err
+	}
+	valid, err := identity.Verify(l.Signer, l.Payload(), signature)
+	if err != nil {
+		return err
+	}
+	if !valid || !l.HasDevice(l.Signer) {
+		return ErrorDeviceListSignature
+	}
+	for _, d := range l.Devices {
+		if d.Proof.MasterPubKey != l.MasterPubKey {
+			return ErrorDeviceListSignature
+		}
+		if err := identity.VerifyMasterProof(d.PeerId, d.Proof); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l DeviceList) HasDevice(QmPeerId string) bool {
+	for _, d := range l.Devices {
+		if d.PeerId == QmPeerId {
+			return true
+		}
+	}
+	return false
+}
+
+func (l DeviceList) IsRevoked(QmPeerId string) bool {
+	for _, revoked := range l.Revoked {
+		if revoked == QmPeerId {
+			return true
+		}
+	}
+	return false
+}
+
+// Add a device to the list, a revoked device still hold a valid master proof and is refused
+func (l *DeviceList) AddDevice(d Device) error {
+	if l.IsRevoked(d.PeerId) {
+		return ErrorDeviceRevoked
+	}
+	if l.HasDevice(d.PeerId) {
+		return nil
+	}
+	d.LinkedAt = time.Now().UTC().Format(time.RFC3339)
+	l.Devices = append(l.Devices, d)
+	l.Version++
+	return nil
+}
+
+func (l *DeviceList) RevokeDevice(QmPeerId string) error {
+	for i, d := range l.Devices {
+		if d.PeerId == QmPeerId {
+			l.Devices = append(l.Devices[:i], l.Devices[i+1:]...)
+			l.Revoked = append(l.Revoked, QmPeerId)
+			l.Version++
+			return nil
+		}
+	}
+	return ErrorDeviceNotLinked
+}
+
+// Check that every device and revocation of the other list is known by the list
+// A device of the other list revoked since is known as well
+func (l DeviceList) Covers(other DeviceList) bool {
+	for _, revoked := range other.Revoked {
+		if !l.IsRevoked(revoked) {
+			return false
+		}
+	}
+	for _, d := range other.Devices {
+		if !l.HasDevice(d.PeerId) && !l.IsRevoked(d.PeerId) {
+			return false
+		}
+	}
+	return true
+}
+
+// Merge a list forked from the list, such as a device linked on one device while another one revoked
+// The devices and revocations of both lists are kept, a device revoked by any of them is removed
+// The version follows both lists, the merged list must then be signed
+func (l *DeviceList) Merge(other DeviceList) {
+	for _, revoked := range other.Revoked {
+		if !l.IsRevoked(revoked) {
+			l.Revoked = append(l.Revoked, revoked)
+		}
+	}
+	for _, d := range other.Devices {
+		if !l.HasDevice(d.PeerId) {
+			l.Devices = append(l.Devices, d)
+		}
+	}
+	devices := make([]Device, 0, len(l.Devices))
+	for _, d := range l.Devices {
+		if !l.IsRevoked(d.PeerId) {
+			devices = append(devices, d)
+		}
+	}
+	l.Devices = devices
+	if other.Version > l.Version {
+		l.Version = other.Version
+	}
+	l.Version++
+}
+
+// Device list of the owner, a list with only the device itself is created the first time
+func FetchDeviceList(id identity.PeerIdentity) (DeviceList, error) {
+	l := &DeviceList{}
+	db, err := database.GetConnection()
+	if err != nil {
+		return *l, err
+	}
+	err = db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("device"))
+		if b == nil {
+			return ErrorDeviceListNotFound
+		}
+		buf := b.Get([]byte("list"))
+		if buf == nil {
+			return ErrorDeviceListNotFound
+		}
+		return json.Unmarshal(buf, l)
+	})
+	if err == ErrorDeviceListNotFound {
+		return NewDeviceList(id)
+	}
+	return *l, err
+}
+
+func (l *DeviceList) Save() error {
+	db, err := database.GetConnection()
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("device"))
+		if err != nil {
+			log.Debug("bucket device create error")
+			return err
+		}
+		return b.Put([]byte("list"), buf)
+	})
+}
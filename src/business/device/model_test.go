@@ -0,0 +1,47 @@
+package device
+
+import (
+	"testing"
+)
+
+func TestDeviceListMerge(t *testing.T) {
+	// Device A revoke X while device B link Y, both from the same version
+	base := DeviceList{Devices: []Device{{PeerId: "QmA"}, {PeerId: "QmB"}, {PeerId: "QmX"}}, Version: 3}
+	revoked := base
+	revoked.Devices = []Device{{PeerId: "QmA"}, {PeerId: "QmB"}}
+	revoked.Revoked = []string{"QmX"}
+	revoked.Version = 4
+	linked := base
+	linked.Devices = []Device{{PeerId: "QmA"}, {PeerId: "QmB"}, {PeerId: "QmX"}, {PeerId: "QmY"}}
+	linked.Version = 4
+
+	if revoked.Covers(linked) || linked.Covers(revoked) {
+		t.Error("Lists forked from the same version must not cover each other")
+	}
+	if !revoked.Covers(base) || !linked.Covers(base) {
+		t.Error("List must cover the version it was changed from")
+	}
+
+	merged := revoked
+	merged.Merge(linked)
+	if !merged.HasDevice("QmY") || merged.HasDevice("QmX") || !merged.IsRevoked("QmX") {
+		t.Errorf("Merged list must keep the device linked and the revocation, current: %v %v", merged.Devices, merged.Revoked)
+	}
+	if merged.Version != 5 {
+		t.Errorf("Merged list must follow both versions, current: %d", merged.Version)
+	}
+	if !merged.Covers(revoked) || !merged.Covers(linked) {
+		t.Error("Merged list must cover both lists")
+	}
+
+	// A later list of B missing the revocation must not bring the device revoked back
+	linked.Devices = append(linked.Devices, Device{PeerId: "QmZ"})
+	linked.Version = 6
+	if linked.Covers(merged) {
+		t.Error("List missing a revocation must not cover the merged list")
+	}
+	merged.Merge(linked)
+	if merged.HasDevice("QmX") || !merged.HasDevice("QmZ") || merged.Version != 7 {
+		t.Errorf("Revocation must be kept on merge, current: %v version %d", merged.Devices, merged.Version)
+	}
+}
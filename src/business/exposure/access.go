@@ -0,0 +1,137 @@
+// Package exposure will manage the secret exposure to the client
+//
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+package exposure
+
+import (
+	"encoding/json"
+	"github.com/PeerVault/PeerVault-Service/business/contact"
+	"github.com/PeerVault/PeerVault-Service/business/owner"
+	"github.com/PeerVault/PeerVault-Service/business/secret"
+	"github.com/PeerVault/PeerVault-Service/communication/peer"
+	"github.com/google/uuid"
+	"net/http"
+	"time"
+)
+
+type AccessRequest struct {
+	Owner string // QmPeerId of the peer owning the secret
+	KeyPath string
+	ExpirationDelay time.Duration // Hours during the access request will be valid
+	Namespace string // Destination namespace of the secrets, shared.<Owner> by default
+}
+
+type AccessResponse struct {
+	Uuid string
+	Approved bool
+}
+
+// ControllerAccess Manage Access Request, secret requested to another peer
+// POST : Ask another peer to share one of its secrets
+// GET : List access requests received
+// PUT : Approve or decline an access request received, the answer is delivered in the background
+func ControllerAccess(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodPost:
+		createAccessRequest(w, r)
+	case http.MethodGet:
+		getAccessRequests(w, r)
+	case http.MethodPut:
+		if !owner.PasswordVerification(r, true) {
+			http.Error(w, "{\"error\": \"X-OWNER-CODE is required\"}", http.StatusUnauthorized)
+			return
+		}
+		accessResponse(w, r)
+	default:
+		http.Error(w, "Invalid request method.", 405)
+	}
+}
+
+func createAccessRequest(w http.ResponseWriter, r *http.Request) {
+	request := &AccessRequest{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&request)
+	if err != nil {
+		http.Error(w, "{\"error\": \"Payload must be struct of AccessRequest\"}", http.StatusBadRequest)
+		return
+	}
+	if !peer.IsSingleKeyPath(request.KeyPath) {
+		http.Error(w, "{\"error\": \"KeyPath must name a single secret, globs are not allowed\"}", http.StatusBadRequest)
+		return
+	}
+	if request.Namespace != "" && !secret.IsValidNamespace(request.Namespace) {
+		http.Error(w, "{\"error\": \"Namespace must be alphanum with dash, dot and underscore only allowed\"}", http.StatusBadRequest)
+		return
+	}
+
+	o := owner.Owner{}
+	if err := o.FetchOwner(); err != nil {
+		log.Notice(err)
+		http.Error(w, "{\"error\": \"Owner not found\"}", http.StatusNotFound)
+		return
+	}
+
+	accessRequest := peer.AccessRequest{
+		Uuid:       uuid.New().String(),
+		Requester:  o.QmPeerId,
+		Owner:      contact.Resolve(request.Owner),
+		Expiration: time.Now().UTC().Add(request.ExpirationDelay * time.Hour).Format(time.RFC3339),
+		KeyPath:    request.KeyPath,
+	}
+	resultJSON, _ := json.Marshal(accessRequest)
+
+	go func() {
+		// Dial to owner of the secret
+		err := peer.RequestAccess(accessRequest, request.Namespace)
+		if err != nil {
+			log.Error("Error during access request dial")
+		}
+	}()
+
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resultJSON)
+}
+
+func getAccessRequests(w http.ResponseWriter, r *http.Request) {
+	accessRequests, err := peer.FetchAccessRequests()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+	resultJSON, _ := json.Marshal(accessRequests)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resultJSON)
+}
+
+func accessResponse(w http.ResponseWriter, r *http.Request) {
+	response := &AccessResponse{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&response)
+	if err != nil {
+		http.Error(w, "{\"error\": \"Payload must be struct of AccessResponse\"}", http.StatusBadRequest)
+		return
+	}
+
+	err = peer.RespondAccess(response.Uuid, response.Approved)
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusAccepted)
+	case peer.ErrorAccessNotFound:
+		http.Error(w, "{\"error\": \"Access request not found\"}", http.StatusNotFound)
+	case peer.ErrorAccessExpired:
+		http.Error(w, "{\"error\": \"Access request has expired, it has been declined\"}", http.StatusGone)
+	case peer.ErrorAccessKeyPath:
+		http.Error(w, "{\"error\": \"Access request must name a single secret, it has been declined\"}", http.StatusBadRequest)
+	case secret.ErrorSecretNotFound:
+		http.Error(w, "{\"error\": \"Not secret found with KeyPath requested, it has been declined\"}", http.StatusNotFound)
+	case peer.ErrorUuidInUse:
+		http.Error(w, "{\"error\": \"Access request uuid is already used by another share, it has been declined\"}", http.StatusConflict)
+	default:
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+	}
+}
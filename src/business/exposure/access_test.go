@@ -0,0 +1,34 @@
+package exposure
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCreateAccessRequestRefused(t *testing.T) {
+	defer newTestOwner(t, false)()
+
+	cases := []struct {
+		body string
+		status int
+	}{
+		{"not json", http.StatusBadRequest},
+		{`{"Owner": "QmOwner", "KeyPath": "staging.*", "ExpirationDelay": 1}`, http.StatusBadRequest},
+		{`{"Owner": "QmOwner", "KeyPath": "staging.database", "Namespace": "../staging"}`, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		w := serveTestRequest(ControllerAccess, http.MethodPost, "/expose/access", c.body)
+		if w.Code != c.status {
+			t.Errorf("Access request %s must be answered %d, current: %d %s", c.body, c.status, w.Code, w.Body)
+		}
+	}
+}
+
+func TestAccessResponseNotFound(t *testing.T) {
+	defer newTestOwner(t, false)()
+
+	w := serveTestRequest(ControllerAccess, http.MethodPut, "/expose/access", `{"Uuid": "unknown", "Approved": true}`)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Access request unknown must not be answered, current: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,209 @@
+// Package exposure will manage the secret exposure to the client
+//
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+package exposure
+
+import (
+	"encoding/json"
+	"github.com/PeerVault/PeerVault-Service/business/approval"
+	"github.com/PeerVault/PeerVault-Service/business/owner"
+	"github.com/PeerVault/PeerVault-Service/business/secret"
+	"github.com/PeerVault/PeerVault-Service/communication/peer"
+	"net/http"
+	"path"
+	"time"
+)
+
+type ApprovalResponse struct {
+	Uuid string
+	Approved bool
+	ValidityDelay time.Duration // Minutes during the approval will be valid
+}
+
+// ControllerPolicy Manage M of N approval policies
+// POST : Create or replace the policy of a namespace
+// GET : List policies
+// DELETE : Remove the policy of a namespace
+func ControllerPolicy(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !owner.PasswordVerification(r, true) {
+		http.Error(w, "{\"error\": \"X-OWNER-CODE is required\"}", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		createPolicy(w, r)
+	case http.MethodGet:
+		getPolicies(w, r)
+	case http.MethodDelete:
+		deletePolicy(w, r)
+	default:
+		http.Error(w, "Invalid request method.", 405)
+	}
+}
+
+// ControllerApproval Manage approval requests
+// GET : List approval requests, both sent and received
+// PUT : Approve or decline a request received as approver
+// DELETE : Remove a request, a new one will be sent on next exposure
+func ControllerApproval(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		getApprovalRequests(w, r)
+	case http.MethodPut:
+		if !owner.PasswordVerification(r, true) {
+			http.Error(w, "{\"error\": \"X-OWNER-CODE is required\"}", http.StatusUnauthorized)
+			return
+		}
+		approvalResponse(w, r)
+	case http.MethodDelete:
+		deleteApprovalRequest(w, r)
+	default:
+		http.Error(w, "Invalid request method.", 405)
+	}
+}
+
+func createPolicy(w http.ResponseWriter, r *http.Request) {
+	policy := &approval.Policy{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&policy)
+	if err != nil {
+		http.Error(w, "{\"error\": \"Payload must be struct of Policy\"}", http.StatusBadRequest)
+		return
+	}
+	if policy.Namespace == "" || policy.Required < 1 || policy.Required > len(policy.Approvers) {
+		http.Error(w, "{\"error\": \"Policy Required must be between 1 and the number of Approvers\"}", http.StatusBadRequest)
+		return
+	}
+	if err := policy.Save(); err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+	resultJSON, _ := json.Marshal(policy)
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write(resultJSON)
+}
+
+func getPolicies(w http.ResponseWriter, r *http.Request) {
+	policies, err := approval.FetchPolicies()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+	resultJSON, _ := json.Marshal(policies)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resultJSON)
+}
+
+func deletePolicy(w http.ResponseWriter, r *http.Request) {
+	policy := &approval.Policy{
+		Namespace: path.Base(r.RequestURI),
+	}
+	if err := policy.Delete(); err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func getApprovalRequests(w http.ResponseWriter, r *http.Request) {
+	requests, err := approval.FetchRequests()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+	resultJSON, _ := json.Marshal(requests)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resultJSON)
+}
+
+func approvalResponse(w http.ResponseWriter, r *http.Request) {
+	response := &ApprovalResponse{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&response)
+	if err != nil {
+		http.Error(w, "{\"error\": \"Payload must be struct of ApprovalResponse\"}", http.StatusBadRequest)
+		return
+	}
+
+	err = peer.SendApproval(response.Uuid, response.Approved, response.ValidityDelay * time.Minute)
+	if err == approval.ErrorRequestNotFound {
+		http.Error(w, "{\"error\": \"Approval request not found\"}", http.StatusNotFound)
+		return
+	}
+	if err == approval.ErrorApprovalValidity {
+		http.Error(w, "{\"error\": \"ValidityDelay must be at least one minute\"}", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func deleteApprovalRequest(w http.ResponseWriter, r *http.Request) {
+	request := &approval.Request{
+		Uuid: path.Base(r.RequestURI),
+	}
+	if err := request.Delete(); err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Verify the approval policy covering the secrets before an action
+// Return true when the action is allowed, otherwise the pending state is written to the client
+// The delivery of shared secrets is checked again by the peer, each secret against its policy
+// Several key paths requested together are joined with a comma
+func requireApproval(w http.ResponseWriter, action string, keyPath string, receiver string, secrets []secret.Secret) bool {
+	policy, request, status, err := peer.FindSecretsApproval(action, keyPath, receiver, secrets)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return false
+	}
+	switch status {
+	case approval.StatusGranted:
+		return true
+	case approval.StatusExpired:
+		request, err = peer.CreateApprovalRequest(policy, action, keyPath, receiver)
+		if err != nil {
+			log.Error(err)
+			http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+			return false
+		}
+		go peer.RequestApprovals(request, policy)
+		status = approval.StatusPending
+	}
+
+	writeApprovalStatus(w, peer.ApprovalStatus{
+		Uuid: request.Uuid,
+		Status: status,
+		Required: policy.Required,
+		Approvals: request.Approvals,
+	})
+	return false
+}
+
+// Write the approval an action is waiting for, forbidden once denied
+func writeApprovalStatus(w http.ResponseWriter, status peer.ApprovalStatus) {
+	resultJSON, _ := json.Marshal(status)
+	if status.Status == approval.StatusDenied {
+		w.WriteHeader(http.StatusForbidden)
+	} else {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	_, _ = w.Write(resultJSON)
+}
@@ -0,0 +1,139 @@
+// Package exposure will manage the secret exposure to the client
+//
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+package exposure
+
+import (
+	"encoding/json"
+	"github.com/PeerVault/PeerVault-Service/business/backup"
+	"github.com/PeerVault/PeerVault-Service/business/contact"
+	"github.com/PeerVault/PeerVault-Service/business/device"
+	"github.com/PeerVault/PeerVault-Service/business/owner"
+	"github.com/PeerVault/PeerVault-Service/communication/peer"
+	"github.com/google/uuid"
+	"net/http"
+)
+
+type BackupRequest struct {
+	PeerIds []string // QmPeerId or nickname of the trusted contacts holding the backup
+}
+
+// ControllerBackup Manage the encrypted backups of the vault stored on trusted contacts
+// POST : Create a backup and push it in the background to the contacts given, the holders status is sent as event backup.created
+// GET : List the backups created
+func ControllerBackup(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !owner.PasswordVerification(r, false) {
+		http.Error(w, "{\"error\": \"X-OWNER-CODE is required\"}", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		createBackup(w, r)
+	case http.MethodGet:
+		backups, err := backup.FetchBackups()
+		if err != nil {
+			log.Error(err)
+			http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+			return
+		}
+		resultJSON, _ := json.Marshal(backups)
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(resultJSON)
+	default:
+		http.Error(w, "Invalid request method.", 405)
+	}
+}
+
+// ControllerBackupRestore Restore the latest backup from the contacts given
+// POST : The secrets not stored on this device are restored in the background, the result is sent as event backup.restored or backup.restore.failed
+func ControllerBackupRestore(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	if !owner.PasswordVerification(r, true) {
+		http.Error(w, "{\"error\": \"X-OWNER-CODE is required\"}", http.StatusUnauthorized)
+		return
+	}
+
+	request := &BackupRequest{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&request)
+	if err != nil || len(request.PeerIds) == 0 {
+		http.Error(w, "{\"error\": \"Payload must be struct of BackupRequest\"}", http.StatusBadRequest)
+		return
+	}
+
+	err = peer.RestoreBackup(resolveHolders(request.PeerIds))
+	if err == device.ErrorNoMasterProof {
+		http.Error(w, "{\"error\": \"Device has no master proof, prove the seed of the owner on PUT /owner/seed first\"}", http.StatusFailedDependency)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ControllerBackupHeld List the backups stored on this device for other owners
+// GET : The quota of each contact is set on the contact
+func ControllerBackupHeld(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	if !owner.PasswordVerification(r, false) {
+		http.Error(w, "{\"error\": \"X-OWNER-CODE is required\"}", http.StatusUnauthorized)
+		return
+	}
+
+	helds, err := backup.FetchHeld()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+	resultJSON, _ := json.Marshal(helds)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resultJSON)
+}
+
+func createBackup(w http.ResponseWriter, r *http.Request) {
+	request := &BackupRequest{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&request)
+	if err != nil || len(request.PeerIds) == 0 {
+		http.Error(w, "{\"error\": \"Payload must be struct of BackupRequest\"}", http.StatusBadRequest)
+		return
+	}
+
+	b, err := peer.CreateBackup(uuid.New().String(), resolveHolders(request.PeerIds))
+	if err == device.ErrorNoMasterProof {
+		http.Error(w, "{\"error\": \"Device has no master proof, prove the seed of the owner on PUT /owner/seed first\"}", http.StatusFailedDependency)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+	resultJSON, _ := json.Marshal(b)
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = w.Write(resultJSON)
+}
+
+func resolveHolders(holders []string) []string {
+	var peerIds []string
+	for _, holder := range holders {
+		peerIds = append(peerIds, contact.Resolve(holder))
+	}
+	return peerIds
+}
@@ -0,0 +1,65 @@
+package exposure
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/PeerVault/PeerVault-Service/business/backup"
+)
+
+func TestBackupRequiresMasterProof(t *testing.T) {
+	defer newTestOwner(t, false)()
+	createTestSecret(t, "staging", "database")
+
+	handlers := []struct {
+		handler http.HandlerFunc
+		target string
+	}{
+		{ControllerBackup, "/backup"},
+		{ControllerBackupRestore, "/backup/restore"},
+	}
+	for _, h := range handlers {
+		w := serveTestRequest(h.handler, http.MethodPost, h.target, "not json")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Payload of %s must be verified, current: %d %s", h.target, w.Code, w.Body)
+		}
+		w = serveTestRequest(h.handler, http.MethodPost, h.target, `{"PeerIds": ["QmHolder"]}`)
+		if w.Code != http.StatusFailedDependency {
+			t.Errorf("Device without master proof must not use %s, current: %d %s", h.target, w.Code, w.Body)
+		}
+	}
+}
+
+func TestCreateBackupAccepted(t *testing.T) {
+	defer newTestOwner(t, true)()
+	createTestSecret(t, "staging", "database")
+
+	// The holders are pushed in the background, the backup is returned at once
+	w := serveTestRequest(ControllerBackup, http.MethodPost, "/backup", `{"PeerIds": ["QmHolder"]}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Backup must be created, current: %d %s", w.Code, w.Body)
+	}
+	b := backup.Backup{}
+	if err := json.Unmarshal(w.Body.Bytes(), &b); err != nil {
+		t.Fatal(err)
+	}
+	if b.Secrets != 1 || len(b.Holders) != 1 || b.Holders[0].Status != backup.HolderStatusPending {
+		t.Fatalf("Backup must be returned with its holders pending, current: %v", b)
+	}
+
+	// The holder unreachable is saved on the backup
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		backups, err := backup.FetchBackups()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(backups) == 1 && backups[0].Holders[0].Status == backup.HolderStatusError {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Backup not delivered must keep the status of its holder")
+}
@@ -0,0 +1,104 @@
+// Package exposure will manage the secret exposure to the client
+//
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+package exposure
+
+import (
+	"encoding/json"
+	"github.com/PeerVault/PeerVault-Service/business/contact"
+	"github.com/PeerVault/PeerVault-Service/business/owner"
+	"github.com/PeerVault/PeerVault-Service/communication/peer"
+	"net/http"
+	"path"
+)
+
+type BlockRequest struct {
+	PeerId string // QmPeerId or nickname of the peer to block
+	RequestUuid string // Or the uuid of a share request received, its sender is blocked
+}
+
+// ControllerBlock Manage the peers blocked, their connections and streams are refused
+// POST : Block a peer, directly or from a share request received
+// GET : List the peers blocked
+// DELETE : Unblock a peer with /contact/block/<QmPeerId>
+func ControllerBlock(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !owner.PasswordVerification(r, false) {
+		http.Error(w, "{\"error\": \"X-OWNER-CODE is required\"}", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		blockPeer(w, r)
+	case http.MethodGet:
+		getBlocked(w, r)
+	case http.MethodDelete:
+		unblockPeer(w, r)
+	default:
+		http.Error(w, "Invalid request method.", 405)
+	}
+}
+
+func blockPeer(w http.ResponseWriter, r *http.Request) {
+	request := &BlockRequest{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&request)
+	if err != nil || (request.PeerId == "" && request.RequestUuid == "") {
+		http.Error(w, "{\"error\": \"Payload must be struct of BlockRequest\"}", http.StatusBadRequest)
+		return
+	}
+
+	var c contact.Contact
+	if request.RequestUuid != "" {
+		c, err = peer.BlockRequestSender(request.RequestUuid)
+	} else {
+		c, err = peer.BlockPeer(contact.Resolve(request.PeerId))
+	}
+	if err == peer.ErrorShareNotFound {
+		http.Error(w, "{\"error\": \"Share request not found\"}", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+	resultJSON, _ := json.Marshal(c)
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write(resultJSON)
+}
+
+func getBlocked(w http.ResponseWriter, r *http.Request) {
+	contacts, err := contact.FetchContacts()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+	blocked := []contact.Contact{}
+	for _, c := range contacts {
+		if c.Blocked {
+			blocked = append(blocked, c)
+		}
+	}
+	resultJSON, _ := json.Marshal(blocked)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resultJSON)
+}
+
+func unblockPeer(w http.ResponseWriter, r *http.Request) {
+	_, err := contact.Unblock(contact.Resolve(path.Base(r.RequestURI)))
+	if err == contact.ErrorContactNotFound {
+		http.Error(w, "{\"error\": \"Contact not found\"}", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -8,11 +8,11 @@ package exposure
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/PeerVault/PeerVault-Service/business/approval"
 	"github.com/PeerVault/PeerVault-Service/business/owner"
 	"github.com/PeerVault/PeerVault-Service/business/secret"
 	"github.com/PeerVault/PeerVault-Service/communication/peer"
 	"github.com/PeerVault/PeerVault-Service/crypto"
-	"github.com/google/uuid"
 	"github.com/op/go-logging"
 	"net/http"
 	"path"
@@ -73,6 +73,9 @@ func getSecretValue(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
 		return
 	}
+	if !requireApproval(w, approval.ActionExpose, string(keyPath), "", []secret.Secret{s}) {
+		return
+	}
 
 	o := owner.Owner{}
 	if o.FetchOwner() != nil {
@@ -108,52 +111,50 @@ func createShareRequest(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write([]byte("{\"error\": \"Payload must be struct of ShareRequest\"}"))
 		return
 	}
-
-	// Check if KeyPath exist
-	_, err = secret.FetchSecret([]byte(shareRequest.KeyPath))
-	if err == secret.ErrorSecretNotFound {
-		http.Error(w, "{\"error\": \"Not secret found with KeyPath specified\"}", http.StatusNotFound)
+	if shareRequest.Receiver == "" {
+		http.Error(w, "{\"error\": \"Receiver is required, create an invite to share with a peer not known yet\"}", http.StatusBadRequest)
 		return
 	}
-	if err != nil {
-		log.Error(err)
-		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+	share, ok := saveShare(w, shareRequest)
+	if !ok {
 		return
 	}
+	resultJSON, _ := json.Marshal(share)
 
-	// Get Owner
-	o := owner.Owner{}
-	if o.FetchOwner() != nil {
-		log.Notice(err)
-		http.Error(w, "{\"error\": \"Owner not found\"}", http.StatusNotFound)
-	}
+	// Dial to receiver, the error is kept on the share
+	go func() {
+		_ = peer.RequestShare(share)
+	}()
 
-	// Create Share
-	share := &Share{
-		Uuid:       uuid.New().String(),
-		Sender:     o.QmPeerId,
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resultJSON)
+}
+
+// Verify the key paths and the approvals then save the share
+// Return false when the error has been written to the client
+func saveShare(w http.ResponseWriter, shareRequest *ShareRequest) (peer.Share, bool) {
+	share, status, err := peer.CreateShare(peer.Share{
 		Receiver:   shareRequest.Receiver,
 		Expiration: time.Now().UTC().Add(shareRequest.ExpirationDelay * time.Hour).Format(time.RFC3339),
 		KeyPath:    shareRequest.KeyPath,
-	}
-	err = share.Save()
-	if err != nil {
+		KeyPaths:   shareRequest.KeyPaths,
+		Subscribe:  shareRequest.Subscribe,
+		IncludeFuture: shareRequest.IncludeFuture,
+	})
+	switch err {
+	case nil:
+		return share, true
+	case peer.ErrorShareInvalidKeyPath:
+		http.Error(w, "{\"error\": \"KeyPath is not a valid key path or glob\"}", http.StatusBadRequest)
+	case peer.ErrorShareNoSecret:
+		http.Error(w, "{\"error\": \"Not secret found with KeyPath specified\"}", http.StatusNotFound)
+	case peer.ErrorShareApproval:
+		writeApprovalStatus(w, status)
+	default:
 		log.Error(err)
 		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
-		return
 	}
-	resultJSON, _ := json.Marshal(share)
-
-	go func() {
-		// Dial to receiver
-		err := peer.Dial(shareRequest.Receiver, peer.PidShareRequest, resultJSON)
-		if err != nil {
-			log.Error("Error during share request dial")
-		}
-	}()
-
-	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write(resultJSON)
+	return share, false
 }
 
 // Retrieved share request
@@ -193,18 +194,32 @@ func shareResponse(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write([]byte("{\"error\": \"Payload must be struct of ShareRequest\"}"))
 		return
 	}
-	shareResponseJSON, _ := json.Marshal(shareResponse)
-
-	go func() {
-		// Approve the request locally to trust data when secret will arrive
-		if shareResponse.Approved {
-			peer.ApproveLocalRequest(shareResponse.Uuid)
-		}
-		// Dial to sender to confirm share
-		err := peer.Dial(shareResponse.Sender, peer.PidShareResponse, shareResponseJSON)
-		if err != nil {
-			log.Error("Error during share response dial")
-		}
-	}()
-	w.WriteHeader(http.StatusOK)
-}
\ No newline at end of file
+	if shareResponse.Namespace != "" && !secret.IsValidNamespace(shareResponse.Namespace) {
+		http.Error(w, "{\"error\": \"Namespace must be alphanum with dash, dot and underscore only allowed\"}", http.StatusBadRequest)
+		return
+	}
+	destination := shareResponse.Namespace
+	shareResponse.Namespace = ""
+
+	// Approve the request locally to trust data when secret will arrive, then confirm to the sender in the background
+	err = peer.RespondShare(peer.ShareResponse{
+		Uuid: shareResponse.Uuid,
+		Sender: shareResponse.Sender,
+		Approved: shareResponse.Approved,
+		KeyPaths: shareResponse.KeyPaths,
+	}, destination)
+	if err == peer.ErrorShareNotFound {
+		http.Error(w, "{\"error\": \"Share request not found\"}", http.StatusNotFound)
+		return
+	}
+	if err == peer.ErrorShareKeyPath {
+		http.Error(w, "{\"error\": \"KeyPaths must be part of the share request\"}", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
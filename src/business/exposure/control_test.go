@@ -0,0 +1,197 @@
+package exposure
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PeerVault/PeerVault-Service/business/approval"
+	"github.com/PeerVault/PeerVault-Service/business/owner"
+	"github.com/PeerVault/PeerVault-Service/business/secret"
+	"github.com/PeerVault/PeerVault-Service/communication/peer"
+	"github.com/PeerVault/PeerVault-Service/crypto"
+	"github.com/PeerVault/PeerVault-Service/database"
+	"github.com/PeerVault/PeerVault-Service/identity"
+	"go.etcd.io/bbolt"
+)
+
+// Owner created in a temporary database as on POST /owner, the password is never asked
+// The libp2p node is not started, every dial to a peer fails
+// Return the function removing the database
+func newTestOwner(t *testing.T, masterProof bool) func() {
+	dir, err := ioutil.TempDir("", "peervault-exposure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bbolt.Open(filepath.Join(dir, "peervault.db"), 0600, &bbolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	database.SetConnection(db)
+
+	seed := &crypto.Seed{}
+	seed.CreateSeed()
+	master, err := seed.CreateMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, err := crypto.CreateChildKey(master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pvtKey, err := crypto.BipKeyToLibp2p(child)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerIdentity, err := identity.CreateIdentity("alice", pvtKey, child.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if masterProof {
+		if err := peerIdentity.SetMasterProof(master, child); err != nil {
+			t.Fatal(err)
+		}
+		peerIdentity.SetVaultKey(master)
+	}
+	o := owner.Owner{QmPeerId: peerIdentity.Id, Nickname: "alice", DeviceName: "alice", AskPassword: owner.PasswordPolicyNone}
+	if err := o.PutOwner(); err != nil {
+		t.Fatal(err)
+	}
+	if err := peerIdentity.SaveIdentity(); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		_ = db.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// Request served by the handler, the response is returned once written
+func serveTestRequest(handler http.HandlerFunc, method string, target string, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return w
+}
+
+// Secret of the owner ciphered with its key, as created by the client
+func createTestSecret(t *testing.T, namespace string, key string) {
+	o := owner.Owner{}
+	if err := o.FetchOwner(); err != nil {
+		t.Fatal(err)
+	}
+	id, err := o.GetIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipherValue, err := crypto.EncryptAes(id.GetChildKeyAsByte(), []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretData := secret.Secret{Namespace: namespace, Type: secret.SecretTypePassword, Key: key, Value: string(cipherValue)}
+	if err := secretData.CreateSecret(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateShareRequestRefused(t *testing.T) {
+	defer newTestOwner(t, false)()
+	createTestSecret(t, "staging", "database")
+
+	cases := []struct {
+		body string
+		status int
+	}{
+		{"not json", http.StatusBadRequest},
+		{`{"KeyPath": "staging.database"}`, http.StatusBadRequest},
+		{`{"Receiver": "QmReceiver", "KeyPath": "staging.[", "ExpirationDelay": 1}`, http.StatusBadRequest},
+		{`{"Receiver": "QmReceiver", "KeyPath": "production.*", "ExpirationDelay": 1}`, http.StatusNotFound},
+	}
+	for _, c := range cases {
+		w := serveTestRequest(ControllerRequest, http.MethodPost, "/expose/request", c.body)
+		if w.Code != c.status {
+			t.Errorf("Share request %s must be answered %d, current: %d %s", c.body, c.status, w.Code, w.Body)
+		}
+	}
+	if shares, _ := FetchShares(); len(shares) != 0 {
+		t.Errorf("Share request refused must not be saved, current: %v", shares)
+	}
+}
+
+func TestCreateShareRequestDeliveryError(t *testing.T) {
+	defer newTestOwner(t, false)()
+	createTestSecret(t, "staging", "database")
+
+	// The receiver is dialed in the background, the share is returned at once
+	w := serveTestRequest(ControllerRequest, http.MethodPost, "/expose/request", `{"Receiver": "QmReceiver", "KeyPath": "staging.database", "ExpirationDelay": 1}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Share request must be created, current: %d %s", w.Code, w.Body)
+	}
+	share := Share{}
+	if err := json.Unmarshal(w.Body.Bytes(), &share); err != nil {
+		t.Fatal(err)
+	}
+
+	// The dial error is kept on the share
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		w = serveTestRequest(ControllerRequest, http.MethodGet, "/expose/request", "")
+		var shares []Share
+		if err := json.Unmarshal(w.Body.Bytes(), &shares); err != nil {
+			t.Fatal(err)
+		}
+		if len(shares) == 1 && shares[0].Uuid == share.Uuid && shares[0].DeliveryError != "" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Share request not delivered must keep the dial error")
+}
+
+func TestCreateShareRequestWaitsForApproval(t *testing.T) {
+	defer newTestOwner(t, false)()
+	createTestSecret(t, "production", "database")
+	p := approval.Policy{Namespace: "production", Required: 1, Approvers: []string{"QmApprover"}}
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serveTestRequest(ControllerRequest, http.MethodPost, "/expose/request", `{"Receiver": "QmReceiver", "KeyPath": "production.database", "ExpirationDelay": 1}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Share covered by a policy must wait for the approval, current: %d %s", w.Code, w.Body)
+	}
+	status := peer.ApprovalStatus{}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != approval.StatusPending || status.Required != 1 || status.Uuid == "" {
+		t.Errorf("Approval pending must be returned, current: %v", status)
+	}
+	if shares, _ := FetchShares(); len(shares) != 0 {
+		t.Errorf("Share waiting for the approval must not be saved, current: %v", shares)
+	}
+}
+
+func TestShareResponseRefused(t *testing.T) {
+	defer newTestOwner(t, false)()
+
+	cases := []struct {
+		body string
+		status int
+	}{
+		{"not json", http.StatusBadRequest},
+		{`{"Uuid": "unknown", "Sender": "QmSender", "Approved": true, "Namespace": "../staging"}`, http.StatusBadRequest},
+		{`{"Uuid": "unknown", "Sender": "QmSender", "Approved": true}`, http.StatusNotFound},
+	}
+	for _, c := range cases {
+		w := serveTestRequest(ControllerRequest, http.MethodPut, "/expose/request", c.body)
+		if w.Code != c.status {
+			t.Errorf("Share response %s must be answered %d, current: %d %s", c.body, c.status, w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Package exposure will manage the secret exposure to the client
+//
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+package exposure
+
+import (
+	"encoding/json"
+	"github.com/PeerVault/PeerVault-Service/business/device"
+	"github.com/PeerVault/PeerVault-Service/business/owner"
+	"github.com/PeerVault/PeerVault-Service/communication/peer"
+	"net/http"
+	"path"
+)
+
+type DeviceLinkRequest struct {
+	PeerId string // QmPeerId of a device already linked to the owner
+}
+
+// ControllerDevice Manage the devices of the owner
+// GET : List the devices linked
+// DELETE : Revoke a device, the other devices are notified in the background
+func ControllerDevice(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		getDevices(w, r)
+	case http.MethodDelete:
+		if !owner.PasswordVerification(r, true) {
+			http.Error(w, "{\"error\": \"X-OWNER-CODE is required\"}", http.StatusUnauthorized)
+			return
+		}
+		revokeDevice(w, r)
+	default:
+		http.Error(w, "Invalid request method.", 405)
+	}
+}
+
+// ControllerDeviceLink Link this device, restored from the seed, to another device of the owner
+// POST : Prove the relationship to the device given, the signed device list is returned
+func ControllerDeviceLink(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	if !owner.PasswordVerification(r, true) {
+		http.Error(w, "{\"error\": \"X-OWNER-CODE is required\"}", http.StatusUnauthorized)
+		return
+	}
+
+	request := &DeviceLinkRequest{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&request)
+	if err != nil {
+		http.Error(w, "{\"error\": \"Payload must be struct of DeviceLinkRequest\"}", http.StatusBadRequest)
+		return
+	}
+	l, err := peer.LinkDevice(request.PeerId)
+	if err != nil {
+		switch err {
+		case device.ErrorNoMasterProof:
+			http.Error(w, "{\"error\": \"Device has no master proof, prove the seed of the owner on PUT /owner/seed first\"}", http.StatusFailedDependency)
+		case device.ErrorDeviceNotLinked, device.ErrorDeviceListSignature:
+			http.Error(w, "{\"error\": \"Device link refused, the device is not from the same seed\"}", http.StatusForbidden)
+		default:
+			log.Error(err)
+			http.Error(w, "{\"error\": \"Device cannot be linked, peer unreachable\"}", http.StatusBadGateway)
+		}
+		return
+	}
+	resultJSON, _ := json.Marshal(l)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resultJSON)
+}
+
+// ControllerDeviceSync Synchronize the vault with the other devices of the owner
+// POST : Request the changes not known yet in the background, the count of secrets updated and conflicts is sent as event vault.synced
+func ControllerDeviceSync(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	if !owner.PasswordVerification(r, false) {
+		http.Error(w, "{\"error\": \"X-OWNER-CODE is required\"}", http.StatusUnauthorized)
+		return
+	}
+
+	err := peer.StartSyncVault()
+	if err == device.ErrorNoMasterProof {
+		http.Error(w, "{\"error\": \"Device has no vault key, prove the seed of the owner on PUT /owner/seed first\"}", http.StatusFailedDependency)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func getDevices(w http.ResponseWriter, r *http.Request) {
+	o := owner.Owner{}
+	if err := o.FetchOwner(); err != nil {
+		log.Notice(err)
+		http.Error(w, "{\"error\": \"Owner not found\"}", http.StatusNotFound)
+		return
+	}
+	id, err := o.GetIdentity()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"Cannot find Identity of current owner\"}", http.StatusInternalServerError)
+		return
+	}
+	l, err := device.FetchDeviceList(id)
+	if err == device.ErrorNoMasterProof {
+		http.Error(w, "{\"error\": \"Device has no master proof, prove the seed of the owner on PUT /owner/seed first\"}", http.StatusFailedDependency)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+	resultJSON, _ := json.Marshal(l)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resultJSON)
+}
+
+func revokeDevice(w http.ResponseWriter, r *http.Request) {
+	err := peer.RevokeDevice(path.Base(r.RequestURI))
+	if err == device.ErrorDeviceNotLinked {
+		http.Error(w, "{\"error\": \"Device not linked to the owner\"}", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,25 @@
+package exposure
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestDeviceSyncRequiresVaultKey(t *testing.T) {
+	defer newTestOwner(t, false)()
+
+	w := serveTestRequest(ControllerDeviceSync, http.MethodPost, "/device/sync", "")
+	if w.Code != http.StatusFailedDependency {
+		t.Errorf("Device without vault key must not synchronize, current: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestDeviceSyncAccepted(t *testing.T) {
+	defer newTestOwner(t, true)()
+
+	// The devices are dialed in the background, the result is sent as event
+	w := serveTestRequest(ControllerDeviceSync, http.MethodPost, "/device/sync", "")
+	if w.Code != http.StatusAccepted {
+		t.Errorf("Vault sync must be started, current: %d %s", w.Code, w.Body)
+	}
+}
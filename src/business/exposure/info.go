@@ -0,0 +1,69 @@
+// Package exposure will manage the secret exposure to the client
+//
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+package exposure
+
+import (
+	"encoding/json"
+	"github.com/PeerVault/PeerVault-Service/business/contact"
+	"github.com/PeerVault/PeerVault-Service/communication/peer"
+	"net/http"
+	"path"
+)
+
+// ControllerPeerInfo Manage the profile of the peers
+// GET /peer/info : Profile of the local peer as sent to the other peers
+// GET /peer/info/<QmPeerId> : Profile of a remote peer, query parameter refresh=true ignore the cache
+func ControllerPeerInfo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+
+	var info peer.PeerInfo
+	var err error
+	if id := path.Base(r.URL.Path); id != "info" {
+		info, err = peer.FetchPeerInfo(contact.Resolve(id), r.URL.Query().Get("refresh") == "true")
+	} else {
+		info, err = peer.LocalInfo()
+	}
+	if err == peer.ErrorInfoSignature {
+		http.Error(w, "{\"error\": \"Profile signature is not valid\"}", http.StatusBadGateway)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"Profile not available, peer unreachable\"}", http.StatusBadGateway)
+		return
+	}
+	resultJSON, _ := json.Marshal(info)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resultJSON)
+}
+
+// ControllerPeerStatus Status of the libp2p node
+// GET : Reachability of the node and the type of every connection, direct or relay
+func ControllerPeerStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+
+	status, err := peer.Status()
+	if err == peer.ErrorNodeNotStarted {
+		http.Error(w, "{\"error\": \"Peer node is not started\"}", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+	resultJSON, _ := json.Marshal(status)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resultJSON)
+}
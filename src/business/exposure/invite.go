@@ -0,0 +1,142 @@
+// Package exposure will manage the secret exposure to the client
+//
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+package exposure
+
+import (
+	"encoding/json"
+	"github.com/PeerVault/PeerVault-Service/communication/peer"
+	"net/http"
+	"path"
+)
+
+type InviteResponse struct {
+	Uuid string // Uuid of the pending share
+	Expiration string
+	Code string // One time code to give to the receiver, usable as QR code
+}
+
+type InviteRedeemRequest struct {
+	Code string
+}
+
+// ControllerInvite Manage share invites, shares sent to a peer not known yet
+// POST : Create a pending share and its one time invite, Receiver is ignored
+// GET : List invites created
+// DELETE : Revoke an invite and its pending share
+func ControllerInvite(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodPost:
+		createInvite(w, r)
+	case http.MethodGet:
+		getInvites(w, r)
+	case http.MethodDelete:
+		deleteInvite(w, r)
+	default:
+		http.Error(w, "Invalid request method.", 405)
+	}
+}
+
+// ControllerInviteRedeem Redeem an invite received out of band
+// POST : The share request of the sender will follow as a regular share request
+func ControllerInviteRedeem(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodPost:
+		redeemInvite(w, r)
+	default:
+		http.Error(w, "Invalid request method.", 405)
+	}
+}
+
+func createInvite(w http.ResponseWriter, r *http.Request) {
+	shareRequest := &ShareRequest{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&shareRequest)
+	if err != nil {
+		http.Error(w, "{\"error\": \"Payload must be struct of ShareRequest\"}", http.StatusBadRequest)
+		return
+	}
+	shareRequest.Receiver = ""
+	share, ok := saveShare(w, shareRequest)
+	if !ok {
+		return
+	}
+
+	_, code, err := peer.CreateInvite(share.Uuid, share.Expiration)
+	if err != nil {
+		log.Error(err)
+		_ = (&Share{Uuid: share.Uuid}).Delete()
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+	resultJSON, _ := json.Marshal(InviteResponse{
+		Uuid: share.Uuid,
+		Expiration: share.Expiration,
+		Code: code,
+	})
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write(resultJSON)
+}
+
+func getInvites(w http.ResponseWriter, r *http.Request) {
+	invites, err := peer.FetchInvites()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+	resultJSON, _ := json.Marshal(invites)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resultJSON)
+}
+
+func deleteInvite(w http.ResponseWriter, r *http.Request) {
+	uuid := path.Base(r.RequestURI)
+	if err := peer.DeleteInvite(uuid); err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+	share := &Share{
+		Uuid: uuid,
+	}
+	if err := share.Delete(); err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func redeemInvite(w http.ResponseWriter, r *http.Request) {
+	request := &InviteRedeemRequest{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&request)
+	if err != nil {
+		http.Error(w, "{\"error\": \"Payload must be struct of InviteRedeemRequest\"}", http.StatusBadRequest)
+		return
+	}
+	inviteCode, err := peer.DecodeInviteCode(request.Code)
+	if err != nil {
+		http.Error(w, "{\"error\": \"Invite code is malformed\"}", http.StatusBadRequest)
+		return
+	}
+
+	reply, err := peer.RedeemInvite(inviteCode)
+	if err == peer.ErrorInviteRefused {
+		http.Error(w, "{\"error\": \"Invite is expired, already redeemed or not valid\"}", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"Invite cannot be redeemed, sender unreachable\"}", http.StatusBadGateway)
+		return
+	}
+	resultJSON, _ := json.Marshal(reply)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resultJSON)
+}
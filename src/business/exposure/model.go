@@ -7,6 +7,7 @@ package exposure
 
 import (
 	"encoding/json"
+	"github.com/PeerVault/PeerVault-Service/communication/peer"
 	"github.com/PeerVault/PeerVault-Service/database"
 	"go.etcd.io/bbolt"
 	"time"
@@ -18,19 +19,30 @@ type Share struct {
 	Sender string
 	Receiver string
 	Expiration string
-	KeyPath string
+	KeyPath string // Key path or glob of key paths such as staging.*
+	KeyPaths []string `json:",omitempty"` // Several key paths or globs shared together
+	Subscribe bool // Receiver will get every later version of the secret
+	IncludeFuture bool // Receiver will get the secrets created later matching the key path glob
+	Delivered []string
+	Results []peer.ShareItemResult // Result reported by the receiver for each secret delivered
+	DeliveryError string `json:",omitempty"` // Error of the last dial to the receiver, empty once it replied
 }
 
 type ShareRequest struct {
 	Receiver string
 	KeyPath string
+	KeyPaths []string // Several key paths or globs, all of them will be delivered in one stream
 	ExpirationDelay time.Duration // Hours during the sharing request will be valid
+	Subscribe bool
+	IncludeFuture bool
 }
 
 type ShareResponse struct {
 	Uuid string
 	Sender string
 	Approved bool
+	KeyPaths []string `json:",omitempty"` // Subset of the key paths approved, every key paths when empty
+	Namespace string `json:",omitempty"` // Destination namespace of the secrets, shared.<Sender> by default
 }
 
 func (s *Share) Save() error {
@@ -0,0 +1,53 @@
+// Package exposure will manage the secret exposure to the client
+//
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+package exposure
+
+import (
+	"encoding/json"
+	"github.com/PeerVault/PeerVault-Service/communication/peer"
+	"net/http"
+	"path"
+)
+
+// ControllerSubscription Manage the subscriptions to the shares received
+// GET : List the shares receiving later versions or secrets
+// DELETE : Unsubscribe, the sender is notified and the later updates are refused
+func ControllerSubscription(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		getSubscriptions(w, r)
+	case http.MethodDelete:
+		unsubscribe(w, r)
+	default:
+		http.Error(w, "Invalid request method.", 405)
+	}
+}
+
+func getSubscriptions(w http.ResponseWriter, r *http.Request) {
+	subscriptions, err := peer.FetchSubscriptions()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+	resultJSON, _ := json.Marshal(subscriptions)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resultJSON)
+}
+
+func unsubscribe(w http.ResponseWriter, r *http.Request) {
+	err := peer.Unsubscribe(path.Base(r.RequestURI))
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusOK)
+	case peer.ErrorSubscriptionNotFound:
+		http.Error(w, "{\"error\": \"Subscription not found\"}", http.StatusNotFound)
+	default:
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+	}
+}
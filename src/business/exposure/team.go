@@ -0,0 +1,296 @@
+// Package exposure will manage the secret exposure to the client
+//
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+package exposure
+
+import (
+	"encoding/json"
+	"github.com/PeerVault/PeerVault-Service/business/owner"
+	"github.com/PeerVault/PeerVault-Service/business/secret"
+	"github.com/PeerVault/PeerVault-Service/business/team"
+	"github.com/PeerVault/PeerVault-Service/communication/peer"
+	"github.com/PeerVault/PeerVault-Service/identity"
+	"github.com/google/uuid"
+	"net/http"
+	"path"
+)
+
+type TeamRequest struct {
+	Name string
+	Namespace string
+	Members []string
+}
+
+type TeamInvitationResponse struct {
+	Uuid string // Uuid of the team
+	Accepted bool
+}
+
+type TeamMemberRequest struct {
+	Team string // Uuid of the team
+	PeerId string
+	Admin bool
+}
+
+// ControllerTeam Manage Team Vault
+// POST : Create a team owning a namespace, the current owner is admin
+// GET : List teams
+// DELETE : Leave a team, its admins are notified in the background and the local copy of the membership is removed
+func ControllerTeam(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !owner.PasswordVerification(r, false) {
+		http.Error(w, "{\"error\": \"X-OWNER-CODE is required\"}", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		createTeam(w, r)
+	case http.MethodGet:
+		getTeams(w, r)
+	case http.MethodDelete:
+		deleteTeam(w, r)
+	default:
+		http.Error(w, "Invalid request method.", 405)
+	}
+}
+
+// ControllerTeamInvitation Manage the invitations to teams received from their admins
+// GET : List invitations not answered yet
+// PUT : Accept or decline an invitation, the team and its secrets are only saved once accepted
+func ControllerTeamInvitation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !owner.PasswordVerification(r, false) {
+		http.Error(w, "{\"error\": \"X-OWNER-CODE is required\"}", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		resultJSON, _ := json.Marshal(peer.FetchTeamInvitations())
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(resultJSON)
+	case http.MethodPut:
+		teamInvitationResponse(w, r)
+	default:
+		http.Error(w, "Invalid request method.", 405)
+	}
+}
+
+// ControllerTeamMember Manage Team Vault membership, only allowed to admins
+// POST : Add a member, or promote a member as admin
+// DELETE : Remove a member, the group key is rotated
+func ControllerTeamMember(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !owner.PasswordVerification(r, false) {
+		http.Error(w, "{\"error\": \"X-OWNER-CODE is required\"}", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		updateTeamMember(w, r, false)
+	case http.MethodDelete:
+		updateTeamMember(w, r, true)
+	default:
+		http.Error(w, "Invalid request method.", 405)
+	}
+}
+
+func createTeam(w http.ResponseWriter, r *http.Request) {
+	teamRequest := &TeamRequest{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&teamRequest)
+	if err != nil {
+		http.Error(w, "{\"error\": \"Payload must be struct of TeamRequest\"}", http.StatusBadRequest)
+		return
+	}
+	if !secret.IsValidNamespace(teamRequest.Namespace) {
+		http.Error(w, "{\"error\": \"Team Namespace must be alphanum with dash, dot and underscore only allowed\"}", http.StatusBadRequest)
+		return
+	}
+	// A team can neither be created inside the namespace of another team nor around it
+	if _, err := team.FetchTeamOverlapping(teamRequest.Namespace); err != team.ErrorTeamNotFound {
+		http.Error(w, "{\"error\": \"Namespace already owned by a team\"}", http.StatusConflict)
+		return
+	}
+
+	o := owner.Owner{}
+	if err := o.FetchOwner(); err != nil {
+		log.Notice(err)
+		http.Error(w, "{\"error\": \"Owner not found\"}", http.StatusNotFound)
+		return
+	}
+	id, err := o.GetIdentity()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"Cannot find Identity of current owner\"}", http.StatusInternalServerError)
+		return
+	}
+
+	t := &team.Team{
+		Uuid: uuid.New().String(),
+		Name: teamRequest.Name,
+		Namespace: teamRequest.Namespace,
+		Version: 1,
+	}
+	t.AddMember(o.QmPeerId, true)
+	for _, member := range teamRequest.Members {
+		t.AddMember(member, false)
+	}
+	if err := saveSignedTeam(t, id, true); err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+
+	go pushTeam(*t, nil)
+
+	t.GroupKey = ""
+	resultJSON, _ := json.Marshal(t)
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write(resultJSON)
+}
+
+func getTeams(w http.ResponseWriter, r *http.Request) {
+	teams, err := team.FetchTeams()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+	for i := range teams {
+		teams[i].GroupKey = ""
+	}
+	resultJSON, _ := json.Marshal(teams)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resultJSON)
+}
+
+func teamInvitationResponse(w http.ResponseWriter, r *http.Request) {
+	response := &TeamInvitationResponse{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&response)
+	if err != nil {
+		http.Error(w, "{\"error\": \"Payload must be struct of TeamInvitationResponse\"}", http.StatusBadRequest)
+		return
+	}
+
+	err = peer.RespondTeamInvitation(response.Uuid, response.Accepted)
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusOK)
+	case peer.ErrorTeamInvitationNotFound:
+		http.Error(w, "{\"error\": \"Team invitation not found\"}", http.StatusNotFound)
+	case peer.ErrorTeamNamespaceInUse:
+		http.Error(w, "{\"error\": \"Team namespace already used by local secrets or another team\"}", http.StatusConflict)
+	default:
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+	}
+}
+
+func deleteTeam(w http.ResponseWriter, r *http.Request) {
+	t, err := team.FetchTeam(path.Base(r.RequestURI))
+	if err == team.ErrorTeamNotFound {
+		http.Error(w, "{\"error\": \"Team not found\"}", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+	if err := peer.LeaveTeam(t); err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func updateTeamMember(w http.ResponseWriter, r *http.Request, removal bool) {
+	memberRequest := &TeamMemberRequest{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&memberRequest)
+	if err != nil {
+		http.Error(w, "{\"error\": \"Payload must be struct of TeamMemberRequest\"}", http.StatusBadRequest)
+		return
+	}
+
+	t, err := team.FetchTeam(memberRequest.Team)
+	if err == team.ErrorTeamNotFound {
+		http.Error(w, "{\"error\": \"Team not found\"}", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+
+	o := owner.Owner{}
+	if err := o.FetchOwner(); err != nil {
+		log.Notice(err)
+		http.Error(w, "{\"error\": \"Owner not found\"}", http.StatusNotFound)
+		return
+	}
+	if !t.IsAdmin(o.QmPeerId) {
+		http.Error(w, "{\"error\": \"Only team admins can change the membership\"}", http.StatusForbidden)
+		return
+	}
+	id, err := o.GetIdentity()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"Cannot find Identity of current owner\"}", http.StatusInternalServerError)
+		return
+	}
+
+	var removed []string
+	if removal {
+		if !t.IsMember(memberRequest.PeerId) {
+			http.Error(w, "{\"error\": \"Peer is not member of the team\"}", http.StatusNotFound)
+			return
+		}
+		t.RemoveMember(memberRequest.PeerId)
+		removed = append(removed, memberRequest.PeerId)
+	} else {
+		t.AddMember(memberRequest.PeerId, memberRequest.Admin)
+	}
+	t.Version++
+
+	// Removed member must not be able to read or write the next team secrets
+	if err := saveSignedTeam(&t, id, removal); err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+
+	go pushTeam(t, removed)
+
+	t.GroupKey = ""
+	resultJSON, _ := json.Marshal(t)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resultJSON)
+}
+
+func saveSignedTeam(t *team.Team, id identity.PeerIdentity, rotate bool) error {
+	if rotate {
+		if err := t.RotateGroupKey(id); err != nil {
+			return err
+		}
+	}
+	if err := t.Sign(id); err != nil {
+		return err
+	}
+	return t.Save()
+}
+
+func pushTeam(t team.Team, removed []string) {
+	if err := peer.PushTeam(t, removed); err != nil {
+		log.Error("Error during team membership push")
+		log.Error(err)
+	}
+}
@@ -0,0 +1,94 @@
+// Package exposure will manage the secret exposure to the client
+//
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+package exposure
+
+import (
+	"encoding/json"
+	"github.com/PeerVault/PeerVault-Service/business/contact"
+	"github.com/PeerVault/PeerVault-Service/business/owner"
+	"github.com/PeerVault/PeerVault-Service/communication/peer"
+	"net/http"
+)
+
+type VerificationRequest struct {
+	PeerId string // QmPeerId or nickname of the contact to verify
+}
+
+type VerificationResponse struct {
+	Uuid string
+	Match bool // Short authentication string displayed is the same on both devices
+}
+
+// ControllerVerification Manage the verification of a contact fingerprint
+// POST : Start a verification, the short authentication string is sent on websocket on both sides
+// GET : List verifications in progress
+// PUT : Confirm or deny the short authentication string
+func ControllerVerification(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !owner.PasswordVerification(r, false) {
+		http.Error(w, "{\"error\": \"X-OWNER-CODE is required\"}", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		startVerification(w, r)
+	case http.MethodGet:
+		resultJSON, _ := json.Marshal(peer.FetchVerifications())
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(resultJSON)
+	case http.MethodPut:
+		confirmVerification(w, r)
+	default:
+		http.Error(w, "Invalid request method.", 405)
+	}
+}
+
+func startVerification(w http.ResponseWriter, r *http.Request) {
+	request := &VerificationRequest{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&request)
+	if err != nil {
+		http.Error(w, "{\"error\": \"Payload must be struct of VerificationRequest\"}", http.StatusBadRequest)
+		return
+	}
+
+	v, err := peer.StartVerification(contact.Resolve(request.PeerId))
+	if err == peer.ErrorVerificationFailed {
+		http.Error(w, "{\"error\": \"Verification refused by the peer\"}", http.StatusBadGateway)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"Verification cannot start, peer unreachable\"}", http.StatusBadGateway)
+		return
+	}
+	resultJSON, _ := json.Marshal(v)
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write(resultJSON)
+}
+
+func confirmVerification(w http.ResponseWriter, r *http.Request) {
+	response := &VerificationResponse{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&response)
+	if err != nil {
+		http.Error(w, "{\"error\": \"Payload must be struct of VerificationResponse\"}", http.StatusBadRequest)
+		return
+	}
+
+	err = peer.ConfirmVerification(response.Uuid, response.Match)
+	if err == peer.ErrorVerificationNotFound {
+		http.Error(w, "{\"error\": \"Verification not found or expired\"}", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -6,6 +6,7 @@
 package owner
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/PeerVault/PeerVault-Service/crypto"
@@ -40,10 +41,18 @@ func Controller(w http.ResponseWriter, r *http.Request) {
 }
 
 //  Manage seed restoration
+// POST : Create the owner from the seed
+// PUT : Prove the seed of an owner created without master proof, required to link devices and replicate the vault
 func ControllerSeed(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodPost:
 		restoreOwner(w, r)
+	case http.MethodPut:
+		if !PasswordVerification(r, false) {
+			http.Error(w, "{\"error\": \"X-OWNER-CODE is required\"}", http.StatusUnauthorized)
+			return
+		}
+		proveOwner(w, r)
 	default:
 		http.Error(w, "Invalid request method.", 405)
 	}
@@ -149,6 +158,15 @@ func createOwner(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	// Master proof and vault key let the other devices of the owner verify this device and replicate the vault
+	err = peerIdentity.SetMasterProof(master, child)
+	if err != nil {
+		log.Debug("Error during master proof creation")
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	peerIdentity.SetVaultKey(master)
 	o.QmPeerId = peerIdentity.Id
 
 	// Save owner in DB
@@ -278,6 +296,15 @@ func restoreOwner(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	// Master proof and vault key let the other devices of the owner verify this device and replicate the vault
+	err = peerIdentity.SetMasterProof(master, child)
+	if err != nil {
+		log.Debug("Error during master proof creation")
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	peerIdentity.SetVaultKey(master)
 	o.QmPeerId = peerIdentity.Id
 
 	// Save owner in DB
@@ -299,6 +326,73 @@ func restoreOwner(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusCreated)
 }
 
+// Create the master proof and vault key of an owner created before they existed
+// The seed must derive the identity of the device, nothing else is changed
+func proveOwner(w http.ResponseWriter, r *http.Request) {
+	o := &Owner{}
+	err := o.FetchOwner()
+	if err != nil {
+		log.Notice(err)
+		http.Error(w, "{\"error\": \"Owner not found\"}", http.StatusNotFound)
+		return
+	}
+	peerIdentity, err := o.GetIdentity()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"Cannot find Identity of current owner\"}", http.StatusInternalServerError)
+		return
+	}
+
+	m := struct {
+		Mnemonic string
+	}{}
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&m)
+	if err != nil || m.Mnemonic == "" {
+		http.Error(w, "{\"error\": \"Seed must be present to prove the owner\"}", http.StatusBadRequest)
+		return
+	}
+
+	seed := &crypto.Seed {
+		Mnemonic: m.Mnemonic,
+	}
+	seed.CreateSeed()
+	master, err := seed.CreateMasterKey()
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	child, err := crypto.CreateChildKey(master)
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !bytes.Equal(child.Key, peerIdentity.GetChildKeyAsByte()) {
+		http.Error(w, "{\"error\": \"Seed is not the seed of the owner\"}", http.StatusForbidden)
+		return
+	}
+	err = peerIdentity.SetMasterProof(master, child)
+	if err != nil {
+		log.Debug("Error during master proof creation")
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	peerIdentity.SetVaultKey(master)
+
+	err = peerIdentity.UpdateIdentity()
+	if err != nil {
+		log.Debug("Error during proved identity save")
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
 // Generate a code to confirm deletion of owner and therefore any information of the current device
 func requestDeleteOwner(w http.ResponseWriter, r *http.Request) {
 	// TODO must notify other peer of the deletion of device
@@ -36,8 +36,15 @@ func Controller(w http.ResponseWriter, r *http.Request) {
 }
 
 // Retrieved secret information
+// Query parameters namespace, origin (local or shared), sender and share filter the secrets
 func getSecrets(w http.ResponseWriter, r *http.Request) {
-	secrets, err := FetchSecrets()
+	query := r.URL.Query()
+	secrets, err := FetchSecretsFiltered(Filter{
+		Namespace: query.Get("namespace"),
+		Origin: query.Get("origin"),
+		Sender: query.Get("sender"),
+		ShareUuid: query.Get("share"),
+	})
 	if err != nil {
 		fmt.Printf("INTERNAL ERROR: %s", err.Error())
 		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
@@ -70,6 +77,16 @@ func createSecret(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "{\"error\": \"Secret Namespace and Key must be alphanum with dash and underscore only allowed\"}", http.StatusBadRequest)
 		return
 	}
+	// Origin is never given by the client, a secret received keep its origin when updated
+	secret.Origin = nil
+	previous, err := FetchSecret([]byte(secret.Namespace + "." + secret.Key))
+	if err == nil {
+		secret.Origin = previous.Origin
+	} else if err != ErrorSecretNotFound {
+		log.Error(err)
+		http.Error(w, "{\"error\": \"internal server error\"}", http.StatusInternalServerError)
+		return
+	}
 	o := owner.Owner{}
 	if o.FetchOwner() != nil {
 		log.Notice(err)
@@ -11,7 +11,9 @@ import (
 	"github.com/PeerVault/PeerVault-Service/database"
 	"github.com/op/go-logging"
 	"go.etcd.io/bbolt"
+	"path"
 	"regexp"
+	"strings"
 )
 
 type Error int
@@ -33,6 +35,8 @@ const (
 
 var (
 	log = logging.MustGetLogger("peerVaultLogger")
+	updateListeners []func(Secret)
+	changeListeners []func(string, *Secret)
 )
 
 
@@ -43,16 +47,87 @@ type Secret struct {
 	Key string
 	Value string
 	Description string
+	Version int // Incremented each time the secret is saved
+	Origin *Origin `json:",omitempty"` // Only for secrets received from another peer
+}
+
+// Origin of a secret received from another peer
+// Only set on reception, kept when the secret is updated locally, replicated to the devices and backed up
+type Origin struct {
+	Sender string // QmPeerId of the peer who sent the secret
+	ShareUuid string
+	ReceivedAt string
+	KeyPath string // Key path of the secret on the sender side
+	Version int `json:",omitempty"` // Version of the secret on the sender side, an older version pushed later is ignored
+}
+
+// Filter applied on the secrets listed, empty fields are ignored
+type Filter struct {
+	Namespace string // Namespace and its sub namespaces
+	Origin string // "local" or "shared"
+	Sender string
+	ShareUuid string
+}
+
+func (f Filter) Match(secret Secret) bool {
+	if f.Namespace != "" && secret.Namespace != f.Namespace && !strings.HasPrefix(secret.Namespace, f.Namespace + ".") {
+		return false
+	}
+	if f.Origin == "local" && secret.Origin != nil || f.Origin == "shared" && secret.Origin == nil {
+		return false
+	}
+	if f.Sender != "" && (secret.Origin == nil || secret.Origin.Sender != f.Sender) {
+		return false
+	}
+	if f.ShareUuid != "" && (secret.Origin == nil || secret.Origin.ShareUuid != f.ShareUuid) {
+		return false
+	}
+	return true
+}
+
+// Register a listener called after each creation or update of a secret
+// The listener receive the secret as stored, therefore with the value encrypted
+func OnSecretUpdate(listener func(Secret)) {
+	updateListeners = append(updateListeners, listener)
+}
+
+func notifySecretUpdate(secret Secret) {
+	for _, listener := range updateListeners {
+		go listener(secret)
+	}
+}
+
+// Register a listener called after every change of the local vault, quiet ones included,
+// except the changes replicated from another device of the owner
+// The secret is nil when the key path has been deleted
+func OnSecretChange(listener func(string, *Secret)) {
+	changeListeners = append(changeListeners, listener)
+}
+
+func notifySecretChange(keyPath string, secret *Secret) {
+	for _, listener := range changeListeners {
+		listener(keyPath, secret)
+	}
 }
 
 func (secret *Secret) assertSecretStruct() bool {
-	reNs := regexp.MustCompile("^[0-9A-Za-z_.-]+$")
 	reKey := regexp.MustCompile("^[0-9A-Za-z_-]+$")
 
-	return reNs.MatchString(secret.Namespace) && reKey.MatchString(secret.Key) && secret.Type <= SecretTypeRsa
+	return IsValidNamespace(secret.Namespace) && reKey.MatchString(secret.Key) && secret.Type <= SecretTypeRsa
+}
+
+// Namespace must be alphanum with dash, dot and underscore only allowed
+func IsValidNamespace(namespace string) bool {
+	reNs := regexp.MustCompile("^[0-9A-Za-z_.-]+$")
+	return reNs.MatchString(namespace)
 }
 
 func FetchSecrets() ([]Secret, error) {
+	return FetchSecretsFiltered(Filter{})
+}
+
+// Fetch secrets matching the filter, values are never returned
+func FetchSecretsFiltered(filter Filter) ([]Secret, error) {
 	db, err := database.GetConnection()
 	if err != nil {
 		return nil, err
@@ -75,7 +150,9 @@ func FetchSecrets() ([]Secret, error) {
 			log.Debug(secret.Key)
 			log.Debug(secret.Value)
 			secret.Value = ""
-			secrets = append(secrets, secret)
+			if filter.Match(secret) {
+				secrets = append(secrets, secret)
+			}
 		}
 
 		return nil
@@ -87,6 +164,55 @@ func FetchSecrets() ([]Secret, error) {
 	return secrets, nil
 }
 
+// Match a key path against a single key path or a glob such as staging.*
+func MatchKeyPath(pattern string, keyPath string) bool {
+	matched, err := path.Match(pattern, keyPath)
+	return err == nil && matched
+}
+
+// Return the first key path or glob matching the key path
+func MatchAnyKeyPath(patterns []string, keyPath string) (string, bool) {
+	for _, pattern := range patterns {
+		if MatchKeyPath(pattern, keyPath) {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// Fetch every secrets, value included, matching one of the key paths or globs of key paths
+// A secret matching several of them is returned once
+func FetchSecretsMatching(patterns ...string) ([]Secret, error) {
+	db, err := database.GetConnection()
+	if err != nil {
+		return nil, err
+	}
+	var secrets []Secret
+
+	err = db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("secret"))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if _, ok := MatchAnyKeyPath(patterns, string(k)); !ok {
+				return nil
+			}
+			var secret Secret
+			if err := json.Unmarshal(v, &secret); err != nil {
+				return err
+			}
+			secrets = append(secrets, secret)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return secrets, nil
+}
+
 func FetchSecret(keyPath []byte) (Secret, error) {
 	secret := &Secret{}
 	db, err := database.GetConnection()
@@ -113,18 +239,28 @@ func FetchSecret(keyPath []byte) (Secret, error) {
 }
 
 func (secret *Secret) CreateSecret() error {
-	db, err := database.GetConnection()
-	if err != nil {
-		return err
-	}
+	return secret.save(true, true)
+}
+
+// Create the secret without notifying the update listeners
+// Used when the secret is a copy replicated from another peer that must not be sent back
+func (secret *Secret) CreateSecretQuietly() error {
+	return secret.save(false, true)
+}
+
+// Create the secret received from another device of the owner, no listener is notified
+func (secret *Secret) ReplicateSecret() error {
+	return secret.save(false, false)
+}
 
-	// Secret serialized to json.
-	buf, err := json.Marshal(&secret)
+func (secret *Secret) save(notify bool, record bool) error {
+	db, err := database.GetConnection()
 	if err != nil {
 		return err
 	}
 
-	return db.Update(func(tx *bbolt.Tx) error {
+	keyPath := []byte(secret.Namespace + "." + secret.Key)
+	err = db.Update(func(tx *bbolt.Tx) error {
 		var b *bbolt.Bucket
 		b = tx.Bucket([]byte("secret"))
 		if b == nil {
@@ -136,12 +272,53 @@ func (secret *Secret) CreateSecret() error {
 			}
 			b = b2
 		}
-		return b.Put([]byte(secret.Namespace + "." + secret.Key), buf)
+
+		// Follow the version of the previous secret stored at the same key path
+		secret.Version = 1
+		if buf := b.Get(keyPath); buf != nil {
+			previous := Secret{}
+			if err := json.Unmarshal(buf, &previous); err != nil {
+				return err
+			}
+			secret.Version = previous.Version + 1
+		}
+
+		// Secret serialized to json.
+		buf, err := json.Marshal(&secret)
+		if err != nil {
+			return err
+		}
+		return b.Put(keyPath, buf)
 	})
+	if err != nil {
+		return err
+	}
+
+	if record {
+		s := *secret
+		notifySecretChange(string(keyPath), &s)
+	}
+	if notify {
+		notifySecretUpdate(*secret)
+	}
+	return nil
 }
 
 // keyPath are the fullpath of the key, namespace concat with key, spaced by dot
 func DeleteSecret(keyPath string) error {
+	if err := removeSecret(keyPath); err != nil {
+		return err
+	}
+	notifySecretChange(keyPath, nil)
+	return nil
+}
+
+// Delete the secret as deleted by another device of the owner, no listener is notified
+func DeleteSecretReplicated(keyPath string) error {
+	return removeSecret(keyPath)
+}
+
+func removeSecret(keyPath string) error {
 	db, err := database.GetConnection()
 	if err != nil {
 		return err
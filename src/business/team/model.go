@@ -0,0 +1,281 @@
+// Package team will manage the team vaults, namespaces owned by a group of peers
+//
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+package team
+
+import (
+	crand "crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/PeerVault/PeerVault-Service/crypto"
+	"github.com/PeerVault/PeerVault-Service/database"
+	"github.com/PeerVault/PeerVault-Service/identity"
+	"github.com/op/go-logging"
+	"go.etcd.io/bbolt"
+	"strings"
+)
+
+type Error int
+
+func (k Error) Error() (msg string) {
+	switch k {
+	case ErrorTeamNotFound:
+		msg = "The team was not found"
+	case ErrorTeamSignature:
+		msg = "The team membership signature is not valid"
+	}
+	return fmt.Sprintf("%s (%d)", msg, k)
+}
+
+const (
+	ErrorTeamNotFound = Error(1)
+	ErrorTeamSignature = Error(2)
+)
+
+var (
+	log = logging.MustGetLogger("peerVaultLogger")
+)
+
+// Team own a namespace shared by all its members
+// The membership list is signed by one of the admins, every change increment the Version
+type Team struct {
+	Uuid string
+	Name string
+	Namespace string
+	Admins []string // QmPeerId of the admins, admins are also members
+	Members []string // QmPeerId of the members
+	Version int
+	Signer string
+	Signature string
+	GroupKey string `json:",omitempty"` // Key shared by members, cipher with the owner key when stored locally
+}
+
+// Payload of the membership list covered by the signature
+func (t Team) Payload() []byte {
+	t.Signature = ""
+	t.GroupKey = ""
+	buf, _ := json.Marshal(t)
+	return buf
+}
+
+func (t *Team) Sign(id identity.PeerIdentity) error {
+	t.Signer = id.Id
+	signature, err := id.Sign(t.Payload())
+	if err != nil {
+		return err
+	}
+	t.Signature = base64.StdEncoding.EncodeToString(signature)
+	return nil
+}
+
+// Verify the membership list has been signed by one of its admins
+func (t Team) Verify() error {
+	if !t.IsAdmin(t.Signer) {
+		return ErrorTeamSignature
+	}
+	signature, err := base64.StdEncoding.DecodeString(t.Signature)
+	if err != nil {
+		return err
+	}
+	valid, err := identity.Verify(t.Signer, t.Payload(), signature)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return ErrorTeamSignature
+	}
+	return nil
+}
+
+func (t Team) IsAdmin(QmPeerId string) bool {
+	return contains(t.Admins, QmPeerId)
+}
+
+func (t Team) IsMember(QmPeerId string) bool {
+	return contains(t.Members, QmPeerId)
+}
+
+func (t *Team) AddMember(QmPeerId string, admin bool) {
+	if !t.IsMember(QmPeerId) {
+		t.Members = append(t.Members, QmPeerId)
+	}
+	if admin && !t.IsAdmin(QmPeerId) {
+		t.Admins = append(t.Admins, QmPeerId)
+	}
+}
+
+func (t *Team) RemoveMember(QmPeerId string) {
+	t.Members = remove(t.Members, QmPeerId)
+	t.Admins = remove(t.Admins, QmPeerId)
+}
+
+// Check if the secret namespace belongs to the team namespace
+func (t Team) MatchNamespace(namespace string) bool {
+	return namespace == t.Namespace || strings.HasPrefix(namespace, t.Namespace + ".")
+}
+
+// Generate a new group key, the previous one is replaced
+func (t *Team) RotateGroupKey(id identity.PeerIdentity) error {
+	groupKey := make([]byte, 32)
+	if _, err := crand.Read(groupKey); err != nil {
+		return err
+	}
+	return t.SetGroupKey(id, groupKey)
+}
+
+// Keep the group key cipher with the owner key
+func (t *Team) SetGroupKey(id identity.PeerIdentity, groupKey []byte) error {
+	cipherGroupKey, err := crypto.EncryptAes(id.GetChildKeyAsByte(), groupKey)
+	if err != nil {
+		return err
+	}
+	t.GroupKey = string(cipherGroupKey)
+	return nil
+}
+
+func (t Team) GetGroupKey(id identity.PeerIdentity) ([]byte, error) {
+	return crypto.DecryptAes(id.GetChildKeyAsByte(), []byte(t.GroupKey))
+}
+
+func (t *Team) Save() error {
+	db, err := database.GetConnection()
+	if err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(&t)
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bbolt.Tx) error {
+		var b *bbolt.Bucket
+		b = tx.Bucket([]byte("team"))
+		if b == nil {
+			log.Debug("bucket team is nil")
+			b2, err := tx.CreateBucket([]byte("team"))
+			if err != nil {
+				log.Debug("bucket team create error nil")
+				return err
+			}
+			b = b2
+		}
+		return b.Put([]byte(t.Uuid), buf)
+	})
+}
+
+func (t *Team) Delete() error {
+	db, err := database.GetConnection()
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("team"))
+		if b == nil {
+			return nil
+		}
+		log.Debugf("Delete the team uuid: %s", t.Uuid)
+		return b.Delete([]byte(t.Uuid))
+	})
+}
+
+func FetchTeam(uuid string) (Team, error) {
+	t := &Team{}
+	db, err := database.GetConnection()
+	if err != nil {
+		return *t, err
+	}
+
+	err = db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("team"))
+		if b == nil {
+			return ErrorTeamNotFound
+		}
+		buf := b.Get([]byte(uuid))
+		if buf == nil {
+			return ErrorTeamNotFound
+		}
+		return json.Unmarshal(buf, t)
+	})
+	return *t, err
+}
+
+func FetchTeams() ([]Team, error) {
+	db, err := database.GetConnection()
+	if err != nil {
+		return nil, err
+	}
+	var teams []Team
+
+	err = db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("team"))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var t Team
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			teams = append(teams, t)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return teams, nil
+}
+
+// Find the team owning a secret namespace
+func FetchTeamOfNamespace(namespace string) (Team, error) {
+	teams, err := FetchTeams()
+	if err != nil {
+		return Team{}, err
+	}
+	for _, t := range teams {
+		if t.MatchNamespace(namespace) {
+			return t, nil
+		}
+	}
+	return Team{}, ErrorTeamNotFound
+}
+
+// Find the team whose namespace contains the namespace, or is contained in it
+func FetchTeamOverlapping(namespace string) (Team, error) {
+	teams, err := FetchTeams()
+	if err != nil {
+		return Team{}, err
+	}
+	probe := Team{Namespace: namespace}
+	for _, t := range teams {
+		if t.MatchNamespace(namespace) || probe.MatchNamespace(t.Namespace) {
+			return t, nil
+		}
+	}
+	return Team{}, ErrorTeamNotFound
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func remove(list []string, value string) []string {
+	result := make([]string, 0, len(list))
+	for _, item := range list {
+		if item != value {
+			result = append(result, item)
+		}
+	}
+	return result
+}
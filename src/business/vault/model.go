@@ -0,0 +1,291 @@
+// Package vault will manage the replication of the secrets between the devices of the owner
+//
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+package vault
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/PeerVault/PeerVault-Service/business/secret"
+	"github.com/PeerVault/PeerVault-Service/database"
+	"github.com/op/go-logging"
+	"go.etcd.io/bbolt"
+	"strings"
+	"time"
+)
+
+const (
+	ClockEqual = iota
+	ClockBefore = iota // Every counter is lower or equal
+	ClockAfter = iota // Every counter is greater or equal
+	ClockConcurrent = iota // Both clocks have a counter greater than the other
+
+	ApplyIgnored = iota // Change already known or older than the local one
+	ApplyUpdated = iota // Change is newer, the local secret must be replaced
+	ApplyConflict = iota // Change is concurrent with the local one
+)
+
+var (
+	log = logging.MustGetLogger("peerVaultLogger")
+)
+
+// Clock is a version vector, the counter of changes made by each device on a key path
+type Clock map[string]int
+
+// Entry keep the replication state of a key path, deleted key paths are kept as tombstone
+type Entry struct {
+	KeyPath string
+	Clock Clock
+	Deleted bool
+	UpdatedAt string
+	ChangeKey string // Key of the latest change in the change log
+}
+
+// Change made on a key path by a device, kept in the change log to be sent to the other devices
+type Change struct {
+	Origin string // QmPeerId of the device who made the change
+	Seq int // Sequence of the change on its origin device
+	KeyPath string
+	Clock Clock
+	Deleted bool
+	Secret *secret.Secret `json:",omitempty"` // Value cipher with the vault key, nil for deletes
+	CreatedAt string
+}
+
+func (c Clock) Compare(other Clock) int {
+	before, after := false, false
+	for device, counter := range c {
+		if counter > other[device] {
+			after = true
+		}
+	}
+	for device, counter := range other {
+		if counter > c[device] {
+			before = true
+		}
+	}
+	switch {
+	case before && after:
+		return ClockConcurrent
+	case before:
+		return ClockBefore
+	case after:
+		return ClockAfter
+	}
+	return ClockEqual
+}
+
+// Merge return the clock knowing every changes of both clocks
+func (c Clock) Merge(other Clock) Clock {
+	merged := Clock{}
+	for device, counter := range c {
+		merged[device] = counter
+	}
+	for device, counter := range other {
+		if counter > merged[device] {
+			merged[device] = counter
+		}
+	}
+	return merged
+}
+
+func changeKey(origin string, seq int) string {
+	return fmt.Sprintf("%s/%020d", origin, seq)
+}
+
+// Origin of the latest change of the key path, empty when never changed
+func (e Entry) Origin() string {
+	if i := strings.LastIndex(e.ChangeKey, "/"); i > 0 {
+		return e.ChangeKey[:i]
+	}
+	return ""
+}
+
+// Record a change made locally by the device, the secret is nil for a delete
+func RecordLocal(device string, keyPath string, s *secret.Secret) (Change, error) {
+	change := Change{
+		Origin: device,
+		KeyPath: keyPath,
+		Deleted: s == nil,
+		Secret: s,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	db, err := database.GetConnection()
+	if err != nil {
+		return change, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		entries, changes, err := buckets(tx)
+		if err != nil {
+			return err
+		}
+		entry, err := getEntry(entries, keyPath)
+		if err != nil {
+			return err
+		}
+		entry.Clock = entry.Clock.Merge(Clock{})
+		entry.Clock[device]++
+		change.Clock = entry.Clock
+
+		seq, err := changes.NextSequence()
+		if err != nil {
+			return err
+		}
+		change.Seq = int(seq)
+		return putChange(entries, changes, entry, change)
+	})
+	return change, err
+}
+
+// Apply the metadata of a change received from another device
+// The caller must replace the local secret when ApplyUpdated is returned,
+// and keep both versions when ApplyConflict is returned
+// On conflict the change is kept with the merged clock, which is only right when its version win,
+// the caller must record a new local change when the local version is kept
+func Apply(change Change) (int, error) {
+	result := ApplyIgnored
+	db, err := database.GetConnection()
+	if err != nil {
+		return result, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		entries, changes, err := buckets(tx)
+		if err != nil {
+			return err
+		}
+		entry, err := getEntry(entries, change.KeyPath)
+		if err != nil {
+			return err
+		}
+		switch change.Clock.Compare(entry.Clock) {
+		case ClockAfter:
+			result = ApplyUpdated
+		case ClockConcurrent:
+			result = ApplyConflict
+		default:
+			return nil
+		}
+		// The merged clock know both versions, the change log keep the change for the next devices
+		if result == ApplyConflict {
+			change.Clock = change.Clock.Merge(entry.Clock)
+			change.Deleted = entry.Deleted && change.Deleted
+		}
+		return putChange(entries, changes, entry, change)
+	})
+	return result, err
+}
+
+// Changes of the change log unknown by a device, known is the latest sequence received from each origin
+func ChangesSince(known map[string]int) ([]Change, error) {
+	var changes []Change
+	err := eachChange(func(change Change) {
+		if change.Seq > known[change.Origin] {
+			changes = append(changes, change)
+		}
+	})
+	return changes, err
+}
+
+// Latest sequence in the change log for each origin device
+func Known() (map[string]int, error) {
+	known := make(map[string]int)
+	err := eachChange(func(change Change) {
+		if change.Seq > known[change.Origin] {
+			known[change.Origin] = change.Seq
+		}
+	})
+	return known, err
+}
+
+func FetchEntry(keyPath string) (Entry, error) {
+	entry := Entry{}
+	db, err := database.GetConnection()
+	if err != nil {
+		return entry, err
+	}
+	err = db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("replica"))
+		if b == nil {
+			entry = Entry{KeyPath: keyPath, Clock: Clock{}}
+			return nil
+		}
+		entry, err = getEntry(b, keyPath)
+		return err
+	})
+	return entry, err
+}
+
+func buckets(tx *bbolt.Tx) (*bbolt.Bucket, *bbolt.Bucket, error) {
+	entries, err := tx.CreateBucketIfNotExists([]byte("replica"))
+	if err != nil {
+		log.Debug("bucket replica create error")
+		return nil, nil, err
+	}
+	changes, err := tx.CreateBucketIfNotExists([]byte("changelog"))
+	if err != nil {
+		log.Debug("bucket changelog create error")
+		return nil, nil, err
+	}
+	return entries, changes, nil
+}
+
+func getEntry(b *bbolt.Bucket, keyPath string) (Entry, error) {
+	entry := Entry{KeyPath: keyPath, Clock: Clock{}}
+	buf := b.Get([]byte(keyPath))
+	if buf == nil {
+		return entry, nil
+	}
+	err := json.Unmarshal(buf, &entry)
+	return entry, err
+}
+
+// Save the change, the previous change of the same key path is removed from the change log
+// as the new one supersede it
+func putChange(entries *bbolt.Bucket, changes *bbolt.Bucket, entry Entry, change Change) error {
+	if entry.ChangeKey != "" {
+		if err := changes.Delete([]byte(entry.ChangeKey)); err != nil {
+			return err
+		}
+	}
+	entry.Clock = change.Clock
+	entry.Deleted = change.Deleted
+	entry.UpdatedAt = change.CreatedAt
+	entry.ChangeKey = changeKey(change.Origin, change.Seq)
+
+	buf, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	if err := changes.Put([]byte(entry.ChangeKey), buf); err != nil {
+		return err
+	}
+	buf, err = json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return entries.Put([]byte(entry.KeyPath), buf)
+}
+
+func eachChange(fn func(change Change)) error {
+	db, err := database.GetConnection()
+	if err != nil {
+		return err
+	}
+	return db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("changelog"))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var change Change
+			if err := json.Unmarshal(v, &change); err != nil {
+				return err
+			}
+			fn(change)
+			return nil
+		})
+	})
+}
+
@@ -0,0 +1,40 @@
+package vault
+
+import (
+	"testing"
+)
+
+func TestClockCompare(t *testing.T) {
+	a := Clock{"QmA": 2, "QmB": 1}
+
+	if result := a.Compare(Clock{"QmA": 2, "QmB": 1}); result != ClockEqual {
+		t.Errorf("Same clocks must be equal, current: %d", result)
+	}
+	if result := a.Compare(Clock{"QmA": 1}); result != ClockAfter {
+		t.Errorf("Clock knowing more changes must be after, current: %d", result)
+	}
+	if result := a.Compare(Clock{"QmA": 2, "QmB": 1, "QmC": 1}); result != ClockBefore {
+		t.Errorf("Clock missing a device must be before, current: %d", result)
+	}
+	if result := a.Compare(Clock{"QmA": 1, "QmB": 2}); result != ClockConcurrent {
+		t.Errorf("Clocks changed on both sides must be concurrent, current: %d", result)
+	}
+
+	merged := a.Merge(Clock{"QmA": 1, "QmB": 2})
+	if merged["QmA"] != 2 || merged["QmB"] != 2 {
+		t.Errorf("Merged clock must keep the greatest counters, current: %v", merged)
+	}
+	if result := merged.Compare(a); result != ClockAfter {
+		t.Errorf("Merged clock must be after both clocks, current: %d", result)
+	}
+}
+
+func TestEntryOrigin(t *testing.T) {
+	entry := Entry{ChangeKey: changeKey("QmA", 3)}
+	if origin := entry.Origin(); origin != "QmA" {
+		t.Errorf("Origin must be the device of the latest change, current: %s", origin)
+	}
+	if origin := (Entry{}).Origin(); origin != "" {
+		t.Errorf("Entry never changed must have no origin, current: %s", origin)
+	}
+}
@@ -8,9 +8,11 @@ package control
 import (
 	"net/http"
 	"time"
+	"github.com/PeerVault/PeerVault-Service/business/contact"
 	"github.com/PeerVault/PeerVault-Service/business/exposure"
 	"github.com/PeerVault/PeerVault-Service/business/owner"
 	"github.com/PeerVault/PeerVault-Service/business/secret"
+	"github.com/PeerVault/PeerVault-Service/communication/relay"
 	"github.com/op/go-logging"
 )
 
@@ -27,7 +29,7 @@ func Listen(address* string) {
 
 	// GET / POST owner information
 	http.HandleFunc("/owner", owner.Controller)
-	// POST owner SEED information
+	// POST owner SEED information, PUT prove the SEED of an owner created without master proof
 	http.HandleFunc("/owner/seed", owner.ControllerSeed)
 	// GET / POST secret information
 	http.HandleFunc("/secret", secret.Controller)
@@ -36,6 +38,63 @@ func Listen(address* string) {
 	http.HandleFunc("/expose/", exposure.Controller)
 	http.HandleFunc("/expose/request", exposure.ControllerRequest)
 	http.HandleFunc("/expose/request/", exposure.ControllerRequest)
+	http.HandleFunc("/expose/access", exposure.ControllerAccess)
+	http.HandleFunc("/expose/subscription", exposure.ControllerSubscription)
+	http.HandleFunc("/expose/subscription/", exposure.ControllerSubscription)
+	http.HandleFunc("/expose/invite", exposure.ControllerInvite)
+	http.HandleFunc("/expose/invite/", exposure.ControllerInvite)
+	http.HandleFunc("/expose/invite/redeem", exposure.ControllerInviteRedeem)
+	http.HandleFunc("/expose/policy", exposure.ControllerPolicy)
+	http.HandleFunc("/expose/policy/", exposure.ControllerPolicy)
+	http.HandleFunc("/expose/approval", exposure.ControllerApproval)
+	http.HandleFunc("/expose/approval/", exposure.ControllerApproval)
+
+	// GET / POST / DELETE known peers
+	http.HandleFunc("/contact", contact.Controller)
+	http.HandleFunc("/contact/", contact.Controller)
+	http.HandleFunc("/contact/verify", exposure.ControllerVerification)
+	http.HandleFunc("/contact/block", exposure.ControllerBlock)
+	http.HandleFunc("/contact/block/", exposure.ControllerBlock)
+
+	// GET profile of the local peer or of a remote peer
+	http.HandleFunc("/peer/info", exposure.ControllerPeerInfo)
+	http.HandleFunc("/peer/info/", exposure.ControllerPeerInfo)
+	// GET status of the node and its connections
+	http.HandleFunc("/peer/status", exposure.ControllerPeerStatus)
+
+	// GET / DELETE devices of the owner, POST link this device to another one, POST sync the vault
+	http.HandleFunc("/device", exposure.ControllerDevice)
+	http.HandleFunc("/device/", exposure.ControllerDevice)
+	http.HandleFunc("/device/link", exposure.ControllerDeviceLink)
+	http.HandleFunc("/device/sync", exposure.ControllerDeviceSync)
+
+	// GET / POST backups stored on trusted contacts, POST restore the latest one, GET backups held for contacts
+	http.HandleFunc("/backup", exposure.ControllerBackup)
+	http.HandleFunc("/backup/restore", exposure.ControllerBackupRestore)
+	http.HandleFunc("/backup/held", exposure.ControllerBackupHeld)
+
+	// GET / POST / DELETE team vaults and their members, GET / PUT invitations to teams
+	http.HandleFunc("/team", exposure.ControllerTeam)
+	http.HandleFunc("/team/", exposure.ControllerTeam)
+	http.HandleFunc("/team/member", exposure.ControllerTeamMember)
+	http.HandleFunc("/team/invitation", exposure.ControllerTeamInvitation)
+
+	s := &http.Server{
+		Addr:           *address,
+		Handler:        nil,
+		ReadTimeout:    timeout,
+		WriteTimeout:   timeout,
+		MaxHeaderBytes: 1 << 20,
+	}
+	log.Fatal(s.ListenAndServe())
+}
+
+// ListenRelay serve the API of the relay mode, without owner nor vault
+func ListenRelay(address* string) {
+	log.Info("listen from control in relay mode")
+
+	// GET statistics of the relay
+	http.HandleFunc("/relay/stats", relay.ControllerStats)
 
 	s := &http.Server{
 		Addr:           *address,
@@ -17,7 +17,8 @@ import (
 var (
 	log = logging.MustGetLogger("peerVaultLogger")
 	upgrader = websocket.Upgrader{} // use default options
-	connections = make([]websocket.Conn,0)
+	connections = make([]*websocket.Conn,0)
+	listeners []func(Message)
 )
 
 type Message struct {
@@ -25,8 +26,17 @@ type Message struct {
 	Data map[string]string `json:"data"`
 }
 
+// Register a listener called with every message before it is written to the websocket clients
+// The listener is called synchronously, it must not block
+func OnMessage(listener func(Message)) {
+	listeners = append(listeners, listener)
+}
+
 // Write response to all websocket client connected
 func Write(message Message) error {
+	for _, listener := range listeners {
+		listener(message)
+	}
 	msgJson, err := json.MarshalIndent(message, "", " ")
 	if err != nil {
 		return err
@@ -47,7 +57,7 @@ func process(w http.ResponseWriter, r *http.Request) {
 		log.Error(err)
 		return
 	}
-	connections = append(connections, *conn)
+	connections = append(connections, conn)
 
 	result := Message {
 		Type: "process-ok",
@@ -0,0 +1,314 @@
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+//
+// Peer package will manage all the communication with
+// the EXTERNAL Peers (libp2p) to exchange password with other Peer
+// same of different owner
+//
+// Access will focus on Protocol regarding secret requested by another peer
+package peer
+
+import (
+	"encoding/json"
+	"github.com/PeerVault/PeerVault-Service/business/secret"
+	"github.com/PeerVault/PeerVault-Service/communication/event"
+	"github.com/PeerVault/PeerVault-Service/database"
+	"github.com/libp2p/go-libp2p-core/network"
+	"go.etcd.io/bbolt"
+	"strings"
+	"time"
+)
+
+// AccessRequest is sent by a peer asking the owner of a secret to share it
+type AccessRequest struct {
+	Uuid string
+	Requester string
+	Owner string
+	Expiration string
+	KeyPath string
+}
+
+type AccessResponse struct {
+	Uuid string
+	Approved bool
+}
+
+// Ask the owner of a secret to share it
+// The request is approved locally, so the secret will be trusted once delivered into the destination namespace
+func RequestAccess(accessRequest AccessRequest, destination string) error {
+	putRequest(ShareRequest{
+		Uuid: accessRequest.Uuid,
+		Sender: accessRequest.Owner,
+		Receiver: accessRequest.Requester,
+		Expiration: accessRequest.Expiration,
+		KeyPath: accessRequest.KeyPath,
+		Approved: true,
+		Destination: destination,
+	})
+	ctx, cancel := DialContext()
+	defer cancel()
+	return Dial(ctx, accessRequest.Owner, PidAccessRequest, accessRequest)
+}
+
+// Answer an access request received from another peer, the answer is delivered in the background
+// On approval the secrets are delivered as for a share approved by its receiver, a failure is sent as event secret.share.failed
+// The request is kept until the requester has been answered, a decline is sent when it cannot be approved
+func RespondAccess(uuid string, approved bool) error {
+	accessRequest, err := getDbAccessRequest([]byte(uuid))
+	if err != nil {
+		return err
+	}
+	if !approved {
+		return declineAccess(accessRequest, nil)
+	}
+
+	expiration, err := time.Parse(time.RFC3339, accessRequest.Expiration)
+	if err != nil || time.Now().UTC().After(expiration) {
+		return declineAccess(accessRequest, ErrorAccessExpired)
+	}
+	if !IsSingleKeyPath(accessRequest.KeyPath) {
+		return declineAccess(accessRequest, ErrorAccessKeyPath)
+	}
+	secrets, err := secret.FetchSecretsMatching(accessRequest.KeyPath)
+	if err != nil {
+		return err
+	}
+	if len(secrets) == 0 {
+		return declineAccess(accessRequest, secret.ErrorSecretNotFound)
+	}
+	// The share keep the uuid chosen by the requester, it must not replace a share of another peer
+	existing, err := getDbShareRequest([]byte(accessRequest.Uuid))
+	if err == nil && (existing.Receiver != accessRequest.Requester || existing.KeyPath != accessRequest.KeyPath) {
+		return declineAccess(accessRequest, ErrorUuidInUse)
+	}
+	if err != nil && err != ErrorShareNotFound {
+		return err
+	}
+	share := Share{
+		Uuid: accessRequest.Uuid,
+		Sender: accessRequest.Owner,
+		Receiver: accessRequest.Requester,
+		Expiration: accessRequest.Expiration,
+		KeyPath: accessRequest.KeyPath,
+		Approved: true,
+	}
+	for _, secretData := range secrets {
+		share.Delivered = append(share.Delivered, secretData.Namespace + "." + secretData.Key)
+	}
+	if err := putDbShare(share); err != nil {
+		return err
+	}
+	background(func() {
+		if err := sendSecrets(share, PidShareSecret, secrets); err != nil {
+			log.Errorf("Access request %s not delivered: %s", uuid, err)
+			return
+		}
+		if err := deleteDbAccessRequest([]byte(uuid)); err != nil {
+			log.Error(err)
+		}
+	})
+	return nil
+}
+
+// Send the decline to the requester in the background, the request is removed once delivered
+// The reason the request cannot be approved is returned
+func declineAccess(accessRequest AccessRequest, reason error) error {
+	background(func() {
+		sendAccessDecline(accessRequest)
+	})
+	return reason
+}
+
+func sendAccessDecline(accessRequest AccessRequest) {
+	response := AccessResponse{Uuid: accessRequest.Uuid, Approved: false}
+	ctx, cancel := DialContext()
+	defer cancel()
+	if err := Dial(ctx, accessRequest.Requester, PidAccessResponse, response); err != nil {
+		log.Errorf("Access request %s decline not delivered to %s", accessRequest.Uuid, accessRequest.Requester)
+		_ = event.Write(event.Message{
+			Type: "secret.access.failed",
+			Data: map[string]string {
+				"Requester": accessRequest.Requester,
+				"Uuid": accessRequest.Uuid,
+				"Error": err.Error(),
+			},
+		})
+		return
+	}
+	if err := deleteDbAccessRequest([]byte(accessRequest.Uuid)); err != nil {
+		log.Error(err)
+	}
+}
+
+// An access request name a single secret, a glob such as * would expose the whole vault
+func IsSingleKeyPath(keyPath string) bool {
+	return keyPath != "" && !strings.ContainsAny(keyPath, "*?[\\")
+}
+
+// Receive a request from another peer asking for one of our secrets
+func accessRequestProtocol(s network.Stream) {
+	log.Debug("Peer accessRequestProtocol")
+	log.Debugf("remote are: %s\n", s.Conn().RemotePeer())
+	rw := newCodec(s)
+	accessRequest := &AccessRequest{}
+	err := rw.Read(accessRequest)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	_ = s.Close()
+
+	if accessRequest.Requester != s.Conn().RemotePeer().Pretty() {
+		log.Error("Access request corrupted, requester and remote peer are different")
+		return
+	}
+	if accessRequest.Owner != node.ID().Pretty() {
+		log.Error("Access request corrupted, owner is not the local peer")
+		return
+	}
+	if !IsSingleKeyPath(accessRequest.KeyPath) {
+		log.Errorf("Access request refused, %s is not a single key path", accessRequest.KeyPath)
+		return
+	}
+	if err := receiveDbAccessRequest(*accessRequest); err != nil {
+		log.Errorf("Access request %s refused: %s", accessRequest.Uuid, err)
+		return
+	}
+
+	_ = event.Write(event.Message{
+		Type: "secret.access.request",
+		Data: peerInfoEventData(accessRequest.Requester, map[string]string {
+			"Requester": accessRequest.Requester,
+			"Uuid": accessRequest.Uuid,
+			"SecretPath": accessRequest.KeyPath,
+			"Expiration": accessRequest.Expiration,
+		}),
+	})
+}
+
+// Receive the decline of an access request we sent
+func accessResponseProtocol(s network.Stream) {
+	log.Debug("Peer accessResponseProtocol")
+	log.Debugf("remote are: %s\n", s.Conn().RemotePeer())
+	rw := newCodec(s)
+	accessResponse := &AccessResponse{}
+	err := rw.Read(accessResponse)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	_ = s.Close()
+
+	shareRequest, ok := getRequest(accessResponse.Uuid)
+	if !ok || shareRequest.Sender != s.Conn().RemotePeer().Pretty() {
+		log.Errorf("access request not found with uuid %s", accessResponse.Uuid)
+		return
+	}
+	if accessResponse.Approved {
+		return
+	}
+	takeRequest(accessResponse.Uuid)
+	_ = event.Write(event.Message{
+		Type: "secret.access.declined",
+		Data: map[string]string {
+			"Owner": shareRequest.Sender,
+			"Uuid": shareRequest.Uuid,
+			"SecretPath": shareRequest.KeyPath,
+		},
+	})
+}
+
+// List the access requests received and not answered yet
+func FetchAccessRequests() ([]AccessRequest, error) {
+	db, err := database.GetConnection()
+	if err != nil {
+		return nil, err
+	}
+	var accessRequests []AccessRequest
+
+	err = db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("access"))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var accessRequest AccessRequest
+			if err := json.Unmarshal(v, &accessRequest); err != nil {
+				return err
+			}
+			accessRequests = append(accessRequests, accessRequest)
+			return nil
+		})
+	})
+	return accessRequests, err
+}
+
+func getDbAccessRequest(uuid []byte) (AccessRequest, error) {
+	accessRequest := &AccessRequest{}
+	db, err := database.GetConnection()
+	if err != nil {
+		return *accessRequest, err
+	}
+
+	err = db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("access"))
+		if b == nil {
+			return ErrorAccessNotFound
+		}
+		buf := b.Get(uuid)
+		if buf == nil {
+			return ErrorAccessNotFound
+		}
+		return json.Unmarshal(buf, accessRequest)
+	})
+	return *accessRequest, err
+}
+
+// Save an access request received, its uuid is chosen by the requester
+// A share or the access request of another peer using the same uuid is never replaced
+func receiveDbAccessRequest(accessRequest AccessRequest) error {
+	db, err := database.GetConnection()
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(&accessRequest)
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bbolt.Tx) error {
+		if shareBucket := tx.Bucket([]byte("share")); shareBucket != nil && shareBucket.Get([]byte(accessRequest.Uuid)) != nil {
+			return ErrorUuidInUse
+		}
+		b, err := tx.CreateBucketIfNotExists([]byte("access"))
+		if err != nil {
+			return err
+		}
+		if previous := b.Get([]byte(accessRequest.Uuid)); previous != nil {
+			stored := AccessRequest{}
+			if err := json.Unmarshal(previous, &stored); err != nil {
+				return err
+			}
+			if stored.Requester != accessRequest.Requester {
+				return ErrorUuidInUse
+			}
+		}
+		return b.Put([]byte(accessRequest.Uuid), buf)
+	})
+}
+
+func deleteDbAccessRequest(uuid []byte) error {
+	db, err := database.GetConnection()
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("access"))
+		if b == nil {
+			return nil
+		}
+		return b.Delete(uuid)
+	})
+}
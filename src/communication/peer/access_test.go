@@ -0,0 +1,101 @@
+package peer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestAccessApproved(t *testing.T) {
+	instances := newInstances(t, "alice", "bob")
+	defer closeInstances(instances)
+	owner, requester := instances[0], instances[1]
+
+	owner.run(func() {
+		createTestSecret(t, "staging", "database", "hunter2")
+	})
+	accessUuid := requestTestAccess(t, requester, owner, "staging.database", time.Now().Add(time.Hour))
+	owner.waitEvent(t, "secret.access.request")
+
+	owner.run(func() {
+		if err := RespondAccess(accessUuid, true); err != nil {
+			t.Fatal(err)
+		}
+	})
+	created := requester.waitEvent(t, "secret.share.created")
+	if created.Data["OriginalPath"] != "staging.database" {
+		t.Errorf("Secret requested must be delivered, current: %v", created.Data)
+	}
+	owner.waitEvent(t, "secret.share.delivered")
+	owner.run(func() {
+		if _, err := getDbAccessRequest([]byte(accessUuid)); err != ErrorAccessNotFound {
+			t.Errorf("Access request must be removed once answered, current: %v", err)
+		}
+	})
+}
+
+func TestAccessExpiredDeclined(t *testing.T) {
+	instances := newInstances(t, "alice", "bob")
+	defer closeInstances(instances)
+	owner, requester := instances[0], instances[1]
+
+	owner.run(func() {
+		createTestSecret(t, "staging", "database", "hunter2")
+	})
+	accessUuid := requestTestAccess(t, requester, owner, "staging.database", time.Now().Add(-time.Hour))
+	owner.waitEvent(t, "secret.access.request")
+
+	owner.run(func() {
+		if err := RespondAccess(accessUuid, true); err != ErrorAccessExpired {
+			t.Errorf("Access request expired must not be approved, current: %v", err)
+		}
+	})
+	declined := requester.waitEvent(t, "secret.access.declined")
+	if declined.Data["Uuid"] != accessUuid {
+		t.Errorf("Requester must be notified of the access expired, current: %v", declined.Data)
+	}
+}
+
+func TestIsSingleKeyPath(t *testing.T) {
+	if !IsSingleKeyPath("staging.database") {
+		t.Error("Key path of a secret must be allowed")
+	}
+	for _, keyPath := range []string{"*", "staging.*", "staging.data?ase", "[a-z].database", ""} {
+		if IsSingleKeyPath(keyPath) {
+			t.Errorf("Glob %s must be refused in an access request", keyPath)
+		}
+	}
+}
+
+func TestAccessUuidInUse(t *testing.T) {
+	instances := newInstances(t, "alice", "bob")
+	defer closeInstances(instances)
+	owner, requester := instances[0], instances[1]
+
+	owner.run(func() {
+		createTestSecret(t, "staging", "database", "hunter2")
+	})
+	shareUuid := requestTestShare(t, owner, requester, "staging.database", false)
+
+	// The uuid is chosen by the requester, it must not replace the share it received
+	owner.run(func() {
+		accessRequest := AccessRequest{Uuid: shareUuid, Requester: requester.QmPeerId, Owner: owner.QmPeerId, KeyPath: "staging.database"}
+		if err := receiveDbAccessRequest(accessRequest); err != ErrorUuidInUse {
+			t.Errorf("Access request must not replace a share, current: %v", err)
+		}
+		accessUuid := uuid.New().String()
+		accessRequest.Uuid = accessUuid
+		if err := receiveDbAccessRequest(accessRequest); err != nil {
+			t.Fatal(err)
+		}
+		accessRequest.Requester = "QmOtherRequester"
+		if err := receiveDbAccessRequest(accessRequest); err != ErrorUuidInUse {
+			t.Errorf("Access request must not replace the request of another peer, current: %v", err)
+		}
+		stored, err := getDbAccessRequest([]byte(accessUuid))
+		if err != nil || stored.Requester != requester.QmPeerId {
+			t.Errorf("Access request of the first requester must be kept, current: %v %v", stored, err)
+		}
+	})
+}
@@ -0,0 +1,389 @@
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+//
+// Peer package will manage all the communication with
+// the EXTERNAL Peers (libp2p) to exchange password with other Peer
+// same of different owner
+//
+// Approval will focus on Protocol regarding the M of N approvals of critical secrets
+package peer
+
+import (
+	"github.com/PeerVault/PeerVault-Service/business/approval"
+	"github.com/PeerVault/PeerVault-Service/business/secret"
+	"github.com/PeerVault/PeerVault-Service/communication/event"
+	"github.com/google/uuid"
+	"github.com/libp2p/go-libp2p-core/network"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ApprovalRequestDelay = 1 * time.Hour // Delay to collect the approvals of a request
+)
+
+// ApprovalStatus of the request an action is waiting for, as returned to the client
+type ApprovalStatus struct {
+	Uuid string
+	Status string
+	Required int
+	Approvals []approval.Approval
+}
+
+// Find the policy covering the key paths, or the namespace of the secrets, and the status of its request
+// StatusGranted when no policy covers them, StatusExpired when a new request must be created
+// Several key paths requested together are joined with a comma
+func FindSecretsApproval(action string, keyPath string, receiver string, secrets []secret.Secret) (approval.Policy, approval.Request, string, error) {
+	p, err := approval.Policy{}, error(approval.ErrorPolicyNotFound)
+	for _, k := range strings.Split(keyPath, ",") {
+		if err != approval.ErrorPolicyNotFound {
+			break
+		}
+		p, err = approval.FetchPolicyOfKeyPath(k)
+	}
+	for _, s := range secrets {
+		if err != approval.ErrorPolicyNotFound {
+			break
+		}
+		p, err = approval.FetchPolicyOfNamespace(s.Namespace)
+	}
+	if err == approval.ErrorPolicyNotFound {
+		return p, approval.Request{}, approval.StatusGranted, nil
+	}
+	if err != nil {
+		return p, approval.Request{}, "", err
+	}
+	r, status, err := FindApproval(p, action, keyPath, receiver)
+	return p, r, status, err
+}
+
+// Status of the latest request of the local peer for an action covered by the policy
+// StatusExpired when no request is in progress, a new one must be created
+// Several key paths requested together are joined with a comma
+func FindApproval(p approval.Policy, action string, keyPath string, receiver string) (approval.Request, string, error) {
+	id, err := getPeerIdentity()
+	if err != nil {
+		return approval.Request{}, "", err
+	}
+	r, err := approval.FindRequest(id.Id, action, keyPath, receiver)
+	if err == approval.ErrorRequestNotFound || (err == nil && r.Namespace != p.Namespace) {
+		return approval.Request{}, approval.StatusExpired, nil
+	}
+	if err != nil {
+		return approval.Request{}, "", err
+	}
+	return r, r.Status(p, time.Now().UTC()), nil
+}
+
+// Save a new request for an action covered by the policy, the approvers must then be asked with RequestApprovals
+func CreateApprovalRequest(p approval.Policy, action string, keyPath string, receiver string) (approval.Request, error) {
+	id, err := getPeerIdentity()
+	if err != nil {
+		return approval.Request{}, err
+	}
+	r := approval.Request{
+		Uuid:       uuid.New().String(),
+		Requester:  id.Id,
+		Action:     action,
+		KeyPath:    keyPath,
+		Receiver:   receiver,
+		Namespace:  p.Namespace,
+		Expiration: time.Now().UTC().Add(ApprovalRequestDelay).Format(time.RFC3339),
+	}
+	return r, r.Save()
+}
+
+// Keep the secrets allowed to be delivered to the receiver of the share
+// A secret covered by a policy require a granted approval of its key path, or of a glob matching it,
+// the approvers are asked otherwise and the secret is held back until the approval is granted
+func approvedSecrets(share Share, secrets []secret.Secret) ([]secret.Secret, error) {
+	allowed := make([]secret.Secret, 0, len(secrets))
+	var held []string
+	for _, secretData := range secrets {
+		keyPath := secretData.Namespace + "." + secretData.Key
+		p, err := approval.FetchPolicyOfNamespace(secretData.Namespace)
+		if err == approval.ErrorPolicyNotFound {
+			allowed = append(allowed, secretData)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		granted, err := isShareGranted(p, share, keyPath)
+		if err != nil {
+			return nil, err
+		}
+		if granted {
+			allowed = append(allowed, secretData)
+			continue
+		}
+		r, status, err := FindApproval(p, approval.ActionShare, keyPath, share.Receiver)
+		if err != nil {
+			return nil, err
+		}
+		if status == approval.StatusGranted {
+			allowed = append(allowed, secretData)
+			continue
+		}
+		if status == approval.StatusExpired {
+			r, err = CreateApprovalRequest(p, approval.ActionShare, keyPath, share.Receiver)
+			if err != nil {
+				return nil, err
+			}
+			background(func() {
+				RequestApprovals(r, p)
+			})
+			status = approval.StatusPending
+		}
+		held = append(held, keyPath)
+		_ = event.Write(event.Message{
+			Type: "secret.share.held",
+			Data: map[string]string {
+				"Receiver": share.Receiver,
+				"Uuid": share.Uuid,
+				"SecretPath": keyPath,
+				"ApprovalUuid": r.Uuid,
+				"Status": status,
+			},
+		})
+	}
+	if len(held) > 0 {
+		// Held secrets are delivered again once approved
+		if err := forgetDelivered(share.Uuid, held); err != nil {
+			return nil, err
+		}
+	}
+	return allowed, nil
+}
+
+// Check if a request to share with the receiver a glob matching the key path has been granted
+func isShareGranted(p approval.Policy, share Share, keyPath string) (bool, error) {
+	requests, err := approval.FetchRequests()
+	if err != nil {
+		return false, err
+	}
+	now := time.Now().UTC()
+	for _, r := range requests {
+		if r.Requester != share.Sender || r.Action != approval.ActionShare || r.Receiver != share.Receiver || r.Namespace != p.Namespace {
+			continue
+		}
+		if _, ok := secret.MatchAnyKeyPath(strings.Split(r.KeyPath, ","), keyPath); !ok {
+			continue
+		}
+		if r.Status(p, now) == approval.StatusGranted {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Deliver the secrets held back on the shares of the receiver once the request is granted
+func deliverHeldSecrets(r approval.Request) {
+	shares, err := getDbShares()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	patterns := strings.Split(r.KeyPath, ",")
+	for _, share := range shares {
+		if share.Receiver != r.Receiver || !share.Approved || share.isExpired() {
+			continue
+		}
+		secrets, err := secret.FetchSecretsMatching(share.keyPaths()...)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		var held []secret.Secret
+		for _, secretData := range secrets {
+			keyPath := secretData.Namespace + "." + secretData.Key
+			if _, ok := secret.MatchAnyKeyPath(patterns, keyPath); ok && !isDelivered(share, keyPath) {
+				held = append(held, secretData)
+				share.Delivered = append(share.Delivered, keyPath)
+			}
+		}
+		if len(held) == 0 {
+			continue
+		}
+		if err := putDbShare(share); err != nil {
+			log.Error(err)
+			continue
+		}
+		// The receiver only keep a subscription when future secrets are included
+		pid := PidShareSecret
+		if share.IncludeFuture {
+			pid = PidShareUpdate
+		}
+		if err := sendSecrets(share, pid, held); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// Ask every approver of the policy to approve the request
+func RequestApprovals(r approval.Request, p approval.Policy) {
+	for _, approver := range p.Approvers {
+		if approver == r.Requester {
+			continue
+		}
+		ctx, cancel := DialContext()
+		err := Dial(ctx, approver, PidApprovalRequest, r)
+		cancel()
+		if err != nil {
+			log.Errorf("Approval request %s not delivered to %s", r.Uuid, approver)
+			log.Error(err)
+		}
+	}
+}
+
+// Sign our approval, or decline, of a request and send it to the requester
+// The approval is valid during validity, and never after the request expiration
+func SendApproval(uuid string, approved bool, validity time.Duration) error {
+	r, err := approval.FetchRequest(uuid)
+	if err != nil {
+		return err
+	}
+	id, err := getPeerIdentity()
+	if err != nil {
+		return err
+	}
+
+	if validity <= 0 {
+		return approval.ErrorApprovalValidity
+	}
+	expiration := time.Now().UTC().Add(validity).Format(time.RFC3339)
+	if expiration > r.Expiration {
+		expiration = r.Expiration
+	}
+	a := approval.Approval{
+		RequestUuid: r.Uuid,
+		Approved: approved,
+		Expiration: expiration,
+	}
+	if err := a.Sign(id, r); err != nil {
+		return err
+	}
+
+	if r.Requester == id.Id {
+		return receiveApproval(r, a)
+	}
+	r.AddApproval(a)
+	if err := r.Save(); err != nil {
+		return err
+	}
+	ctx, cancel := RequestContext()
+	defer cancel()
+	return Dial(ctx, r.Requester, PidApproval, a)
+}
+
+// Receive a request to approve an action on a secret of another peer
+func approvalRequestProtocol(s network.Stream) {
+	log.Debug("Peer approvalRequestProtocol")
+	log.Debugf("remote are: %s\n", s.Conn().RemotePeer())
+	rw := newCodec(s)
+	r := &approval.Request{}
+	err := rw.Read(r)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	_ = s.Close()
+
+	if r.Requester != s.Conn().RemotePeer().Pretty() {
+		log.Error("Approval request corrupted, requester and remote peer are different")
+		return
+	}
+	r.Approvals = nil
+	if err := r.SaveReceived(); err != nil {
+		log.Error(err)
+		return
+	}
+
+	_ = event.Write(event.Message{
+		Type: "secret.approval.request",
+		Data: map[string]string {
+			"Requester": r.Requester,
+			"Uuid": r.Uuid,
+			"Action": r.Action,
+			"SecretPath": r.KeyPath,
+			"Receiver": r.Receiver,
+			"Expiration": r.Expiration,
+		},
+	})
+}
+
+// Receive the signed approval of one of the approvers of our request
+func approvalProtocol(s network.Stream) {
+	log.Debug("Peer approvalProtocol")
+	log.Debugf("remote are: %s\n", s.Conn().RemotePeer())
+	rw := newCodec(s)
+	a := &approval.Approval{}
+	err := rw.Read(a)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	_ = s.Close()
+
+	if a.Approver != s.Conn().RemotePeer().Pretty() {
+		log.Error("Approval corrupted, approver and remote peer are different")
+		return
+	}
+	r, err := approval.FetchRequest(a.RequestUuid)
+	if err != nil {
+		log.Errorf("approval request not found with uuid %s", a.RequestUuid)
+		return
+	}
+	if r.Requester != node.ID().Pretty() {
+		log.Error("Approval corrupted, the request was not sent by the local peer")
+		return
+	}
+	if err := receiveApproval(r, *a); err != nil {
+		log.Error(err)
+	}
+}
+
+// Verify and record an approval on our request, the quorum is checked against the current policy
+func receiveApproval(r approval.Request, a approval.Approval) error {
+	p, err := approval.FetchPolicy(r.Namespace)
+	if err != nil {
+		return err
+	}
+	if !p.IsApprover(a.Approver) {
+		log.Errorf("Approval refused, %s is not approver of %s", a.Approver, p.Namespace)
+		return approval.ErrorApprovalSignature
+	}
+	if err := a.Verify(r); err != nil {
+		return err
+	}
+	r.AddApproval(a)
+	if err := r.Save(); err != nil {
+		return err
+	}
+
+	status := r.Status(p, time.Now().UTC())
+	eventType := "secret.approval.received"
+	switch status {
+	case approval.StatusGranted:
+		eventType = "secret.approval.granted"
+	case approval.StatusDenied:
+		eventType = "secret.approval.denied"
+	}
+	_ = event.Write(event.Message{
+		Type: eventType,
+		Data: map[string]string {
+			"Approver": a.Approver,
+			"Approved": strconv.FormatBool(a.Approved),
+			"Uuid": r.Uuid,
+			"Action": r.Action,
+			"SecretPath": r.KeyPath,
+			"Required": strconv.Itoa(p.Required),
+		},
+	})
+	if status == approval.StatusGranted && r.Action == approval.ActionShare {
+		deliverHeldSecrets(r)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package peer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/PeerVault/PeerVault-Service/business/approval"
+	"github.com/PeerVault/PeerVault-Service/business/secret"
+	"github.com/google/uuid"
+)
+
+func TestShareHeldUntilApproved(t *testing.T) {
+	instances := newInstances(t, "alice", "bob", "carol")
+	defer closeInstances(instances)
+	sender, receiver, approver := instances[0], instances[1], instances[2]
+
+	sender.run(func() {
+		createTestSecret(t, "production", "database", "hunter2")
+	})
+	shareUuid := requestTestShare(t, sender, receiver, "*", false)
+	receiver.waitEvent(t, "secret.share.request")
+	// The policy created after the share request is checked on each secret delivered
+	sender.run(func() {
+		p := approval.Policy{Namespace: "production", Required: 1, Approvers: []string{approver.QmPeerId}}
+		if err := p.Save(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	respondTestShare(t, sender, receiver, shareUuid, true)
+
+	held := sender.waitEvent(t, "secret.share.held")
+	if held.Data["SecretPath"] != "production.database" || held.Data["Status"] != approval.StatusPending {
+		t.Errorf("Secret covered by a policy must be held until approved, current: %v", held.Data)
+	}
+	request := approver.waitEvent(t, "secret.approval.request")
+	receiver.run(func() {
+		if _, err := secret.FetchSecret([]byte("shared." + sender.QmPeerId + ".production.database")); err != secret.ErrorSecretNotFound {
+			t.Errorf("Secret held must not be delivered, current: %v", err)
+		}
+	})
+
+	approver.run(func() {
+		if err := SendApproval(request.Data["Uuid"], true, 0); err != approval.ErrorApprovalValidity {
+			t.Errorf("Approval without validity must be refused, current: %v", err)
+		}
+		if err := SendApproval(request.Data["Uuid"], true, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	})
+	created := receiver.waitEvent(t, "secret.share.created")
+	if created.Data["OriginalPath"] != "production.database" {
+		t.Errorf("Secret held must be delivered once approved, current: %v", created.Data)
+	}
+}
+
+func TestShareWaitsForApproval(t *testing.T) {
+	instances := newInstances(t, "alice", "bob", "carol")
+	defer closeInstances(instances)
+	sender, receiver, approver := instances[0], instances[1], instances[2]
+
+	share := Share{Receiver: receiver.QmPeerId, KeyPath: "production.database"}
+	sender.run(func() {
+		createTestSecret(t, "production", "database", "hunter2")
+		p := approval.Policy{Namespace: "production", Required: 1, Approvers: []string{approver.QmPeerId}}
+		if err := p.Save(); err != nil {
+			t.Fatal(err)
+		}
+		share.Expiration = time.Now().UTC().Add(time.Hour).Format(time.RFC3339)
+		_, status, err := CreateShare(share)
+		if err != ErrorShareApproval || status.Status != approval.StatusPending || status.Required != 1 {
+			t.Errorf("Share covered by a policy must wait for the approval, current: %v %v", err, status)
+		}
+		if shares, _ := getDbShares(); len(shares) != 0 {
+			t.Errorf("Share waiting for the approval must not be saved, current: %v", shares)
+		}
+	})
+
+	request := approver.waitEvent(t, "secret.approval.request")
+	if request.Data["SecretPath"] != "production.database" || request.Data["Receiver"] != receiver.QmPeerId {
+		t.Errorf("Approver must be asked for the share, current: %v", request.Data)
+	}
+	approver.run(func() {
+		if err := SendApproval(request.Data["Uuid"], true, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	})
+	sender.waitEvent(t, "secret.approval.granted")
+
+	sender.run(func() {
+		created, status, err := CreateShare(share)
+		if err != nil || status.Status != approval.StatusGranted {
+			t.Fatalf("Share must be created once approved, current: %v %v", err, status)
+		}
+		if err := RequestShare(created); err != nil {
+			t.Fatal(err)
+		}
+	})
+	receiver.waitEvent(t, "secret.share.request")
+}
+
+func TestApprovalRequestUuidInUse(t *testing.T) {
+	instances := newInstances(t, "alice")
+	defer closeInstances(instances)
+	requester := instances[0]
+
+	requester.run(func() {
+		local := approval.Request{Uuid: uuid.New().String(), Requester: requester.QmPeerId, Action: approval.ActionShare}
+		if err := local.Save(); err != nil {
+			t.Fatal(err)
+		}
+		received := local
+		received.Requester = "QmOtherRequester"
+		if err := received.SaveReceived(); err != approval.ErrorRequestExists {
+			t.Errorf("Approval request received must not replace the request of another requester, current: %v", err)
+		}
+		stored, err := approval.FetchRequest(local.Uuid)
+		if err != nil || stored.Requester != requester.QmPeerId {
+			t.Errorf("Local approval request must be kept, current: %v %v", stored, err)
+		}
+	})
+}
@@ -0,0 +1,331 @@
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+//
+// Peer package will manage all the communication with
+// the EXTERNAL Peers (libp2p) to exchange password with other Peer
+// same of different owner
+//
+// Backup will focus on Protocol regarding the encrypted backups stored on trusted contacts
+package peer
+
+import (
+	"encoding/json"
+	"github.com/PeerVault/PeerVault-Service/business/backup"
+	"github.com/PeerVault/PeerVault-Service/business/contact"
+	"github.com/PeerVault/PeerVault-Service/business/device"
+	"github.com/PeerVault/PeerVault-Service/business/secret"
+	"github.com/PeerVault/PeerVault-Service/communication/event"
+	"github.com/PeerVault/PeerVault-Service/crypto"
+	"github.com/PeerVault/PeerVault-Service/identity"
+	"github.com/libp2p/go-libp2p-core/network"
+	"strconv"
+	"time"
+)
+
+// BackupChunk is sent to a holder, the master proof identify the owner of the backup
+type BackupChunk struct {
+	Proof identity.MasterProof
+	Chunk backup.Chunk
+}
+
+// BackupAck is the reply of the holder for each chunk
+type BackupAck struct {
+	Stored bool
+	Error string `json:",omitempty"`
+}
+
+// BackupRestore is sent to a holder by any device restored from the seed of the owner
+// Each request return one chunk, the first one of the latest backup when the uuid is empty
+type BackupRestore struct {
+	Proof identity.MasterProof
+	Uuid string `json:",omitempty"`
+	Index int
+}
+
+// Create a snapshot of the vault, cipher with the backup key, its chunks are pushed to the holders in the background
+// The backup is returned with its holders pending, their status is saved and sent as event once every holder is done
+func CreateBackup(uuid string, holders []string) (backup.Backup, error) {
+	b := backup.Backup{
+		Uuid: uuid,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	id, err := getPeerIdentity()
+	if err != nil {
+		return b, err
+	}
+	if id.MasterProof == nil || id.VaultKey == "" {
+		return b, device.ErrorNoMasterProof
+	}
+
+	// Values are required to cipher the secrets with the vault key
+	secrets, err := secret.FetchSecretsMatching("*")
+	if err != nil {
+		return b, err
+	}
+	snapshot := backup.Snapshot{CreatedAt: b.CreatedAt}
+	for _, s := range secrets {
+		cipherSecret, err := toVaultKey(id, s)
+		if err != nil {
+			return b, err
+		}
+		snapshot.Secrets = append(snapshot.Secrets, cipherSecret)
+	}
+	snapshotJson, err := json.Marshal(snapshot)
+	if err != nil {
+		return b, err
+	}
+	cipherText, err := crypto.EncryptAes(id.GetBackupKeyAsByte(), snapshotJson)
+	if err != nil {
+		return b, err
+	}
+	chunks := backup.Split(uuid, cipherText)
+	b.Size = len(cipherText)
+	b.Chunks = len(chunks)
+	b.Secrets = len(snapshot.Secrets)
+
+	for _, holder := range holders {
+		b.Holders = append(b.Holders, backup.Holder{PeerId: holder, Status: backup.HolderStatusPending})
+	}
+	if err := b.Save(); err != nil {
+		return b, err
+	}
+	pushed := b
+	pushed.Holders = append([]backup.Holder{}, b.Holders...)
+	background(func() {
+		pushBackupHolders(*id.MasterProof, pushed, chunks)
+	})
+	return b, nil
+}
+
+// Push the chunks to each holder in turn, then save the status of the holders
+func pushBackupHolders(proof identity.MasterProof, b backup.Backup, chunks []backup.Chunk) {
+	for i, holder := range b.Holders {
+		b.Holders[i] = pushBackup(proof, holder.PeerId, chunks)
+	}
+	if err := b.Save(); err != nil {
+		log.Error(err)
+	}
+
+	stored := 0
+	for _, holder := range b.Holders {
+		if holder.Status == backup.HolderStatusStored {
+			stored++
+		}
+	}
+	_ = event.Write(event.Message{
+		Type: "backup.created",
+		Data: map[string]string {
+			"Uuid": b.Uuid,
+			"Chunks": strconv.Itoa(b.Chunks),
+			"Holders": strconv.Itoa(len(b.Holders)),
+			"Stored": strconv.Itoa(stored),
+		},
+	})
+}
+
+// Send every chunk to a holder, stop at the first chunk refused
+func pushBackup(proof identity.MasterProof, QmPeerId string, chunks []backup.Chunk) backup.Holder {
+	holder := backup.Holder{PeerId: QmPeerId, Status: backup.HolderStatusStored}
+	for _, chunk := range chunks {
+		ack := BackupAck{}
+		ctx, cancel := DialContext()
+		err := DialRequest(ctx, QmPeerId, PidBackupChunk, BackupChunk{Proof: proof, Chunk: chunk}, &ack)
+		cancel()
+		if err != nil && err != ErrorNoReply {
+			log.Errorf("Backup chunk %d not delivered to %s", chunk.Index, QmPeerId)
+			holder.Status = backup.HolderStatusError
+			holder.Error = err.Error()
+			return holder
+		}
+		if !ack.Stored {
+			holder.Status = backup.HolderStatusRefused
+			holder.Error = ack.Error
+			if holder.Error == "" {
+				holder.Error = ErrorBackupRefused.Error()
+			}
+			return holder
+		}
+	}
+	return holder
+}
+
+// Restore the latest backup in the background from the first holder able to return it, the secrets already stored are kept
+// The count of secrets restored is sent as event backup.restored, or backup.restore.failed when no holder return it
+func RestoreBackup(holders []string) error {
+	id, err := getPeerIdentity()
+	if err != nil {
+		return err
+	}
+	if id.MasterProof == nil || id.VaultKey == "" {
+		return device.ErrorNoMasterProof
+	}
+	background(func() {
+		restoreBackup(id, holders)
+	})
+	return nil
+}
+
+func restoreBackup(id identity.PeerIdentity, holders []string) {
+	for _, holder := range holders {
+		snapshot, err := fetchBackup(id, holder, BackupRestore{Proof: *id.MasterProof})
+		if err != nil {
+			log.Errorf("Backup not restored from %s: %s", holder, err)
+			continue
+		}
+
+		restored := 0
+		for _, s := range snapshot.Secrets {
+			keyPath := s.Namespace + "." + s.Key
+			if _, err := secret.FetchSecret([]byte(keyPath)); err != secret.ErrorSecretNotFound {
+				continue
+			}
+			plainSecret, err := fromVaultKey(id, s)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			if err := plainSecret.CreateSecretQuietly(); err != nil {
+				log.Error(err)
+				continue
+			}
+			restored++
+		}
+
+		_ = event.Write(event.Message{
+			Type: "backup.restored",
+			Data: map[string]string {
+				"PeerId": holder,
+				"CreatedAt": snapshot.CreatedAt,
+				"Restored": strconv.Itoa(restored),
+			},
+		})
+		return
+	}
+
+	_ = event.Write(event.Message{
+		Type: "backup.restore.failed",
+		Data: map[string]string {
+			"Holders": strconv.Itoa(len(holders)),
+			"Error": backup.ErrorBackupNotFound.Error(),
+		},
+	})
+}
+
+// Request the chunks of the latest backup one by one, a whole backup does not fit in a message
+func fetchBackup(id identity.PeerIdentity, holder string, request BackupRestore) (backup.Snapshot, error) {
+	snapshot := backup.Snapshot{}
+	var chunks []backup.Chunk
+	for total := 1; request.Index < total; request.Index++ {
+		chunk := backup.Chunk{}
+		ctx, cancel := DialContext()
+		err := DialRequest(ctx, holder, PidBackupRestore, request, &chunk)
+		cancel()
+		if err == ErrorNoReply {
+			return snapshot, backup.ErrorBackupNotFound
+		}
+		if err != nil {
+			return snapshot, err
+		}
+		if chunk.Index != request.Index || (request.Uuid != "" && chunk.Uuid != request.Uuid) {
+			return snapshot, backup.ErrorChunkCorrupted
+		}
+		// The next chunks must come from the same backup, even if the holder receive a new one meanwhile
+		request.Uuid = chunk.Uuid
+		total = chunk.Total
+		chunks = append(chunks, chunk)
+	}
+	cipherText, err := backup.Join(chunks)
+	if err != nil {
+		return snapshot, err
+	}
+	snapshotJson, err := crypto.DecryptAes(id.GetBackupKeyAsByte(), cipherText)
+	if err != nil {
+		return snapshot, err
+	}
+	err = json.Unmarshal(snapshotJson, &snapshot)
+	return snapshot, err
+}
+
+// Receive a chunk of backup, only trusted contacts within their quota are accepted
+func backupChunkProtocol(s network.Stream) {
+	log.Debug("Peer backupChunkProtocol")
+	log.Debugf("remote are: %s\n", s.Conn().RemotePeer())
+	defer s.Close()
+	rw := newCodec(s)
+	request := BackupChunk{}
+	if err := rw.Read(&request); err != nil {
+		log.Error(err)
+		return
+	}
+
+	remote := s.Conn().RemotePeer().Pretty()
+	ack := BackupAck{Stored: true}
+	c, err := contact.FetchContactOfPeer(remote)
+	switch {
+	case err != nil || c.Trust != contact.TrustTrusted:
+		ack = BackupAck{Error: ErrorBackupRefused.Error()}
+	case identity.VerifyMasterProof(remote, request.Proof) != nil:
+		ack = BackupAck{Error: ErrorBackupRefused.Error()}
+	default:
+		err = backup.HoldChunk(request.Proof.MasterPubKey, remote, request.Chunk, c.BackupQuota)
+		if err != nil {
+			log.Error(err)
+			ack = BackupAck{Error: err.Error()}
+		}
+	}
+	if err := rw.Write(ack); err != nil {
+		log.Error(err)
+		return
+	}
+
+	if ack.Stored && request.Chunk.Index == request.Chunk.Total - 1 {
+		_ = event.Write(event.Message{
+			Type: "backup.held",
+			Data: map[string]string {
+				"PeerId": remote,
+				"Uuid": request.Chunk.Uuid,
+				"Chunks": strconv.Itoa(request.Chunk.Total),
+			},
+		})
+	}
+}
+
+// Reply with a chunk of the latest backup to a device proving it is derived from the seed of the owner
+func backupRestoreProtocol(s network.Stream) {
+	log.Debug("Peer backupRestoreProtocol")
+	log.Debugf("remote are: %s\n", s.Conn().RemotePeer())
+	defer s.Close()
+	rw := newCodec(s)
+	request := BackupRestore{}
+	if err := rw.Read(&request); err != nil {
+		log.Error(err)
+		return
+	}
+
+	remote := s.Conn().RemotePeer().Pretty()
+	if err := identity.VerifyMasterProof(remote, request.Proof); err != nil {
+		log.Errorf("Backup restore refused, master proof of %s is not valid: %s", remote, err)
+		return
+	}
+	chunk, err := backup.FetchHeldChunk(request.Proof.MasterPubKey, request.Uuid, request.Index)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if err := rw.Write(chunk); err != nil {
+		log.Error(err)
+		return
+	}
+
+	if chunk.Index == chunk.Total - 1 {
+		_ = event.Write(event.Message{
+			Type: "backup.returned",
+			Data: map[string]string {
+				"PeerId": remote,
+				"Uuid": chunk.Uuid,
+				"Chunks": strconv.Itoa(chunk.Total),
+			},
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package peer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/PeerVault/PeerVault-Service/business/backup"
+	"github.com/PeerVault/PeerVault-Service/business/contact"
+	"github.com/PeerVault/PeerVault-Service/business/secret"
+)
+
+func TestBackupRestoreChunks(t *testing.T) {
+	instances := newInstances(t, "alice", "bob")
+	defer closeInstances(instances)
+	owner, holder := instances[0], instances[1]
+
+	holder.run(func() {
+		c := contact.Contact{PeerId: owner.QmPeerId, Trust: contact.TrustTrusted, BackupQuota: 4 * backup.ChunkSize}
+		if err := c.Save(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// The backup is larger than a chunk, it is restored one chunk at a time
+	value := strings.Repeat("x", backup.ChunkSize)
+	owner.run(func() {
+		createTestSecret(t, "staging", "certificate", value)
+		b, err := CreateBackup("backup-uuid", []string{holder.QmPeerId})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.Chunks < 2 || len(b.Holders) != 1 || b.Holders[0].Status != backup.HolderStatusPending {
+			t.Fatalf("Backup must be split in several chunks and pushed in the background, current: %v", b)
+		}
+	})
+	created := owner.waitEvent(t, "backup.created")
+	if created.Data["Uuid"] != "backup-uuid" || created.Data["Stored"] != "1" {
+		t.Fatalf("Backup must be stored by the holder, current: %v", created.Data)
+	}
+
+	owner.run(func() {
+		backups, err := backup.FetchBackups()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(backups) != 1 || backups[0].Holders[0].Status != backup.HolderStatusStored {
+			t.Errorf("Backup must be saved with the status of its holders, current: %v", backups)
+		}
+		if err := secret.DeleteSecret("staging.certificate"); err != nil {
+			t.Fatal(err)
+		}
+		if err := RestoreBackup([]string{holder.QmPeerId}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	restored := owner.waitEvent(t, "backup.restored")
+	if restored.Data["Restored"] != "1" {
+		t.Errorf("Secret deleted must be restored, current: %v", restored.Data)
+	}
+	owner.run(func() {
+		if received := fetchTestSecret(t, "staging.certificate"); received.Value != value {
+			t.Errorf("Secret restored must have the value backed up, current length: %d", len(received.Value))
+		}
+	})
+	returned := holder.waitEvent(t, "backup.returned")
+	if returned.Data["Uuid"] != "backup-uuid" || returned.Data["PeerId"] != owner.QmPeerId {
+		t.Errorf("Holder must be notified once the whole backup is returned, current: %v", returned.Data)
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+//
+// Peer package will manage all the communication with
+// the EXTERNAL Peers (libp2p) to exchange password with other Peer
+// same of different owner
+//
+// Codec will focus on the messages written on the streams, framed CBOR from the version 2 of the protocols
+// and newline-delimited JSON for the peers of a lower version
+package peer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/fxamacker/cbor"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+const (
+	framedMajorVersion = 2 // First major version of the protocols exchanging framed messages
+
+	MaxFrameSize = 64 << 10 // Payload of a frame, a larger message is streamed over several frames
+	MaxMessageSize = 16 << 20 // Size of a message refused, whatever the number of frames
+)
+
+// Codec of the messages exchanged on a stream
+type codec interface {
+	Read(v interface{}) error // io.EOF when the remote peer closed the stream without message
+	Write(v interface{}) error
+}
+
+// Ack written back on the stream for every framed message read
+type Ack struct {
+	Error string `json:",omitempty"` // Message not accepted, such as a message not decoded
+}
+
+// Codec of the version of the protocol negotiated on the stream
+func newCodec(s network.Stream) codec {
+	if protocolMajor(s.Protocol()) >= framedMajorVersion {
+		return &frameCodec{s: s, r: bufio.NewReader(s), w: bufio.NewWriter(s)}
+	}
+	return &lineCodec{rw: bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))}
+}
+
+// Major version of a semver protocol id, 0 for a legacy protocol id
+func protocolMajor(id protocol.ID) int {
+	parts := strings.Split(string(id), "/")
+	major, err := strconv.Atoi(strings.Split(parts[len(parts)-1], ".")[0])
+	if err != nil || !strings.Contains(parts[len(parts)-1], ".") {
+		return 0
+	}
+	return major
+}
+
+// One JSON message per line, the line is refused above MaxMessageSize
+type lineCodec struct {
+	rw *bufio.ReadWriter
+}
+
+func (c *lineCodec) Read(v interface{}) error {
+	var buf []byte
+	for {
+		line, err := c.rw.ReadSlice('\n')
+		buf = append(buf, line...)
+		if len(buf) > MaxMessageSize {
+			return ErrorMessageTooLarge
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(buf, v)
+	}
+}
+
+func (c *lineCodec) Write(v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := c.rw.Write(append(buf, '\n')); err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+// CBOR message split in frames, each frame is prefixed by the uvarint of its length
+// An empty frame ends the message, every message read is acknowledged on the same stream
+type frameCodec struct {
+	s network.Stream
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// Read the message then acknowledge it, the stream is reset on a message too large
+func (c *frameCodec) Read(v interface{}) error {
+	err := c.readMessage(v)
+	if err == io.EOF {
+		return err
+	}
+	if err == ErrorMessageTooLarge {
+		_ = c.s.Reset()
+		return err
+	}
+	if err != nil {
+		_ = c.writeMessage(Ack{Error: err.Error()})
+		return err
+	}
+	return c.writeMessage(Ack{})
+}
+
+// Write the message then wait for its ack
+func (c *frameCodec) Write(v interface{}) error {
+	if err := c.writeMessage(v); err != nil {
+		if err == ErrorMessageTooLarge {
+			_ = c.s.Reset()
+		}
+		return err
+	}
+	ack := Ack{}
+	if err := c.readMessage(&ack); err != nil {
+		return err
+	}
+	if ack.Error != "" {
+		log.Debugf("Message refused by %s: %s", c.s.Conn().RemotePeer().Pretty(), ack.Error)
+		return ErrorMessageRefused
+	}
+	return nil
+}
+
+func (c *frameCodec) readMessage(v interface{}) error {
+	fr := &frameReader{r: c.r}
+	if err := cbor.NewDecoder(fr).Decode(v); err != nil {
+		if fr.err != nil {
+			return fr.err
+		}
+		return err
+	}
+	// Consume the end of the message, the next message start after the empty frame
+	if _, err := io.Copy(ioutil.Discard, fr); err != nil {
+		return err
+	}
+	return fr.err
+}
+
+func (c *frameCodec) writeMessage(v interface{}) error {
+	fw := &frameWriter{w: c.w}
+	if err := cbor.NewEncoder(fw, cbor.EncOptions{}).Encode(v); err != nil {
+		return err
+	}
+	return fw.Close()
+}
+
+// Reader of the payload of the frames of a message, io.EOF on the empty frame
+type frameReader struct {
+	r *bufio.Reader
+	remaining uint64 // Bytes left in the current frame
+	total uint64
+	done bool
+	err error // Error of the stream, the decoder may hide it behind its own error
+}
+
+func (f *frameReader) Read(p []byte) (int, error) {
+	for f.remaining == 0 {
+		if f.done {
+			return 0, io.EOF
+		}
+		size, err := binary.ReadUvarint(f.r)
+		if err == io.EOF && f.total > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			f.err = err
+			return 0, err
+		}
+		if size == 0 {
+			f.done = true
+			return 0, io.EOF
+		}
+		if size > MaxFrameSize || f.total + size > MaxMessageSize {
+			f.err = ErrorMessageTooLarge
+			return 0, f.err
+		}
+		f.remaining = size
+		f.total += size
+	}
+	if uint64(len(p)) > f.remaining {
+		p = p[:f.remaining]
+	}
+	n, err := f.r.Read(p)
+	f.remaining -= uint64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		f.err = err
+	}
+	return n, err
+}
+
+// Writer of a message split in frames of MaxFrameSize at most
+type frameWriter struct {
+	w *bufio.Writer
+	total int
+}
+
+func (f *frameWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		size := len(p)
+		if size > MaxFrameSize {
+			size = MaxFrameSize
+		}
+		f.total += size
+		if f.total > MaxMessageSize {
+			return written, ErrorMessageTooLarge
+		}
+		if err := f.writeSize(size); err != nil {
+			return written, err
+		}
+		if _, err := f.w.Write(p[:size]); err != nil {
+			return written, err
+		}
+		written += size
+		p = p[size:]
+	}
+	return written, nil
+}
+
+// End the message with the empty frame
+func (f *frameWriter) Close() error {
+	if err := f.writeSize(0); err != nil {
+		return err
+	}
+	return f.w.Flush()
+}
+
+func (f *frameWriter) writeSize(size int) error {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, uint64(size))
+	_, err := f.w.Write(buf[:n])
+	return err
+}
@@ -0,0 +1,114 @@
+package peer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+type testMessage struct {
+	Uuid string
+	Payload string `json:",omitempty"`
+}
+
+// Stream of the dialer to a listener replying with the message received, for the versions of the listener
+func newCodecStream(t *testing.T, listenerVersions []string, dialerVersions []string) network.Stream {
+	mn, err := mocknet.FullMeshConnected(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+	setStreamHandler(hosts[1], listenerVersions, testPid, func(s network.Stream) {
+		defer s.Close()
+		rw := newCodec(s)
+		message := testMessage{}
+		if err := rw.Read(&message); err != nil {
+			return
+		}
+		_ = rw.Write(message)
+	})
+	s, err := hosts[0].NewStream(context.Background(), hosts[1].ID(), protocolIds(dialerVersions, testPid)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestCodecExchange(t *testing.T) {
+	tests := []struct {
+		name string
+		versions []string
+		payload string
+	}{
+		{"legacy line", nil, "secret"},
+		{"line", []string{"1.0.0"}, "secret"},
+		{"framed", []string{"2.0.0", "1.0.0"}, "secret"},
+		{"framed over several frames", []string{"2.0.0"}, strings.Repeat("a", MaxFrameSize * 3 + 10)},
+		{"framed binary payload", []string{"2.0.0"}, "line\nbreak\x00binary"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newCodecStream(t, test.versions, test.versions)
+			defer s.Close()
+			reply := testMessage{}
+			err := exchange(context.Background(), "listener", newCodec(s), testMessage{Uuid: "uuid", Payload: test.payload}, &reply)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply.Uuid != "uuid" || reply.Payload != test.payload {
+				t.Errorf("Reply must be the message sent, current: %s with %d bytes", reply.Uuid, len(reply.Payload))
+			}
+		})
+	}
+}
+
+func TestCodecTooLarge(t *testing.T) {
+	s := newCodecStream(t, []string{"2.0.0"}, []string{"2.0.0"})
+	message := testMessage{Uuid: "uuid", Payload: strings.Repeat("a", MaxMessageSize)}
+	if err := newCodec(s).Write(message); err != ErrorMessageTooLarge {
+		t.Errorf("Message above the maximum size must not be sent, current: %v", err)
+	}
+}
+
+func TestFrameReaderLimits(t *testing.T) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, MaxFrameSize + 1)
+	fr := &frameReader{r: bufio.NewReader(bytes.NewReader(buf[:n]))}
+	if _, err := fr.Read(make([]byte, 10)); err != ErrorMessageTooLarge {
+		t.Errorf("Frame above the maximum size must be refused, current: %v", err)
+	}
+
+	// Message of several frames, ended by the empty frame
+	var framed bytes.Buffer
+	w := bufio.NewWriter(&framed)
+	fw := &frameWriter{w: w}
+	if _, err := fw.Write([]byte(strings.Repeat("b", MaxFrameSize + 1))); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fr = &frameReader{r: bufio.NewReader(&framed)}
+	var payload bytes.Buffer
+	if _, err := payload.ReadFrom(fr); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Len() != MaxFrameSize + 1 || !fr.done {
+		t.Errorf("Frames must be read until the empty frame, current: %d bytes", payload.Len())
+	}
+}
+
+func TestLineCodecTooLarge(t *testing.T) {
+	line := strings.Repeat("c", MaxMessageSize + 1) + "\n"
+	rw := bufio.NewReadWriter(bufio.NewReader(strings.NewReader(line)), bufio.NewWriter(&bytes.Buffer{}))
+	c := &lineCodec{rw: rw}
+	if err := c.Read(&testMessage{}); err != ErrorMessageTooLarge {
+		t.Errorf("Line above the maximum size must be refused, current: %v", err)
+	}
+}
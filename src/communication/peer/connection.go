@@ -0,0 +1,366 @@
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+//
+// Peer package will manage all the communication with
+// the EXTERNAL Peers (libp2p) to exchange password with other Peer
+// same of different owner
+//
+// Connection will focus on the direct connections between peers, the relay is only a fallback
+// A relayed connection is upgraded by dialing the addresses of the peer learned by identify,
+// it succeeds when one of the peers is reachable: public address, port mapped on the router or same local network
+// Otherwise both peers behind a NAT punch a hole coordinated through the relay, see holepunch.go
+// The relayed connection is closed once the direct one is established, it stays in use when every dial failed
+package peer
+
+import (
+	"context"
+	"github.com/PeerVault/PeerVault-Service/communication/event"
+	autonat "github.com/libp2p/go-libp2p-autonat"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/transport"
+	swarm "github.com/libp2p/go-libp2p-swarm"
+	ma "github.com/multiformats/go-multiaddr"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	ConnectionDirect = "direct"
+	ConnectionRelay = "relay"
+
+	ReachabilityRelayOnly = "relay-only" // No listen address, every connection goes through the relay
+	ReachabilityUnknown = "unknown"
+	ReachabilityPublic = "public"
+	ReachabilityPrivate = "private"
+
+	directDialTimeout = 5 * time.Second
+	upgradeDelay = 2 * time.Second // Delay between two attempts to upgrade a relayed connection
+	upgradeAttempts = 5
+
+	// Address of the listener handing the direct connections over to the swarm, never announced to the peers
+	handoffAddr = "/unix/peervault-handoff"
+)
+
+// ConnectionStatus of a peer connected to the node
+type ConnectionStatus struct {
+	PeerId string
+	Type string // ConnectionDirect | ConnectionRelay
+	Addr string
+	Streams int
+}
+
+// NodeStatus of the libp2p node and its connections
+type NodeStatus struct {
+	PeerId string
+	Relays []RelayStatus
+	ListenAddrs []string
+	Addrs []string
+	Reachability string
+	PrivateNetwork bool // Only the nodes with the same swarm key can connect
+	Connections []ConnectionStatus
+}
+
+// Status of the node, with the type of every connection
+func Status() (NodeStatus, error) {
+	if node == nil {
+		return NodeStatus{}, ErrorNodeNotStarted
+	}
+	status := NodeStatus{
+		PeerId: node.ID().Pretty(),
+		Relays: RelayStatuses(),
+		Reachability: reachability(),
+		PrivateNetwork: swarmKeyPath != "",
+	}
+	for _, addr := range publicAddrs(node.Network().ListenAddresses()) {
+		status.ListenAddrs = append(status.ListenAddrs, addr.String())
+	}
+	for _, addr := range node.Addrs() {
+		status.Addrs = append(status.Addrs, addr.String())
+	}
+	for _, c := range node.Network().Conns() {
+		connectionType := ConnectionDirect
+		if isRelayed(c) {
+			connectionType = ConnectionRelay
+		}
+		status.Connections = append(status.Connections, ConnectionStatus{
+			PeerId: c.RemotePeer().Pretty(),
+			Type: connectionType,
+			Addr: c.RemoteMultiaddr().String(),
+			Streams: len(c.GetStreams()),
+		})
+	}
+	return status, nil
+}
+
+func reachability() string {
+	if natService == nil {
+		return ReachabilityRelayOnly
+	}
+	switch natService.Status() {
+	case autonat.NATStatusPublic:
+		return ReachabilityPublic
+	case autonat.NATStatusPrivate:
+		return ReachabilityPrivate
+	}
+	return ReachabilityUnknown
+}
+
+func isRelayed(c network.Conn) bool {
+	_, err := c.RemoteMultiaddr().ValueForProtocol(ma.P_CIRCUIT)
+	return err == nil
+}
+
+func hasDirectConn(id peer.ID) bool {
+	for _, c := range node.Network().ConnsToPeer(id) {
+		if !isRelayed(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// Addresses of the peer reachable without the relay, learned by identify on a previous connection
+func directAddrs(id peer.ID) []ma.Multiaddr {
+	var addrs []ma.Multiaddr
+	for _, addr := range node.Peerstore().Addrs(id) {
+		if _, err := addr.ValueForProtocol(ma.P_CIRCUIT); err != nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// Connect directly to the peer not connected yet, a relayed connection is upgraded in the background
+func connectDirect(ctx context.Context, id peer.ID) error {
+	if hasDirectConn(id) {
+		return nil
+	}
+	if node.Network().Connectedness(id) == network.Connected {
+		return ErrorRelayInUse
+	}
+	addrs := directAddrs(id)
+	if len(addrs) == 0 {
+		return ErrorNoDirectAddr
+	}
+
+	// Only the direct addresses are dialed, the relay address is given again on fallback
+	// The direct addresses keep their TTL, such as the addresses found by mDNS
+	for _, addr := range node.Peerstore().Addrs(id) {
+		if _, err := addr.ValueForProtocol(ma.P_CIRCUIT); err == nil {
+			node.Peerstore().SetAddr(id, addr, 0)
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, directDialTimeout)
+	defer cancel()
+	err := node.Connect(ctx, peer.AddrInfo{ID: id, Addrs: addrs})
+	if err != nil {
+		// The failed direct dial must not prevent the fallback on the relay
+		if s, ok := node.Network().(*swarm.Swarm); ok {
+			s.Backoff().Clear(id)
+		}
+		return err
+	}
+	log.Debugf("Direct connection with %s", id.Pretty())
+	return nil
+}
+
+// Connect directly to the peer connected through the relay, the relayed connection is kept open
+// The addresses learned are dialed first, then a hole is punched when both peers are behind a NAT
+func upgradeDirect(ctx context.Context, id peer.ID) error {
+	if addrs := directAddrs(id); len(addrs) > 0 {
+		err := dialDirect(ctx, id, addrs)
+		if err == nil {
+			return nil
+		}
+		log.Debugf("Direct dial of %s failed, punching a hole: %s", id.Pretty(), err)
+	}
+	return holePunch(ctx, id)
+}
+
+// Dial the peer with the transport of its direct addresses, even if a relayed connection is open
+// The swarm only dial a peer without connection, the connection dialed is handed over to it
+func dialDirect(ctx context.Context, id peer.ID, addrs []ma.Multiaddr) error {
+	s, ok := node.Network().(*swarm.Swarm)
+	if !ok {
+		return ErrorNoDirectAddr
+	}
+	ctx, cancel := context.WithTimeout(ctx, directDialTimeout)
+	defer cancel()
+	err := error(ErrorNoDirectAddr)
+	for _, addr := range addrs {
+		t := s.TransportForDialing(addr)
+		if t == nil || t.Proxy() || !t.CanDial(addr) {
+			continue
+		}
+		var c transport.CapableConn
+		c, err = t.Dial(ctx, addr, id)
+		if err != nil {
+			log.Debugf("Direct dial of %s on %s failed: %s", id.Pretty(), addr, err)
+			continue
+		}
+		return handOver(ctx, s, c)
+	}
+	return err
+}
+
+// Close the relayed connections without stream once the peer is connected directly
+// Return the count of relayed connections still in use
+func closeRelayedConns(id peer.ID) int {
+	inUse := 0
+	for _, c := range node.Network().ConnsToPeer(id) {
+		if !isRelayed(c) {
+			continue
+		}
+		if len(c.GetStreams()) > 0 {
+			inUse++
+			continue
+		}
+		_ = c.Close()
+	}
+	return inUse
+}
+
+// Try to replace a relayed connection by a direct one, once identify gave the addresses of the peer
+// The relayed connections still in use are closed once their streams are done
+func upgradeConnection(id peer.ID) {
+	for i := 0; i < upgradeAttempts; i++ {
+		time.Sleep(upgradeDelay)
+		if hasDirectConn(id) {
+			if closeRelayedConns(id) == 0 {
+				return
+			}
+			continue
+		}
+		if node.Network().Connectedness(id) != network.Connected {
+			return
+		}
+		if err := upgradeDirect(context.Background(), id); err != nil {
+			log.Debugf("Connection with %s stay relayed: %s", id.Pretty(), err)
+			continue
+		}
+		_ = event.Write(event.Message{
+			Type: "peer.connection.upgraded",
+			Data: map[string]string {
+				"PeerId": id.Pretty(),
+			},
+		})
+		if closeRelayedConns(id) == 0 {
+			return
+		}
+	}
+}
+
+// The addresses without the handoff listener, announced to the peers
+func publicAddrs(addrs []ma.Multiaddr) []ma.Multiaddr {
+	var public []ma.Multiaddr
+	for _, addr := range addrs {
+		if _, err := addr.ValueForProtocol(ma.P_UNIX); err != nil {
+			public = append(public, addr)
+		}
+	}
+	return public
+}
+
+// Listen for the direct connections handed over to the swarm of the host
+func startHandoff(h host.Host) error {
+	s, ok := h.Network().(*swarm.Swarm)
+	if !ok {
+		return nil
+	}
+	addr, err := ma.NewMultiaddr(handoffAddr)
+	if err != nil {
+		return err
+	}
+	if err := s.AddTransport(&handoffTransport{addr: addr, conns: make(chan transport.CapableConn)}); err != nil {
+		return err
+	}
+	return s.AddListenAddr(addr)
+}
+
+// Hand a connection over to the swarm, it is accepted as an inbound connection
+func handOver(ctx context.Context, s *swarm.Swarm, c transport.CapableConn) error {
+	addr, _ := ma.NewMultiaddr(handoffAddr)
+	t, ok := s.TransportForListening(addr).(*handoffTransport)
+	if !ok {
+		_ = c.Close()
+		return ErrorNoDirectAddr
+	}
+	select {
+	case t.conns <- c:
+	case <-ctx.Done():
+		_ = c.Close()
+		return ctx.Err()
+	}
+	// The swarm add the connection in the background
+	for !hasDirectConn(c.RemotePeer()) {
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	log.Debugf("Direct connection with %s", c.RemotePeer().Pretty())
+	return nil
+}
+
+// handoffTransport accept the connections dialed directly, it does not dial
+type handoffTransport struct {
+	addr ma.Multiaddr
+	conns chan transport.CapableConn
+}
+
+func (t *handoffTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.CapableConn, error) {
+	return nil, ErrorNoDirectAddr
+}
+
+func (t *handoffTransport) CanDial(addr ma.Multiaddr) bool {
+	return false
+}
+
+func (t *handoffTransport) Listen(laddr ma.Multiaddr) (transport.Listener, error) {
+	return &handoffListener{transport: t, closed: make(chan struct{})}, nil
+}
+
+func (t *handoffTransport) Protocols() []int {
+	return []int{ma.P_UNIX}
+}
+
+func (t *handoffTransport) Proxy() bool {
+	return false
+}
+
+type handoffListener struct {
+	transport *handoffTransport
+	closed chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *handoffListener) Accept() (transport.CapableConn, error) {
+	select {
+	case c := <-l.transport.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, io.EOF
+	}
+}
+
+// Closed by the swarm on teardown and once the accept loop ends
+func (l *handoffListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *handoffListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: handoffAddr, Net: "unix"}
+}
+
+func (l *handoffListener) Multiaddr() ma.Multiaddr {
+	return l.transport.addr
+}
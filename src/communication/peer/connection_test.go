@@ -0,0 +1,75 @@
+package peer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Relayed connection between the two instances, the direct addresses of the remote are learned by identify
+func relayedPeer(t *testing.T, local *instance, remote *instance) peer.ID {
+	id, err := peer.IDB58Decode(remote.QmPeerId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local.run(func() {
+		conns := node.Network().ConnsToPeer(id)
+		if len(conns) != 1 || !isRelayed(conns[0]) {
+			t.Fatalf("Instances must be connected through the relay, current: %v", conns)
+		}
+	})
+	return id
+}
+
+func TestUpgradeRelayedConnection(t *testing.T) {
+	instances, relay := newRelayedInstances(t, "alice", "bob")
+	defer relay.Close()
+	defer closeInstances(instances)
+	local, remote := instances[0], instances[1]
+	id := relayedPeer(t, local, remote)
+
+	local.run(func() {
+		if err := connectDirect(context.Background(), id); err != ErrorRelayInUse {
+			t.Errorf("Peer connected through the relay must be upgraded in the background, current: %v", err)
+		}
+		if err := upgradeDirect(context.Background(), id); err != nil {
+			t.Fatal(err)
+		}
+		// The relayed connection is kept until the direct one is established
+		relayed := 0
+		for _, c := range node.Network().ConnsToPeer(id) {
+			if isRelayed(c) {
+				relayed++
+			}
+		}
+		if !hasDirectConn(id) || relayed != 1 {
+			t.Errorf("Direct connection must be established next to the relayed one, relayed: %d", relayed)
+		}
+		if inUse := closeRelayedConns(id); inUse != 0 {
+			t.Errorf("Relayed connection without stream must be closed, in use: %d", inUse)
+		}
+		if err := connectDirect(context.Background(), id); err != nil {
+			t.Errorf("Peer must stay connected directly, current: %v", err)
+		}
+	})
+}
+
+func TestHolePunch(t *testing.T) {
+	instances, relay := newRelayedInstances(t, "alice", "bob")
+	defer relay.Close()
+	defer closeInstances(instances)
+	local, remote := instances[0], instances[1]
+	id := relayedPeer(t, local, remote)
+
+	local.run(func() {
+		// Without a direct address known, the addresses are exchanged through the relay
+		node.Peerstore().ClearAddrs(id)
+		if err := upgradeDirect(context.Background(), id); err != nil {
+			t.Fatal(err)
+		}
+		if !hasDirectConn(id) {
+			t.Error("Peer must be connected directly once the hole is punched")
+		}
+	})
+}
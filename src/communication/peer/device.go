@@ -0,0 +1,273 @@
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+//
+// Peer package will manage all the communication with
+// the EXTERNAL Peers (libp2p) to exchange password with other Peer
+// same of different owner
+//
+// Device will focus on Protocol regarding the devices linked to the same owner
+package peer
+
+import (
+	"github.com/PeerVault/PeerVault-Service/business/device"
+	"github.com/PeerVault/PeerVault-Service/communication/event"
+	"github.com/PeerVault/PeerVault-Service/identity"
+	"github.com/libp2p/go-libp2p-core/network"
+	"strconv"
+)
+
+// DeviceLink is sent by a device restored from the seed to a device already linked
+type DeviceLink struct {
+	Device device.Device
+}
+
+// Link the local device to a device of the same owner
+// The master proof of the local device is verified by the remote one, which reply with the signed device list
+func LinkDevice(QmPeerId string) (device.DeviceList, error) {
+	id, err := getPeerIdentity()
+	if err != nil {
+		return device.DeviceList{}, err
+	}
+	if id.MasterProof == nil {
+		return device.DeviceList{}, device.ErrorNoMasterProof
+	}
+	link := DeviceLink{
+		Device: device.Device{
+			PeerId: id.Id,
+			Name: id.Name,
+			Proof: *id.MasterProof,
+		},
+	}
+	ctx, cancel := RequestContext()
+	defer cancel()
+	l := device.DeviceList{}
+	err = DialRequest(ctx, QmPeerId, PidDeviceLink, link, &l)
+	if err == ErrorNoReply {
+		return l, device.ErrorDeviceNotLinked
+	}
+	if err != nil {
+		return l, err
+	}
+	if l.Signer != QmPeerId || !l.HasDevice(id.Id) {
+		return l, device.ErrorDeviceNotLinked
+	}
+	if err := acceptDeviceList(id, l); err != nil {
+		return l, err
+	}
+	// Initial full sync of the vault with the devices of the owner
+	background(func() {
+		if _, err := SyncVault(); err != nil {
+			log.Error(err)
+		}
+	})
+	return l, nil
+}
+
+// Revoke a device of the owner, the new list is pushed in the background to every device including the revoked one
+func RevokeDevice(QmPeerId string) error {
+	id, err := getPeerIdentity()
+	if err != nil {
+		return err
+	}
+	l, err := device.FetchDeviceList(id)
+	if err != nil {
+		return err
+	}
+	if err := l.RevokeDevice(QmPeerId); err != nil {
+		return err
+	}
+	if err := l.Sign(id); err != nil {
+		return err
+	}
+	if err := l.Save(); err != nil {
+		return err
+	}
+	background(func() {
+		pushDeviceList(id, l, QmPeerId)
+	})
+	return nil
+}
+
+// Send the device list to the other devices, and to the extra recipients such as a revoked device
+func pushDeviceList(id identity.PeerIdentity, l device.DeviceList, extra ...string) {
+	recipients := extra
+	for _, d := range l.Devices {
+		recipients = append(recipients, d.PeerId)
+	}
+	for _, recipient := range recipients {
+		if recipient == id.Id {
+			continue
+		}
+		ctx, cancel := DialContext()
+		err := Dial(ctx, recipient, PidDeviceList, l)
+		cancel()
+		if err != nil {
+			log.Errorf("Device list version %d not delivered to %s", l.Version, recipient)
+			log.Error(err)
+		}
+	}
+}
+
+// Verify and save a device list received from another device of the owner
+func acceptDeviceList(id identity.PeerIdentity, l device.DeviceList) error {
+	if id.MasterProof == nil {
+		return device.ErrorNoMasterProof
+	}
+	if l.MasterPubKey != id.MasterProof.MasterPubKey {
+		return device.ErrorDeviceListSignature
+	}
+	if err := l.Verify(); err != nil {
+		return err
+	}
+	if err := l.Save(); err != nil {
+		return err
+	}
+
+	eventType := "device.list.updated"
+	if l.IsRevoked(id.Id) {
+		eventType = "device.revoked"
+	}
+	_ = event.Write(event.Message{
+		Type: eventType,
+		Data: map[string]string {
+			"Signer": l.Signer,
+			"Version": strconv.Itoa(l.Version),
+			"Devices": strconv.Itoa(len(l.Devices)),
+		},
+	})
+	return nil
+}
+
+// Receive the link request of a device restored from the seed of the owner
+func deviceLinkProtocol(s network.Stream) {
+	log.Debug("Peer deviceLinkProtocol")
+	log.Debugf("remote are: %s\n", s.Conn().RemotePeer())
+	defer s.Close()
+	rw := newCodec(s)
+	link := DeviceLink{}
+	if err := rw.Read(&link); err != nil {
+		log.Error(err)
+		return
+	}
+	if link.Device.PeerId != s.Conn().RemotePeer().Pretty() {
+		log.Error("Device link corrupted, device and remote peer are different")
+		return
+	}
+
+	id, err := getPeerIdentity()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	l, err := device.FetchDeviceList(id)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if link.Device.Proof.MasterPubKey != l.MasterPubKey {
+		log.Errorf("Device link refused, %s is not derived from the same seed", link.Device.PeerId)
+		return
+	}
+	if err := identity.VerifyMasterProof(link.Device.PeerId, link.Device.Proof); err != nil {
+		log.Errorf("Device link refused, master proof of %s is not valid: %s", link.Device.PeerId, err)
+		return
+	}
+
+	if err := l.AddDevice(link.Device); err != nil {
+		log.Errorf("Device link refused, %s: %s", link.Device.PeerId, err)
+		return
+	}
+	if err := l.Sign(id); err != nil {
+		log.Error(err)
+		return
+	}
+	if err := l.Save(); err != nil {
+		log.Error(err)
+		return
+	}
+	if err := rw.Write(l); err != nil {
+		log.Error(err)
+		return
+	}
+
+	_ = event.Write(event.Message{
+		Type: "device.linked",
+		Data: map[string]string {
+			"PeerId": link.Device.PeerId,
+			"Name": link.Device.Name,
+			"Version": strconv.Itoa(l.Version),
+		},
+	})
+	go pushDeviceList(id, l)
+}
+
+// Receive a new version of the device list
+func deviceListProtocol(s network.Stream) {
+	log.Debug("Peer deviceListProtocol")
+	log.Debugf("remote are: %s\n", s.Conn().RemotePeer())
+	rw := newCodec(s)
+	l := device.DeviceList{}
+	err := rw.Read(&l)
+	_ = s.Close()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if l.Signer != s.Conn().RemotePeer().Pretty() {
+		log.Error("Device list corrupted, signer and remote peer are different")
+		return
+	}
+
+	id, err := getPeerIdentity()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	local, err := device.FetchDeviceList(id)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if !local.HasDevice(l.Signer) {
+		log.Errorf("Device list refused, %s is not a device of the owner", l.Signer)
+		return
+	}
+	switch {
+	case l.IsRevoked(id.Id):
+		// The local device is revoked, it cannot sign a merged list anymore
+		err = acceptDeviceList(id, l)
+	case local.Covers(l):
+		log.Debugf("Device list version %d ignored, already known by local version %d", l.Version, local.Version)
+	case l.Covers(local) && l.Version > local.Version:
+		err = acceptDeviceList(id, l)
+	default:
+		err = mergeDeviceList(id, local, l)
+	}
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// Merge a device list forked from the local one, then push the merged list to the other devices
+// Both lists were changed from the same version, neither of them can replace the other without losing a change
+func mergeDeviceList(id identity.PeerIdentity, local device.DeviceList, l device.DeviceList) error {
+	if l.MasterPubKey != local.MasterPubKey {
+		return device.ErrorDeviceListSignature
+	}
+	if err := l.Verify(); err != nil {
+		return err
+	}
+	log.Noticef("Device list version %d of %s forked from local version %d, lists merged", l.Version, l.Signer, local.Version)
+	local.Merge(l)
+	if err := local.Sign(id); err != nil {
+		return err
+	}
+	if err := acceptDeviceList(id, local); err != nil {
+		return err
+	}
+	background(func() {
+		pushDeviceList(id, local)
+	})
+	return nil
+}
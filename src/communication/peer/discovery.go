@@ -0,0 +1,98 @@
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+//
+// Peer package will manage all the communication with
+// the EXTERNAL Peers (libp2p) to exchange password with other Peer
+// same of different owner
+//
+// Discovery will focus on the peers found on the local network with mDNS
+package peer
+
+import (
+	"context"
+	"github.com/PeerVault/PeerVault-Service/communication/event"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p/p2p/discovery"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	mdnsServiceTag = "_peervault-discovery._udp"
+	mdnsInterval = 10 * time.Second
+	discoveredDelay = 10 * time.Minute // Delay before a peer still on the network is notified again
+)
+
+var (
+	mdnsEnabled bool
+	discovered = make(map[peer.ID]time.Time)
+	discoveredLock sync.Mutex
+)
+
+type mdnsNotifee struct{}
+
+// Discover the other nodes on the local network, only when the node listen for direct connections
+func EnableMdns() {
+	mdnsEnabled = true
+}
+
+func startMdns(ctx context.Context) {
+	if len(listenAddrs) == 0 {
+		log.Warning("mDNS discovery needs listen addresses, the node is relay only")
+		return
+	}
+	service, err := discovery.NewMdnsService(ctx, node, mdnsInterval, mdnsServiceTag)
+	if err != nil {
+		log.Errorf("mDNS discovery not started: %s", err)
+		return
+	}
+	service.RegisterNotifee(&mdnsNotifee{})
+	log.Info("mDNS discovery started")
+}
+
+// Connect directly to the peer found on the local network and notify the client with its profile
+func (n *mdnsNotifee) HandlePeerFound(pi peer.AddrInfo) {
+	if pi.ID == node.ID() || !isNewlyDiscovered(pi.ID) {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), directDialTimeout)
+		defer cancel()
+		if err := node.Connect(ctx, pi); err != nil {
+			log.Debugf("Peer %s discovered but unreachable: %s", pi.ID.Pretty(), err)
+			forgetDiscovered(pi.ID)
+			return
+		}
+
+		var addrs []string
+		for _, addr := range pi.Addrs {
+			addrs = append(addrs, addr.String())
+		}
+		_ = event.Write(event.Message{
+			Type: "peer.discovered",
+			Data: peerInfoEventData(pi.ID.Pretty(), map[string]string {
+				"PeerId": pi.ID.Pretty(),
+				"Addrs": strings.Join(addrs, ","),
+			}),
+		})
+	}()
+}
+
+// mDNS announce the peers at every interval, they are notified once per discoveredDelay
+func isNewlyDiscovered(id peer.ID) bool {
+	discoveredLock.Lock()
+	defer discoveredLock.Unlock()
+	if at, ok := discovered[id]; ok && time.Since(at) < discoveredDelay {
+		return false
+	}
+	discovered[id] = time.Now()
+	return true
+}
+
+func forgetDiscovered(id peer.ID) {
+	discoveredLock.Lock()
+	defer discoveredLock.Unlock()
+	delete(discovered, id)
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+//
+// Peer package will manage all the communication with
+// the EXTERNAL Peers (libp2p) to exchange password with other Peer
+// same of different owner
+//
+// Gate will focus on the peers allowed to connect and open streams, backed by the contact book
+package peer
+
+import (
+	"github.com/PeerVault/PeerVault-Service/business/contact"
+	"github.com/PeerVault/PeerVault-Service/business/device"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"sync"
+	"time"
+)
+
+const (
+	GateOpen = "open" // Every peer not blocked can open streams
+	GateAllowlist = "allowlist" // Only the known and trusted contacts and the devices of the owner can open streams
+
+	streamBucketIdle = time.Minute // A bucket unused this long is full again, as a new one, it is removed
+)
+
+var (
+	gateMode = GateOpen
+	streamRate = 30 // Inbound streams per minute of a peer neither trusted nor a device of the owner, 0 for unlimited
+	streamBuckets = make(map[peer.ID]*streamBucket)
+	streamBucketsLock sync.Mutex
+	streamBucketsPruned time.Time
+)
+
+type streamBucket struct {
+	tokens float64
+	last time.Time
+}
+
+func SetGateMode(mode string) {
+	gateMode = mode
+}
+
+func SetStreamRate(perMinute int) {
+	streamRate = perMinute
+}
+
+// Protocols open in allowlist mode, their requests are verified by a token or a master proof
+func isOpenProtocol(pid protocol.ID) bool {
+	return pid == PidInviteRedeem || pid == PidDeviceLink
+}
+
+// Handler refusing the streams of the peers blocked, not allowed or above their rate limit
+func gateHandler(pid protocol.ID, handler network.StreamHandler) network.StreamHandler {
+	return func(s network.Stream) {
+		remote := s.Conn().RemotePeer()
+		if err := allowStream(remote, pid); err != nil {
+			log.Debugf("Stream %s of %s refused: %s", s.Protocol(), remote.Pretty(), err)
+			_ = s.Reset()
+			return
+		}
+		log.Debugf("Stream %s version %s of %s", pid, streamVersion(s, pid), remote.Pretty())
+		handler(s)
+	}
+}
+
+func allowStream(id peer.ID, pid protocol.ID) error {
+	c, err := contact.FetchContactOfPeer(id.Pretty())
+	known := err == nil
+	if known && c.Blocked {
+		return ErrorPeerBlocked
+	}
+	trusted := (known && c.Trust == contact.TrustTrusted) || isOwnerPeer(id)
+	if gateMode == GateAllowlist && !isOpenProtocol(pid) && !trusted && !(known && c.Trust == contact.TrustKnown) {
+		return ErrorPeerNotAllowed
+	}
+	if !trusted && !takeStreamToken(id) {
+		return ErrorRateLimited
+	}
+	return nil
+}
+
+func isOwnerPeer(id peer.ID) bool {
+	localId, err := getPeerIdentity()
+	if err != nil || localId.MasterProof == nil {
+		return false
+	}
+	l, err := device.FetchDeviceList(localId)
+	if err != nil {
+		return false
+	}
+	return l.HasDevice(id.Pretty())
+}
+
+// Token bucket of the inbound streams, refilled by streamRate tokens per minute
+func takeStreamToken(id peer.ID) bool {
+	if streamRate <= 0 {
+		return true
+	}
+	streamBucketsLock.Lock()
+	defer streamBucketsLock.Unlock()
+	now := time.Now()
+	pruneStreamBuckets(now)
+	b, ok := streamBuckets[id]
+	if !ok {
+		b = &streamBucket{tokens: float64(streamRate), last: now}
+		streamBuckets[id] = b
+	}
+	b.tokens += now.Sub(b.last).Minutes() * float64(streamRate)
+	if b.tokens > float64(streamRate) {
+		b.tokens = float64(streamRate)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Remove the idle buckets, at most once per idle period, so a peer rotating its identity cannot grow the map
+// The buckets lock must be held
+func pruneStreamBuckets(now time.Time) {
+	if now.Sub(streamBucketsPruned) < streamBucketIdle {
+		return
+	}
+	streamBucketsPruned = now
+	for id, b := range streamBuckets {
+		if now.Sub(b.last) >= streamBucketIdle {
+			delete(streamBuckets, id)
+		}
+	}
+}
+
+// Close the connections of the blocked peers as soon as they connect
+func watchGate() {
+	node.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(n network.Network, c network.Conn) {
+			if isBlocked(c.RemotePeer()) {
+				log.Debugf("Connection of %s closed, the peer is blocked", c.RemotePeer().Pretty())
+				go c.Close()
+			}
+		},
+	})
+}
+
+func isBlocked(id peer.ID) bool {
+	c, err := contact.FetchContactOfPeer(id.Pretty())
+	return err == nil && c.Blocked
+}
+
+// Block a peer and close its connections
+func BlockPeer(QmPeerId string) (contact.Contact, error) {
+	c, err := contact.Block(QmPeerId)
+	if err != nil {
+		return c, err
+	}
+	if node != nil {
+		if id, err := peer.IDB58Decode(QmPeerId); err == nil {
+			_ = node.Network().ClosePeer(id)
+		}
+	}
+	return c, nil
+}
+
+// Block the sender of a share request received, the request is dropped
+func BlockRequestSender(uuid string) (contact.Contact, error) {
+	request, ok := takeRequest(uuid)
+	if !ok {
+		return contact.Contact{}, ErrorShareNotFound
+	}
+	return BlockPeer(request.Sender)
+}
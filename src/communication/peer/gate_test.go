@@ -0,0 +1,35 @@
+package peer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestStreamBucketsPruned(t *testing.T) {
+	now := time.Now()
+	streamBucketsLock.Lock()
+	defer streamBucketsLock.Unlock()
+	streamBuckets = map[peer.ID]*streamBucket{
+		peer.ID("idle"): {tokens: 0, last: now.Add(-streamBucketIdle)},
+		peer.ID("active"): {tokens: 0, last: now.Add(-time.Second)},
+	}
+	streamBucketsPruned = now.Add(-streamBucketIdle)
+
+	pruneStreamBuckets(now)
+	if _, ok := streamBuckets[peer.ID("idle")]; ok {
+		t.Error("Bucket idle for a whole refill must be removed")
+	}
+	if _, ok := streamBuckets[peer.ID("active")]; !ok {
+		t.Error("Bucket in use must be kept, its tokens are not refilled yet")
+	}
+
+	// The buckets are not scanned again before the next idle period
+	streamBuckets[peer.ID("idle")] = &streamBucket{last: now.Add(-streamBucketIdle)}
+	pruneStreamBuckets(now.Add(time.Second))
+	if _, ok := streamBuckets[peer.ID("idle")]; !ok {
+		t.Error("Buckets must be pruned at most once per idle period")
+	}
+	streamBuckets = make(map[peer.ID]*streamBucket)
+}
@@ -0,0 +1,437 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PeerVault/PeerVault-Service/business/owner"
+	"github.com/PeerVault/PeerVault-Service/business/secret"
+	"github.com/PeerVault/PeerVault-Service/business/team"
+	"github.com/PeerVault/PeerVault-Service/communication/event"
+	"github.com/PeerVault/PeerVault-Service/crypto"
+	"github.com/PeerVault/PeerVault-Service/database"
+	"github.com/PeerVault/PeerVault-Service/identity"
+	"github.com/google/uuid"
+	"github.com/libp2p/go-libp2p"
+	circuit "github.com/libp2p/go-libp2p-circuit"
+	p2pCrypto "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	ma "github.com/multiformats/go-multiaddr"
+	"go.etcd.io/bbolt"
+)
+
+// The state of a PeerVault service is global: database connection, libp2p node, share requests...
+// Every instance of the harness run its own state in the same process, only one instance run at a time
+// The baton is held by the instance running, it is given back while a stream wait for the remote peer
+var (
+	baton sync.Mutex
+	running *instance
+	listenEvents sync.Once
+	tasks sync.WaitGroup // Tasks run in the background by the instances
+)
+
+const eventTimeout = 10 * time.Second
+
+// Instance of PeerVault with its own database, owner identity and mock libp2p node
+type instance struct {
+	name string
+	QmPeerId string
+	dir string
+	db *bbolt.DB
+	host host.Host
+	requests map[string]ShareRequest
+	verifications map[string]Verification
+	invitations map[string]TeamMembership
+	events []event.Message // Events written by the instance
+}
+
+// Several instances connected together on a mock network, the handlers of every protocol are set
+// The instances must be closed at the end of the test
+func newInstances(t *testing.T, names ...string) []*instance {
+	listenEvents.Do(func() {
+		event.OnMessage(func(m event.Message) {
+			// Messages are only written by the instance holding the baton
+			if running != nil {
+				running.events = append(running.events, m)
+			}
+		})
+		// A task in the background run as the instance which started it, once the baton is free
+		background = func(task func()) {
+			inst := running
+			tasks.Add(1)
+			go func() {
+				defer tasks.Done()
+				inst.run(task)
+			}()
+		}
+	})
+	mn := mocknet.New(context.Background())
+	var instances []*instance
+	for i, name := range names {
+		inst, pvtKey := newInstance(t, name)
+		instances = append(instances, inst)
+		addr, _ := ma.NewMultiaddr(fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", 4001 + i))
+		h, err := mn.AddPeer(pvtKey, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inst.setHost(h)
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.ConnectAllButSelf(); err != nil {
+		t.Fatal(err)
+	}
+	return instances
+}
+
+// Instances with a libp2p node listening on the loopback, connected together through a circuit relay
+// The relay must be closed at the end of the test, after the instances
+func newRelayedInstances(t *testing.T, names ...string) ([]*instance, host.Host) {
+	ctx := context.Background()
+	relay, err := libp2p.New(ctx, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"), libp2p.EnableRelay(circuit.OptHop))
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayInfo := peer.AddrInfo{ID: relay.ID(), Addrs: relay.Addrs()}
+	var instances []*instance
+	for _, name := range names {
+		inst, pvtKey := newInstance(t, name)
+		instances = append(instances, inst)
+		h, err := libp2p.New(ctx,
+			libp2p.Identity(pvtKey),
+			libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"),
+			libp2p.EnableRelay(),
+			libp2p.AddrsFactory(publicAddrs),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := startHandoff(h); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.Connect(ctx, relayInfo); err != nil {
+			t.Fatal(err)
+		}
+		inst.setHost(h)
+	}
+	for i, inst := range instances {
+		for _, remote := range instances[i+1:] {
+			circuitAddr, err := ma.NewMultiaddr(fmt.Sprintf("/p2p/%s/p2p-circuit", relay.ID().Pretty()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			remoteId, _ := peer.IDB58Decode(remote.QmPeerId)
+			if err := inst.host.(*harnessHost).Host.Connect(ctx, peer.AddrInfo{ID: remoteId, Addrs: []ma.Multiaddr{circuitAddr}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return instances, relay
+}
+
+// Set the node of the instance, the handlers of every protocol are set
+func (inst *instance) setHost(h host.Host) {
+	inst.host = &harnessHost{Host: h}
+	for _, sh := range streamHandlers() {
+		setStreamHandler(h, protocolVersions, sh.pid, inst.handle(gateHandler(sh.pid, sh.handler)))
+	}
+}
+
+func closeInstances(instances []*instance) {
+	tasks.Wait()
+	for _, inst := range instances {
+		if inst.host != nil {
+			_ = inst.host.Close()
+		}
+		_ = inst.db.Close()
+		_ = os.RemoveAll(inst.dir)
+	}
+}
+
+// Instance with a new owner in a temporary database, created as on POST /owner
+// The linux keychain is kept in the database, therefore the identity too
+func newInstance(t *testing.T, name string) (*instance, p2pCrypto.PrivKey) {
+	dir, err := ioutil.TempDir("", "peervault-" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bbolt.Open(filepath.Join(dir, "peervault.db"), 0600, &bbolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst := &instance{
+		name: name,
+		dir: dir,
+		db: db,
+		requests: make(map[string]ShareRequest),
+		verifications: make(map[string]Verification),
+		invitations: make(map[string]TeamMembership),
+	}
+	var pvtKey p2pCrypto.PrivKey
+	inst.run(func() {
+		seed := &crypto.Seed{}
+		seed.CreateSeed()
+		master, err := seed.CreateMasterKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		child, err := crypto.CreateChildKey(master)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pvtKey, err = crypto.BipKeyToLibp2p(child)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peerIdentity, err := identity.CreateIdentity(name, pvtKey, child.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := peerIdentity.SetMasterProof(master, child); err != nil {
+			t.Fatal(err)
+		}
+		peerIdentity.SetVaultKey(master)
+		o := owner.Owner{QmPeerId: peerIdentity.Id, Nickname: name, DeviceName: name}
+		if err := o.PutOwner(); err != nil {
+			t.Fatal(err)
+		}
+		if err := peerIdentity.SaveIdentity(); err != nil {
+			t.Fatal(err)
+		}
+		inst.QmPeerId = peerIdentity.Id
+	})
+	return inst, pvtKey
+}
+
+// Install the state of the instance, the baton is held until release
+func (inst *instance) acquire() {
+	baton.Lock()
+	running = inst
+	database.SetConnection(inst.db)
+	node = inst.host
+	requests = inst.requests
+	verifications = inst.verifications
+	invitations = inst.invitations
+}
+
+func (inst *instance) release() {
+	inst.requests = requests
+	inst.verifications = verifications
+	inst.invitations = invitations
+	running = nil
+	baton.Unlock()
+}
+
+// Run a step of the test as the instance, such as an action of its owner
+func (inst *instance) run(fn func()) {
+	inst.acquire()
+	defer inst.release()
+	fn()
+}
+
+// Handler of a stream received by the instance
+func (inst *instance) handle(handler network.StreamHandler) network.StreamHandler {
+	return func(s network.Stream) {
+		inst.acquire()
+		defer inst.release()
+		handler(&harnessStream{Stream: s, inst: inst})
+	}
+}
+
+// Wait for an event written by the instance, the handlers of the other instances run meanwhile
+func (inst *instance) waitEvent(t *testing.T, eventType string) event.Message {
+	deadline := time.Now().Add(eventTimeout)
+	for time.Now().Before(deadline) {
+		inst.acquire()
+		for _, m := range inst.events {
+			if m.Type == eventType {
+				inst.release()
+				return m
+			}
+		}
+		inst.release()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Event %s not written by %s", eventType, inst.name)
+	return event.Message{}
+}
+
+// Host of an instance, the baton is given back while the remote peer is dialed
+type harnessHost struct {
+	host.Host
+}
+
+func (h *harnessHost) Connect(ctx context.Context, pi peer.AddrInfo) error {
+	inst := running
+	inst.release()
+	defer inst.acquire()
+	return h.Host.Connect(ctx, pi)
+}
+
+func (h *harnessHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (network.Stream, error) {
+	inst := running
+	inst.release()
+	s, err := h.Host.NewStream(ctx, p, pids...)
+	inst.acquire()
+	if err != nil {
+		return nil, err
+	}
+	return &harnessStream{Stream: s, inst: inst}, nil
+}
+
+// Stream of an instance, the baton is given back while the remote peer read or write
+type harnessStream struct {
+	network.Stream
+	inst *instance
+}
+
+func (s *harnessStream) Read(p []byte) (int, error) {
+	s.inst.release()
+	defer s.inst.acquire()
+	return s.Stream.Read(p)
+}
+
+func (s *harnessStream) Write(p []byte) (int, error) {
+	s.inst.release()
+	defer s.inst.acquire()
+	return s.Stream.Write(p)
+}
+
+func (s *harnessStream) Close() error {
+	s.inst.release()
+	defer s.inst.acquire()
+	return s.Stream.Close()
+}
+
+func (s *harnessStream) Reset() error {
+	s.inst.release()
+	defer s.inst.acquire()
+	return s.Stream.Reset()
+}
+
+// Secret of the owner ciphered with its key, as created by the client
+func createTestSecret(t *testing.T, namespace string, key string, value string) {
+	id, err := getPeerIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipherValue, err := crypto.EncryptAes(id.GetChildKeyAsByte(), []byte(value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretData := secret.Secret{Namespace: namespace, Type: secret.SecretTypePassword, Key: key, Value: string(cipherValue)}
+	if err := secretData.CreateSecret(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Secret stored by the instance with its value deciphered
+func fetchTestSecret(t *testing.T, keyPath string) secret.Secret {
+	secretData, err := secret.FetchSecret([]byte(keyPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := getPeerIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainText, err := crypto.DecryptAes(id.GetChildKeyAsByte(), []byte(secretData.Value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretData.Value = string(plainText)
+	return secretData
+}
+
+// Share created by the sender then requested to the receiver, as on POST /expose/request
+// Return the uuid of the share
+func requestTestShare(t *testing.T, sender *instance, receiver *instance, keyPath string, subscribe bool) string {
+	return requestTestShareOf(t, sender, receiver, Share{KeyPath: keyPath, Subscribe: subscribe})
+}
+
+// Share given created by the sender then requested to the receiver
+func requestTestShareOf(t *testing.T, sender *instance, receiver *instance, share Share) string {
+	share.Receiver = receiver.QmPeerId
+	share.Expiration = time.Now().UTC().Add(time.Hour).Format(time.RFC3339)
+	sender.run(func() {
+		created, _, err := CreateShare(share)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := RequestShare(created); err != nil {
+			t.Fatal(err)
+		}
+		share = created
+	})
+	return share.Uuid
+}
+
+// Share approved or declined by the receiver, as on PUT /expose/request
+func respondTestShare(t *testing.T, sender *instance, receiver *instance, shareUuid string, approved bool) {
+	receiver.run(func() {
+		response := ShareResponse{Uuid: shareUuid, Sender: sender.QmPeerId, Approved: approved}
+		if err := RespondShare(response, ""); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// Team created by the admin with the members given, then pushed to them
+// Return the uuid of the team
+func pushTestTeam(t *testing.T, admin *instance, namespace string, members ...*instance) string {
+	teamData := team.Team{Uuid: uuid.New().String(), Name: "ops", Namespace: namespace, Version: 1}
+	admin.run(func() {
+		id, err := getPeerIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		createTestSecret(t, namespace, "token", "s3cr3t")
+		teamData.AddMember(admin.QmPeerId, true)
+		for _, member := range members {
+			teamData.AddMember(member.QmPeerId, false)
+		}
+		if err := teamData.RotateGroupKey(id); err != nil {
+			t.Fatal(err)
+		}
+		if err := teamData.Sign(id); err != nil {
+			t.Fatal(err)
+		}
+		if err := teamData.Save(); err != nil {
+			t.Fatal(err)
+		}
+		if err := PushTeam(teamData, nil); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return teamData.Uuid
+}
+
+// Access requested by the requester to the owner of the secret, as on POST /secret/access
+// Return the uuid of the access request
+func requestTestAccess(t *testing.T, requester *instance, owner *instance, keyPath string, expiration time.Time) string {
+	accessRequest := AccessRequest{
+		Uuid: uuid.New().String(),
+		Requester: requester.QmPeerId,
+		Owner: owner.QmPeerId,
+		Expiration: expiration.UTC().Format(time.RFC3339),
+		KeyPath: keyPath,
+	}
+	requester.run(func() {
+		if err := RequestAccess(accessRequest, ""); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return accessRequest.Uuid
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+//
+// Peer package will manage all the communication with
+// the EXTERNAL Peers (libp2p) to exchange password with other Peer
+// same of different owner
+//
+// Hole punching will focus on the direct connection of two peers behind a NAT, coordinated through the relay
+// The peers exchange their addresses, observed ones included, over the relayed connection and measure its round trip.
+// The recipient then sends a SYN from its listen port with a TTL too low to reach the initiator,
+// its NAT maps the port for the initiator which dials right after, its SYN goes through both NAT.
+// A NAT mapping a different port for each destination (symmetric NAT) cannot be punched, the relay stays in use
+package peer
+
+import (
+	"context"
+	reuseport "github.com/libp2p/go-reuseport"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	punchTTL = 5 // Hops of the SYN opening the NAT, enough to leave the local network but not to reach the remote NAT
+	punchTimeout = 100 * time.Millisecond // Time given to the SYN to open the NAT, before the initiator dials
+)
+
+// HolePunch is exchanged over the relayed connection, the initiator sends its addresses then the sync
+type HolePunch struct {
+	Addrs []string `json:",omitempty"`
+	Sync bool `json:",omitempty"` // The initiator dials once the recipient received the sync and opened its NAT
+}
+
+// Punch a hole with a peer connected through the relay, then dial it directly
+func holePunch(ctx context.Context, id peer.ID) error {
+	ctx, cancel := context.WithTimeout(ctx, directDialTimeout)
+	defer cancel()
+	stream, err := node.NewStream(ctx, id, protocolIds(protocolVersions, PidHolePunch)...)
+	if err != nil {
+		return streamError(ctx, id.Pretty(), err)
+	}
+	defer stream.Close()
+	setStreamDeadline(ctx, stream)
+	rw := newCodec(stream)
+
+	reply := HolePunch{}
+	start := time.Now()
+	if err := exchange(ctx, id.Pretty(), rw, HolePunch{Addrs: punchAddrs()}, &reply); err != nil {
+		return err
+	}
+	rtt := time.Since(start)
+	addrs := parsePunchAddrs(reply.Addrs)
+	if len(addrs) == 0 {
+		return ErrorNoDirectAddr
+	}
+	if err := rw.Write(HolePunch{Sync: true}); err != nil {
+		return streamError(ctx, id.Pretty(), err)
+	}
+
+	// The sync reaches the recipient half a round trip later, its NAT is open once its SYN is sent
+	time.Sleep(rtt / 2 + punchTimeout)
+	return dialDirect(ctx, id, addrs)
+}
+
+// Open the NAT for the initiator of the hole punching, the initiator dials once the sync is received
+func holePunchProtocol(s network.Stream) {
+	log.Debug("Peer holePunchProtocol")
+	log.Debugf("remote are: %s\n", s.Conn().RemotePeer())
+	defer s.Close()
+	rw := newCodec(s)
+	request := HolePunch{}
+	if err := rw.Read(&request); err != nil {
+		log.Error(err)
+		return
+	}
+	if err := rw.Write(HolePunch{Addrs: punchAddrs()}); err != nil {
+		log.Error(err)
+		return
+	}
+	sync := HolePunch{}
+	if err := rw.Read(&sync); err != nil || !sync.Sync {
+		log.Debugf("Hole punching with %s canceled: %v", s.Conn().RemotePeer().Pretty(), err)
+		return
+	}
+	punch(parsePunchAddrs(request.Addrs))
+}
+
+// Addresses of the node reachable without the relay, the addresses observed by the peers included
+func punchAddrs() []string {
+	var addrs []string
+	for _, addr := range node.Addrs() {
+		if _, err := addr.ValueForProtocol(ma.P_CIRCUIT); err == nil {
+			continue
+		}
+		addrs = append(addrs, addr.String())
+	}
+	return addrs
+}
+
+// TCP addresses sent by the peer, the other addresses cannot be punched
+func parsePunchAddrs(addrs []string) []ma.Multiaddr {
+	var parsed []ma.Multiaddr
+	for _, addr := range addrs {
+		maddr, err := ma.NewMultiaddr(addr)
+		if err != nil {
+			continue
+		}
+		if _, err := maddr.ValueForProtocol(ma.P_TCP); err != nil {
+			continue
+		}
+		if _, err := maddr.ValueForProtocol(ma.P_CIRCUIT); err == nil {
+			continue
+		}
+		parsed = append(parsed, maddr)
+	}
+	return parsed
+}
+
+// Send a SYN to every address from the listen port, the NAT then lets in the SYN of the initiator
+// The SYN expire before reaching the initiator, the connections are dropped when the time is over
+func punch(addrs []ma.Multiaddr) {
+	if !reuseport.Available() {
+		log.Debug("Hole punching not possible, the listen port cannot be reused")
+		return
+	}
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		dialNetwork, raddr, err := manet.DialArgs(addr)
+		if err != nil {
+			continue
+		}
+		laddr := punchLocalAddr(dialNetwork)
+		if laddr == nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d := net.Dialer{LocalAddr: laddr, Timeout: punchTimeout, Control: punchControl}
+			if c, err := d.Dial(dialNetwork, raddr); err == nil {
+				// Reachable without the NAT, the initiator dials it anyway
+				_ = c.Close()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Listen address of the node for the network given, the SYN must be sent from this port
+func punchLocalAddr(network string) *net.TCPAddr {
+	for _, addr := range node.Network().ListenAddresses() {
+		listenNetwork, listenAddr, err := manet.DialArgs(addr)
+		if err != nil || listenNetwork != network {
+			continue
+		}
+		tcpAddr, err := net.ResolveTCPAddr(network, listenAddr)
+		if err != nil {
+			continue
+		}
+		if network == "tcp6" {
+			tcpAddr.IP = net.IPv6unspecified
+		} else {
+			tcpAddr.IP = net.IPv4zero
+		}
+		return tcpAddr
+	}
+	return nil
+}
+
+// Share the listen port, lower the TTL of the SYN and drop the connection without TIME_WAIT once closed
+func punchControl(network string, address string, c syscall.RawConn) error {
+	if err := reuseport.Control(network, address, c); err != nil {
+		return err
+	}
+	var err error
+	controlErr := c.Control(func(fd uintptr) {
+		if network == "tcp6" {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, punchTTL)
+		} else {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, punchTTL)
+		}
+		if err == nil {
+			err = syscall.SetsockoptLinger(int(fd), syscall.SOL_SOCKET, syscall.SO_LINGER, &syscall.Linger{Onoff: 1, Linger: 0})
+		}
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return err
+}
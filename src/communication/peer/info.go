@@ -0,0 +1,244 @@
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+//
+// Peer package will manage all the communication with
+// the EXTERNAL Peers (libp2p) to exchange password with other Peer
+// same of different owner
+//
+// Info will focus on Protocol regarding the profile of the owner exchanged between peers
+package peer
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/PeerVault/PeerVault-Service/business/owner"
+	"github.com/PeerVault/PeerVault-Service/communication/event"
+	"github.com/PeerVault/PeerVault-Service/database"
+	"github.com/PeerVault/PeerVault-Service/identity"
+	"github.com/libp2p/go-libp2p-core/network"
+	"go.etcd.io/bbolt"
+	"sync"
+	"time"
+)
+
+const (
+	infoCacheDelay = 24 * time.Hour // Delay before the profile of a peer is requested again
+)
+
+var (
+	refreshing = make(map[string]bool) // Peers whose profile is being fetched in the background
+	refreshingLock sync.Mutex
+)
+
+// PeerInfo is the profile of the owner, signed by its peer
+type PeerInfo struct {
+	PeerId string
+	Nickname string
+	DeviceName string
+	Version string
+	Protocols []string
+	SignedAt string
+	Signature string
+	FetchedAt string `json:",omitempty"` // Only set in the local cache
+}
+
+// Payload of the profile covered by the signature
+func (i PeerInfo) Payload() []byte {
+	i.Signature = ""
+	i.FetchedAt = ""
+	buf, _ := json.Marshal(i)
+	return buf
+}
+
+func (i *PeerInfo) Sign(id identity.PeerIdentity) error {
+	i.PeerId = id.Id
+	signature, err := id.Sign(i.Payload())
+	if err != nil {
+		return err
+	}
+	i.Signature = base64.StdEncoding.EncodeToString(signature)
+	return nil
+}
+
+func (i PeerInfo) Verify() error {
+	signature, err := base64.StdEncoding.DecodeString(i.Signature)
+	if err != nil {
+		return err
+	}
+	valid, err := identity.Verify(i.PeerId, i.Payload(), signature)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return ErrorInfoSignature
+	}
+	return nil
+}
+
+// Profile of the local owner as sent to the other peers
+func LocalInfo() (PeerInfo, error) {
+	o := owner.Owner{}
+	if err := o.FetchOwner(); err != nil {
+		return PeerInfo{}, err
+	}
+	id, err := o.GetIdentity()
+	if err != nil {
+		return PeerInfo{}, err
+	}
+	info := PeerInfo{
+		Nickname: o.Nickname,
+		DeviceName: o.DeviceName,
+		Version: Version,
+		SignedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	for _, h := range streamHandlers() {
+		for _, id := range protocolIds(protocolVersions, h.pid) {
+			info.Protocols = append(info.Protocols, string(id))
+		}
+	}
+	return info, info.Sign(id)
+}
+
+// Profile of a peer, from the cache unless older than infoCacheDelay or refresh is asked
+func FetchPeerInfo(QmPeerId string, refresh bool) (PeerInfo, error) {
+	cached, err := getDbPeerInfo([]byte(QmPeerId))
+	if err == nil && !refresh && !isInfoOutdated(cached) {
+		return cached, nil
+	}
+
+	ctx, cancel := RequestContext()
+	defer cancel()
+	info := PeerInfo{}
+	err = DialRequest(ctx, QmPeerId, PidInfo, struct{}{}, &info)
+	if err == ErrorNoReply {
+		err = ErrorInfoNotFound
+	}
+	if err != nil {
+		// The cached profile is better than nothing when the peer is unreachable
+		if cached.PeerId != "" {
+			return cached, nil
+		}
+		return PeerInfo{}, err
+	}
+	if info.PeerId != QmPeerId {
+		return PeerInfo{}, ErrorInfoSignature
+	}
+	if err := info.Verify(); err != nil {
+		return PeerInfo{}, err
+	}
+	info.FetchedAt = time.Now().UTC().Format(time.RFC3339)
+	return info, putDbPeerInfo(info)
+}
+
+// Profile data attached to the events regarding a remote peer, taken from the cache so the event is not delayed
+// A profile missing or older than infoCacheDelay is fetched in the background then notified with peer.info.updated
+func peerInfoEventData(QmPeerId string, data map[string]string) map[string]string {
+	info, err := getDbPeerInfo([]byte(QmPeerId))
+	if err != nil || isInfoOutdated(info) {
+		background(func() {
+			refreshPeerInfo(QmPeerId)
+		})
+	}
+	data["Nickname"] = info.Nickname
+	data["DeviceName"] = info.DeviceName
+	data["Version"] = info.Version
+	return data
+}
+
+func isInfoOutdated(info PeerInfo) bool {
+	fetchedAt, err := time.Parse(time.RFC3339, info.FetchedAt)
+	return err != nil || time.Now().UTC().After(fetchedAt.Add(infoCacheDelay))
+}
+
+// Fetch the profile of a peer and notify the client, a single fetch run at a time for each peer
+func refreshPeerInfo(QmPeerId string) {
+	refreshingLock.Lock()
+	if refreshing[QmPeerId] {
+		refreshingLock.Unlock()
+		return
+	}
+	refreshing[QmPeerId] = true
+	refreshingLock.Unlock()
+	defer func() {
+		refreshingLock.Lock()
+		delete(refreshing, QmPeerId)
+		refreshingLock.Unlock()
+	}()
+
+	info, err := FetchPeerInfo(QmPeerId, true)
+	if err != nil {
+		log.Errorf("Profile of %s not available: %s", QmPeerId, err)
+		return
+	}
+	_ = event.Write(event.Message{
+		Type: "peer.info.updated",
+		Data: map[string]string {
+			"PeerId": info.PeerId,
+			"Nickname": info.Nickname,
+			"DeviceName": info.DeviceName,
+			"Version": info.Version,
+		},
+	})
+}
+
+// Reply with the signed profile of the owner
+func infoProtocol(s network.Stream) {
+	log.Debug("Peer infoProtocol")
+	log.Debugf("remote are: %s\n", s.Conn().RemotePeer())
+	defer s.Close()
+	rw := newCodec(s)
+	request := struct{}{}
+	if err := rw.Read(&request); err != nil {
+		log.Error(err)
+		return
+	}
+	info, err := LocalInfo()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if err := rw.Write(info); err != nil {
+		log.Error(err)
+	}
+}
+
+func getDbPeerInfo(QmPeerId []byte) (PeerInfo, error) {
+	info := &PeerInfo{}
+	db, err := database.GetConnection()
+	if err != nil {
+		return *info, err
+	}
+
+	err = db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("peerinfo"))
+		if b == nil {
+			return ErrorInfoNotFound
+		}
+		buf := b.Get(QmPeerId)
+		if buf == nil {
+			return ErrorInfoNotFound
+		}
+		return json.Unmarshal(buf, info)
+	})
+	return *info, err
+}
+
+func putDbPeerInfo(info PeerInfo) error {
+	db, err := database.GetConnection()
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(&info)
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("peerinfo"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(info.PeerId), buf)
+	})
+}
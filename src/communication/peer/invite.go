@@ -0,0 +1,324 @@
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+//
+// Peer package will manage all the communication with
+// the EXTERNAL Peers (libp2p) to exchange password with other Peer
+// same of different owner
+//
+// Invite will focus on Protocol regarding share invites redeemed by a peer not known yet
+package peer
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/PeerVault/PeerVault-Service/communication/event"
+	"github.com/PeerVault/PeerVault-Service/database"
+	"github.com/libp2p/go-libp2p-core/network"
+	"go.etcd.io/bbolt"
+	"strings"
+	"time"
+)
+
+// Invite is kept by the sender until a peer redeem it, the pending share is then bound to this peer
+type Invite struct {
+	Uuid string // Uuid of the pending share
+	Token string
+	Expiration string
+	Receiver string // QmPeerId of the peer who redeemed the invite
+}
+
+// InviteCode is given out of band to the receiver, encoded as a single string usable as QR code
+type InviteCode struct {
+	PeerId string
+	Relay string
+	Uuid string
+	Token string
+}
+
+type InviteRedeem struct {
+	Uuid string
+	Token string
+	Receiver string
+}
+
+type InviteReply struct {
+	Uuid string
+	Sender string
+	Accepted bool
+}
+
+// Create a one time invite for a pending share and return the code to give to the receiver
+func CreateInvite(uuid string, expiration string) (Invite, string, error) {
+	id, err := getPeerIdentity()
+	if err != nil {
+		return Invite{}, "", err
+	}
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return Invite{}, "", err
+	}
+	invite := Invite{
+		Uuid: uuid,
+		Token: base64.RawURLEncoding.EncodeToString(token),
+		Expiration: expiration,
+	}
+	if err := putDbInvite(invite); err != nil {
+		return Invite{}, "", err
+	}
+	code, _ := json.Marshal(InviteCode{
+		PeerId: id.Id,
+		Relay: activeRelay(),
+		Uuid: invite.Uuid,
+		Token: invite.Token,
+	})
+	return invite, base64.RawURLEncoding.EncodeToString(code), nil
+}
+
+func DecodeInviteCode(code string) (InviteCode, error) {
+	inviteCode := InviteCode{}
+	buf, err := base64.RawURLEncoding.DecodeString(strings.TrimSpace(code))
+	if err != nil {
+		return inviteCode, ErrorInviteCode
+	}
+	if err := json.Unmarshal(buf, &inviteCode); err != nil || inviteCode.PeerId == "" || inviteCode.Token == "" {
+		return inviteCode, ErrorInviteCode
+	}
+	return inviteCode, nil
+}
+
+// Redeem an invite received out of band, the sender identity is proven by the libp2p handshake
+// The share request of the sender follows as for any share
+func RedeemInvite(inviteCode InviteCode) (InviteReply, error) {
+	reply := InviteReply{}
+	id, err := getPeerIdentity()
+	if err != nil {
+		return reply, err
+	}
+	ctx, cancel := RequestContext()
+	defer cancel()
+	var stream network.Stream
+	if inviteCode.Relay != "" {
+		stream, err = openStreamVia(ctx, inviteCode.Relay, inviteCode.PeerId, PidInviteRedeem)
+	} else {
+		stream, err = openStream(ctx, inviteCode.PeerId, PidInviteRedeem)
+	}
+	if err != nil {
+		return reply, err
+	}
+	defer stream.Close()
+	redeem := InviteRedeem{
+		Uuid: inviteCode.Uuid,
+		Token: inviteCode.Token,
+		Receiver: id.Id,
+	}
+	setStreamDeadline(ctx, stream)
+	err = exchange(ctx, inviteCode.PeerId, newCodec(stream), redeem, &reply)
+	if err == ErrorNoReply {
+		return reply, ErrorInviteRefused
+	}
+	if err != nil {
+		return reply, err
+	}
+	if !reply.Accepted || reply.Sender != inviteCode.PeerId {
+		return reply, ErrorInviteRefused
+	}
+	_ = event.Write(event.Message{
+		Type: "secret.invite.redeemed",
+		Data: map[string]string {
+			"Sender": reply.Sender,
+			"Uuid": reply.Uuid,
+		},
+	})
+	return reply, nil
+}
+
+// Receive the redeem of one of our invites, the pending share is bound to the remote peer
+func inviteRedeemProtocol(s network.Stream) {
+	log.Debug("Peer inviteRedeemProtocol")
+	log.Debugf("remote are: %s\n", s.Conn().RemotePeer())
+	defer s.Close()
+	rw := newCodec(s)
+	redeem := &InviteRedeem{}
+	err := rw.Read(redeem)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	receiver := s.Conn().RemotePeer().Pretty()
+	if redeem.Receiver != receiver {
+		log.Error("Invite redeem corrupted, receiver and remote peer are different")
+		return
+	}
+	share, err := redeemInvite(*redeem)
+	reply := InviteReply{Uuid: redeem.Uuid, Sender: node.ID().Pretty(), Accepted: err == nil}
+	if err != nil {
+		log.Errorf("Invite %s refused for %s: %s", redeem.Uuid, receiver, err)
+	}
+	if err := rw.Write(reply); err != nil {
+		log.Error(err)
+		return
+	}
+	if !reply.Accepted {
+		return
+	}
+
+	_ = event.Write(event.Message{
+		Type: "secret.invite.accepted",
+		Data: map[string]string {
+			"Receiver": receiver,
+			"Uuid": share.Uuid,
+			"SecretPath": strings.Join(share.keyPaths(), ","),
+		},
+	})
+	go func() {
+		_ = RequestShare(share)
+	}()
+}
+
+// Consume the invite and bind its share to the receiver
+// Checked and marked redeemed in the same transaction, so two concurrent redeems cannot both succeed
+func redeemInvite(redeem InviteRedeem) (Share, error) {
+	share := Share{}
+	db, err := database.GetConnection()
+	if err != nil {
+		return share, err
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		inviteBucket := tx.Bucket([]byte("invite"))
+		if inviteBucket == nil {
+			return ErrorInviteNotFound
+		}
+		buf := inviteBucket.Get([]byte(redeem.Uuid))
+		if buf == nil {
+			return ErrorInviteNotFound
+		}
+		invite := Invite{}
+		if err := json.Unmarshal(buf, &invite); err != nil {
+			return err
+		}
+		if invite.Receiver != "" || subtle.ConstantTimeCompare([]byte(invite.Token), []byte(redeem.Token)) != 1 {
+			return ErrorInviteRefused
+		}
+		expiration, err := time.Parse(time.RFC3339, invite.Expiration)
+		if err != nil || time.Now().UTC().After(expiration) {
+			return ErrorInviteRefused
+		}
+
+		shareBucket := tx.Bucket([]byte("share"))
+		if shareBucket == nil {
+			return ErrorShareNotFound
+		}
+		buf = shareBucket.Get([]byte(invite.Uuid))
+		if buf == nil {
+			return ErrorShareNotFound
+		}
+		if err := json.Unmarshal(buf, &share); err != nil {
+			return err
+		}
+		if share.Receiver != "" {
+			return ErrorInviteRefused
+		}
+
+		invite.Receiver = redeem.Receiver
+		buf, err = json.Marshal(&invite)
+		if err != nil {
+			return err
+		}
+		if err := inviteBucket.Put([]byte(invite.Uuid), buf); err != nil {
+			return err
+		}
+		share.Receiver = redeem.Receiver
+		buf, err = json.Marshal(&share)
+		if err != nil {
+			return err
+		}
+		return shareBucket.Put([]byte(share.Uuid), buf)
+	})
+	return share, err
+}
+
+// List the invites created, redeemed or not
+func FetchInvites() ([]Invite, error) {
+	db, err := database.GetConnection()
+	if err != nil {
+		return nil, err
+	}
+	var invites []Invite
+
+	err = db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("invite"))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var invite Invite
+			if err := json.Unmarshal(v, &invite); err != nil {
+				return err
+			}
+			invite.Token = ""
+			invites = append(invites, invite)
+			return nil
+		})
+	})
+	return invites, err
+}
+
+func DeleteInvite(uuid string) error {
+	db, err := database.GetConnection()
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("invite"))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(uuid))
+	})
+}
+
+func getDbInvite(uuid []byte) (Invite, error) {
+	invite := &Invite{}
+	db, err := database.GetConnection()
+	if err != nil {
+		return *invite, err
+	}
+
+	err = db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("invite"))
+		if b == nil {
+			return ErrorInviteNotFound
+		}
+		buf := b.Get(uuid)
+		if buf == nil {
+			return ErrorInviteNotFound
+		}
+		return json.Unmarshal(buf, invite)
+	})
+	return *invite, err
+}
+
+func putDbInvite(invite Invite) error {
+	db, err := database.GetConnection()
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(&invite)
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("invite"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(invite.Uuid), buf)
+	})
+}
@@ -0,0 +1,63 @@
+package peer
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestRedeemInviteOnce(t *testing.T) {
+	instances := newInstances(t, "alice")
+	defer closeInstances(instances)
+	sender := instances[0]
+
+	sender.run(func() {
+		expiration := time.Now().UTC().Add(time.Hour).Format(time.RFC3339)
+		share := Share{Uuid: uuid.New().String(), Sender: sender.QmPeerId, KeyPath: "staging.*", Expiration: expiration}
+		if err := putDbShare(share); err != nil {
+			t.Fatal(err)
+		}
+		invite, _, err := CreateInvite(share.Uuid, expiration)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Several receivers redeem the same invite at once, only one of them get the share
+		receivers := []string{"QmReceiverA", "QmReceiverB", "QmReceiverC", "QmReceiverD"}
+		var wg sync.WaitGroup
+		var lock sync.Mutex
+		redeemed := 0
+		for _, receiver := range receivers {
+			wg.Add(1)
+			go func(receiver string) {
+				defer wg.Done()
+				_, err := redeemInvite(InviteRedeem{Uuid: invite.Uuid, Token: invite.Token, Receiver: receiver})
+				if err == nil {
+					lock.Lock()
+					redeemed++
+					lock.Unlock()
+				} else if err != ErrorInviteRefused {
+					t.Error(err)
+				}
+			}(receiver)
+		}
+		wg.Wait()
+		if redeemed != 1 {
+			t.Errorf("Invite must be redeemed once, current: %d", redeemed)
+		}
+
+		kept, err := getDbInvite([]byte(invite.Uuid))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bound, err := getDbShareRequest([]byte(share.Uuid))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kept.Receiver == "" || bound.Receiver != kept.Receiver {
+			t.Errorf("Share must be bound to the receiver of the invite, current: %s %s", bound.Receiver, kept.Receiver)
+		}
+	})
+}
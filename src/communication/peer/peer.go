@@ -8,35 +8,79 @@
 package peer
 
 import (
-	"bufio"
 	"context"
-	"fmt"
+	"io"
+	"github.com/PeerVault/PeerVault-Service/crypto"
 	"github.com/PeerVault/PeerVault-Service/identity"
 	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/protocol"
 	"github.com/op/go-logging"
 
 	"github.com/PeerVault/PeerVault-Service/business/owner"
+	"github.com/PeerVault/PeerVault-Service/business/secret"
 	"github.com/libp2p/go-libp2p"
+	autonat "github.com/libp2p/go-libp2p-autonat"
 	circuit "github.com/libp2p/go-libp2p-circuit"
 	"github.com/libp2p/go-libp2p-core/peer"
 	ma "github.com/multiformats/go-multiaddr"
+	msmux "github.com/multiformats/go-multistream"
+	"time"
 )
 
 const (
 	PidShareRequest protocol.ID = "/secret/share/request"
 	PidShareResponse protocol.ID = "/secret/share/response"
 	PidShareSecret protocol.ID = "/secret/share"
+	PidShareUpdate protocol.ID = "/secret/share/update"
+	PidShareUnsubscribe protocol.ID = "/secret/share/unsubscribe"
+	PidTeamMembership protocol.ID = "/team/membership"
+	PidTeamSecret protocol.ID = "/team/secret"
+	PidTeamLeave protocol.ID = "/team/leave"
+	PidAccessRequest protocol.ID = "/secret/access/request"
+	PidAccessResponse protocol.ID = "/secret/access/response"
+	PidApprovalRequest protocol.ID = "/secret/approval/request"
+	PidApproval protocol.ID = "/secret/approval"
+	PidInviteRedeem protocol.ID = "/secret/invite/redeem"
+	PidVerify protocol.ID = "/contact/verify"
+	PidVerifyConfirm protocol.ID = "/contact/verify/confirm"
+	PidInfo protocol.ID = "/peervault/info"
+	PidDeviceLink protocol.ID = "/device/link"
+	PidDeviceList protocol.ID = "/device/list"
+	PidVaultSync protocol.ID = "/vault/sync"
+	PidVaultChange protocol.ID = "/vault/change"
+	PidBackupChunk protocol.ID = "/backup/chunk"
+	PidBackupRestore protocol.ID = "/backup/restore"
+	PidHolePunch protocol.ID = "/peervault/holepunch"
+
+	DialTimeout = 30 * time.Second // Time given to reach a recipient and exchange with it
+	RequestTimeout = 8 * time.Second // Time given to a dial awaited by the client, below the timeout of the control server
 )
 
 var (
+	Version = "0.1.0" // Service version, may be overridden with -ldflags "-X ...peer.Version="
 	log = logging.MustGetLogger("peerVaultLogger")
-	relayHost string
+	listenAddrs []string
+	natPortMap bool
+	swarmKeyPath string
 	node host.Host
+	natService autonat.AutoNAT
+	background = func(task func()) { go task() } // Run a task without delaying the caller, its result is notified by an event
 )
 
-func SetRelayHost(relay string) {
-	relayHost = relay
+// Swarm key of the private network, without key the node join the public network
+func SetSwarmKey(path string) {
+	swarmKeyPath = path
+}
+
+// Addresses listened for direct connections, without address the node is only reachable through the relay
+func SetListenAddrs(addrs []string) {
+	listenAddrs = addrs
+}
+
+// Open the listened ports on the router with UPnP or NAT-PMP, so other peers can dial directly
+func EnableNatPortMap() {
+	natPortMap = true
 }
 
 func Listen() {
@@ -60,31 +104,67 @@ func Listen() {
 		log.Fatal(err)
 	}
 
-	// Zero out the listen addresses for the host, so it can only communicate via p2p-circuit
-	node, err = libp2p.New(
-		ctx,
+	options := []libp2p.Option{
 		libp2p.Identity(pvt),
-		libp2p.ListenAddrs(),
 		libp2p.EnableRelay(circuit.OptDiscovery),
-	)
+	}
+	if swarmKeyPath != "" {
+		protector, err := crypto.NewSwarmProtector(swarmKeyPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		options = append(options, libp2p.PrivateNetwork(protector))
+	}
+	if len(listenAddrs) == 0 {
+		// Zero out the listen addresses for the host, so it can only communicate via p2p-circuit
+		options = append(options, libp2p.ListenAddrs())
+	} else {
+		options = append(options, libp2p.ListenAddrStrings(listenAddrs...))
+		if natPortMap {
+			options = append(options, libp2p.NATPortMap())
+		}
+	}
+	// The listener handing the direct connections over to the swarm is never announced
+	options = append(options, libp2p.AddrsFactory(publicAddrs))
+	node, err = libp2p.New(ctx, options...)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err := startHandoff(node); err != nil {
+		log.Error(err)
+	}
 
-	// Creates relay peer.AddrInfo
-	relayAddrInfo, err := p2pAddrInfo(relayHost)
-	if err != nil {
-		log.Fatal(err)
+	// Keep a connection with the relays, reconnected when they drop
+	go watchRelays(ctx)
+
+	// Detect if the listen addresses are reachable from the other peers
+	if len(listenAddrs) > 0 {
+		natService = autonat.NewAutoNAT(ctx, node, nil)
 	}
 
-	if err := node.Connect(context.Background(), *relayAddrInfo); err != nil {
-		log.Fatal(err)
+	// Find the other nodes on the local network
+	if mdnsEnabled {
+		startMdns(ctx)
+	}
+
+	// Define handle for every protocols and their versions, the streams of the peers blocked or not allowed are refused
+	for _, h := range streamHandlers() {
+		setStreamHandler(node, protocolVersions, h.pid, gateHandler(h.pid, h.handler))
 	}
+	watchGate()
 
-	// Define handle for sharing request protocol
-	node.SetStreamHandler(PidShareRequest, secretShareRequestProtocol)
-	node.SetStreamHandler(PidShareResponse, secretShareResponseProtocol)
-	node.SetStreamHandler(PidShareSecret, secretProtocol)
+	// Push new versions of secrets to subscribed receivers and team members
+	secret.OnSecretUpdate(pushSecretUpdate)
+	secret.OnSecretUpdate(pushTeamSecret)
+
+	// Replicate the vault with the other devices of the owner
+	secret.OnSecretChange(recordVaultChange)
+	go func() {
+		bootstrapVault()
+		if _, err := SyncVault(); err != nil {
+			log.Error(err)
+		}
+	}()
 
 	log.Info("listen from peer")
 	log.Info(node.ID().Pretty())
@@ -93,16 +173,159 @@ func Listen() {
 	select {}
 }
 
-func Dial(recipient string, pid protocol.ID, data []byte) error {
-	recipientPeerId, err := peer.IDB58Decode(recipient)
+type streamHandler struct {
+	pid protocol.ID
+	handler network.StreamHandler
+}
+
+// Protocols supported by the peer and their handler
+func streamHandlers() []streamHandler {
+	return []streamHandler{
+		{PidShareRequest, secretShareRequestProtocol},
+		{PidShareResponse, secretShareResponseProtocol},
+		{PidShareSecret, secretProtocol},
+		{PidShareUpdate, secretUpdateProtocol},
+		{PidShareUnsubscribe, shareUnsubscribeProtocol},
+		{PidTeamMembership, teamMembershipProtocol},
+		{PidTeamSecret, teamSecretProtocol},
+		{PidTeamLeave, teamLeaveProtocol},
+		{PidAccessRequest, accessRequestProtocol},
+		{PidAccessResponse, accessResponseProtocol},
+		{PidApprovalRequest, approvalRequestProtocol},
+		{PidApproval, approvalProtocol},
+		{PidInviteRedeem, inviteRedeemProtocol},
+		{PidVerify, verifyProtocol},
+		{PidVerifyConfirm, verifyConfirmProtocol},
+		{PidInfo, infoProtocol},
+		{PidDeviceLink, deviceLinkProtocol},
+		{PidDeviceList, deviceListProtocol},
+		{PidVaultSync, vaultSyncProtocol},
+		{PidVaultChange, vaultChangeProtocol},
+		{PidBackupChunk, backupChunkProtocol},
+		{PidBackupRestore, backupRestoreProtocol},
+		{PidHolePunch, holePunchProtocol},
+	}
+}
+
+// Dial the recipient and write the message, the context bound the time to reach the recipient
+// The errors are typed, ErrorPeerUnreachable | ErrorProtocolNotSupported | ErrorRelayDown | ErrorInvalidPeerId
+// The peers of the version 2 acknowledge the message, a message not accepted return ErrorMessageRefused
+func Dial(ctx context.Context, recipient string, pid protocol.ID, message interface{}) error {
+	stream, err := openStream(ctx, recipient, pid)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	setStreamDeadline(ctx, stream)
+	if err := newCodec(stream).Write(message); err != nil {
+		return streamError(ctx, recipient, err)
+	}
+	return nil
+}
+
+// Dial the recipient and wait for its reply on the same stream
+// A recipient closing the stream without reply return ErrorNoReply
+func DialRequest(ctx context.Context, recipient string, pid protocol.ID, request interface{}, reply interface{}) error {
+	stream, err := openStream(ctx, recipient, pid)
 	if err != nil {
 		return err
 	}
-	log.Debugf("recipientPeerId %s", relayHost + "/p2p-circuit/p2p/" + recipientPeerId.Pretty())
+	defer stream.Close()
+	setStreamDeadline(ctx, stream)
+	return exchange(ctx, recipient, newCodec(stream), request, reply)
+}
+
+// Context of a dial initiated by the service, canceled after DialTimeout
+func DialContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), DialTimeout)
+}
+
+// Context of a dial awaited by the client, canceled after RequestTimeout so its error can still be replied
+// A call dialing several peers must run in the background and report through events instead
+func RequestContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), RequestTimeout)
+}
+
+// The reads and writes on the stream must not outlive the context of the dial
+func setStreamDeadline(ctx context.Context, stream network.Stream) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+}
+
+// Write the request on the stream then read the reply
+func exchange(ctx context.Context, recipient string, c codec, request interface{}, reply interface{}) error {
+	if err := c.Write(request); err != nil {
+		return streamError(ctx, recipient, err)
+	}
+	err := c.Read(reply)
+	if err == io.EOF {
+		return ErrorNoReply
+	}
+	if err != nil {
+		return streamError(ctx, recipient, err)
+	}
+	return nil
+}
+
+// Open a stream with the recipient, directly when possible otherwise through the relay
+func openStream(ctx context.Context, recipient string, pid protocol.ID) (network.Stream, error) {
+	if node == nil {
+		return nil, ErrorNodeNotStarted
+	}
+	recipientPeerId, err := peer.IDB58Decode(recipient)
+	if err != nil {
+		log.Debugf("Recipient %s is not a peer id: %s", recipient, err)
+		return nil, ErrorInvalidPeerId
+	}
+	err = connectDirect(ctx, recipientPeerId)
+	if err == nil {
+		stream, err := node.NewStream(ctx, recipientPeerId, protocolIds(protocolVersions, pid)...)
+		if err != nil {
+			return nil, streamError(ctx, recipient, err)
+		}
+		return stream, nil
+	}
+	log.Debugf("No direct connection with %s, fallback on relay: %s", recipient, err)
+
+	// The connected relays are tried first
+	hosts := relayHosts()
+	if len(hosts) == 0 {
+		return nil, ErrorNoRelay
+	}
+	err = ErrorRelayDown
+	for _, relay := range hosts {
+		var stream network.Stream
+		stream, err = openStreamVia(ctx, relay, recipient, pid)
+		if err == nil {
+			return stream, nil
+		}
+		log.Debugf("Recipient %s unreachable through relay %s: %s", recipient, relay, err)
+		if err == ErrorProtocolNotSupported || ctx.Err() != nil {
+			break
+		}
+	}
+	if err != ErrorProtocolNotSupported && !isRelayConnected() {
+		return nil, ErrorRelayDown
+	}
+	return nil, err
+}
+
+// Open a stream with the recipient through the relay given
+func openStreamVia(ctx context.Context, relay string, recipient string, pid protocol.ID) (network.Stream, error) {
+	if node == nil {
+		return nil, ErrorNodeNotStarted
+	}
+	recipientPeerId, err := peer.IDB58Decode(recipient)
+	if err != nil {
+		log.Debugf("Recipient %s is not a peer id: %s", recipient, err)
+		return nil, ErrorInvalidPeerId
+	}
 	ma.SwapToP2pMultiaddrs()
-	relayAddr, err := ma.NewMultiaddr(relayHost + "/p2p-circuit/p2p/" + recipientPeerId.Pretty())
+	relayAddr, err := ma.NewMultiaddr(relay + "/p2p-circuit/p2p/" + recipientPeerId.Pretty())
 	if err != nil {
-		log.Fatal(err)
+		log.Errorf("Invalid relay address %s: %s", relay, err)
+		return nil, ErrorRelayDown
 	}
 
 	recipientRelayInfo := peer.AddrInfo{
@@ -111,25 +334,36 @@ func Dial(recipient string, pid protocol.ID, data []byte) error {
 	}
 
 	// Connect node to recipient
-	if err := node.Connect(context.Background(), recipientRelayInfo); err != nil {
-		log.Error("fail connect to recipient using relay")
-		return err
+	if err := node.Connect(ctx, recipientRelayInfo); err != nil {
+		log.Debugf("Fail connect to %s using relay %s: %s", recipient, relay, err)
+		return nil, ErrorPeerUnreachable
+	}
+	if !hasDirectConn(recipientPeerId) {
+		go upgradeConnection(recipientPeerId)
 	}
 
 	// we're connected!
-	stream, err := node.NewStream(context.Background(), recipientPeerId, pid)
-	if err != nil {
-		log.Fatal("Fail opening protocol with other peer", err)
-		return err
-	}
-	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
-	_, err = rw.WriteString(fmt.Sprintf("%s\n", data))
+	stream, err := node.NewStream(ctx, recipientPeerId, protocolIds(protocolVersions, pid)...)
 	if err != nil {
-		return err
+		return nil, streamError(ctx, recipient, err)
 	}
-	err = rw.Flush()
+	return stream, nil
+}
 
-	return err
+// Typed error of a stream failing to open or to exchange, the cause is only logged
+func streamError(ctx context.Context, recipient string, err error) error {
+	if err == msmux.ErrNotSupported {
+		return ErrorProtocolNotSupported
+	}
+	if e, ok := err.(Error); ok {
+		return e
+	}
+	if ctx.Err() != nil {
+		log.Debugf("Dial of %s canceled: %s", recipient, ctx.Err())
+	} else {
+		log.Debugf("Stream with %s failed: %s", recipient, err)
+	}
+	return ErrorPeerUnreachable
 }
 
 func getPeerIdentity() (identity.PeerIdentity, error) {
@@ -151,12 +385,3 @@ func getPeerIdentity() (identity.PeerIdentity, error) {
 	}
 	return o.GetIdentity()
 }
-
-// create peer addr info
-func p2pAddrInfo(addrStr string) (*peer.AddrInfo, error) {
-	addr, err := ma.NewMultiaddr(addrStr)
-	if err != nil {
-		panic(err)
-	}
-	return peer.AddrInfoFromP2pAddr(addr)
-}
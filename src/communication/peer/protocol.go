@@ -0,0 +1,71 @@
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+//
+// Peer package will manage all the communication with
+// the EXTERNAL Peers (libp2p) to exchange password with other Peer
+// same of different owner
+//
+// Protocol will focus on the versions of the protocols and their negotiation between peers
+package peer
+
+import (
+	"github.com/libp2p/go-libp2p-core/helpers"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"strings"
+)
+
+const (
+	LegacyVersion = "0.0.0" // Version of the protocol ids without version, used by the peers before the versioning
+)
+
+var (
+	// Versions of the protocols supported, the highest first
+	// A peer offer every version on dial and the highest version supported by both peers is selected
+	// A change breaking the messages of a protocol require a new major version, the previous one is kept side by side
+	// The version 2 exchange framed CBOR messages, the version 1 and the legacy ids newline-delimited JSON
+	protocolVersions = []string{"2.0.0", "1.0.0"}
+)
+
+// Semver protocol id, such as /secret/share/request/1.0.0
+func versionedId(pid protocol.ID, version string) protocol.ID {
+	if version == LegacyVersion {
+		return pid
+	}
+	return protocol.ID(string(pid) + "/" + version)
+}
+
+// Ids of the protocol offered on dial, the highest version first and the legacy id last
+func protocolIds(versions []string, pid protocol.ID) []protocol.ID {
+	var ids []protocol.ID
+	for _, version := range versions {
+		ids = append(ids, versionedId(pid, version))
+	}
+	return append(ids, pid)
+}
+
+// Handle every version of the protocol and its legacy id
+// A version also accept the lower minor versions of the same major version
+func setStreamHandler(h host.Host, versions []string, pid protocol.ID, handler network.StreamHandler) {
+	for _, version := range versions {
+		id := versionedId(pid, version)
+		match, err := helpers.MultistreamSemverMatcher(id)
+		if err != nil {
+			log.Errorf("Protocol %s has an invalid version: %s", id, err)
+			continue
+		}
+		h.SetStreamHandlerMatch(id, match, handler)
+	}
+	h.SetStreamHandler(pid, handler)
+}
+
+// Version of the protocol negotiated on the stream, LegacyVersion for a peer without versioning
+func streamVersion(s network.Stream, pid protocol.ID) string {
+	negotiated := string(s.Protocol())
+	if negotiated == string(pid) || !strings.HasPrefix(negotiated, string(pid) + "/") {
+		return LegacyVersion
+	}
+	return strings.TrimPrefix(negotiated, string(pid) + "/")
+}
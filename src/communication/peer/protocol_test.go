@@ -0,0 +1,94 @@
+package peer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	msmux "github.com/multiformats/go-multistream"
+)
+
+const testPid protocol.ID = "/secret/share/request"
+
+// Two connected hosts, the listener handle the versions given, nil for a peer before the versioning
+func newVersionedHosts(t *testing.T, listenerVersions []string) (host.Host, host.Host, chan string) {
+	mn, err := mocknet.FullMeshConnected(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+	negotiated := make(chan string, 1)
+	handler := func(s network.Stream) {
+		negotiated <- streamVersion(s, testPid)
+	}
+	if listenerVersions == nil {
+		hosts[1].SetStreamHandler(testPid, handler)
+	} else {
+		setStreamHandler(hosts[1], listenerVersions, testPid, handler)
+	}
+	return hosts[0], hosts[1], negotiated
+}
+
+func TestProtocolNegotiation(t *testing.T) {
+	tests := []struct {
+		name string
+		dialer []string
+		listener []string
+		version string
+	}{
+		{"same version", []string{"1.0.0"}, []string{"1.0.0"}, "1.0.0"},
+		{"highest common version", []string{"2.0.0", "1.1.0", "1.0.0"}, []string{"1.1.0", "1.0.0"}, "1.1.0"},
+		{"new dialer to a legacy listener", []string{"1.0.0"}, nil, LegacyVersion},
+		{"legacy dialer to a new listener", []string{}, []string{"1.0.0"}, LegacyVersion},
+		{"lower minor accepted by a higher minor", []string{"1.0.0"}, []string{"1.2.0"}, "1.0.0"},
+		{"major side by side", []string{"1.0.0"}, []string{"2.0.0", "1.0.0"}, "1.0.0"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dialer, listener, negotiated := newVersionedHosts(t, test.listener)
+			s, err := dialer.NewStream(context.Background(), listener.ID(), protocolIds(test.dialer, testPid)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			if version := streamVersion(s, testPid); version != test.version {
+				t.Errorf("Dialer must negotiate version %s, current: %s", test.version, version)
+			}
+			if version := <-negotiated; version != test.version {
+				t.Errorf("Listener must negotiate version %s, current: %s", test.version, version)
+			}
+		})
+	}
+}
+
+func TestProtocolIncompatible(t *testing.T) {
+	dialer, listener, _ := newVersionedHosts(t, []string{"2.0.0"})
+	listener.RemoveStreamHandler(testPid)
+
+	// Neither a common major version nor the legacy id
+	_, err := dialer.NewStream(context.Background(), listener.ID(), versionedId(testPid, "1.0.0"))
+	if err != msmux.ErrNotSupported {
+		t.Errorf("Incompatible versions must not be negotiated, current: %v", err)
+	}
+	// A higher minor version is not understood by a lower minor listener
+	_, err = dialer.NewStream(context.Background(), listener.ID(), versionedId(testPid, "2.1.0"))
+	if err != msmux.ErrNotSupported {
+		t.Errorf("Higher minor version must not be negotiated, current: %v", err)
+	}
+}
+
+func TestProtocolIds(t *testing.T) {
+	ids := protocolIds([]string{"1.1.0", "1.0.0"}, PidShareRequest)
+	expected := []protocol.ID{"/secret/share/request/1.1.0", "/secret/share/request/1.0.0", "/secret/share/request"}
+	if len(ids) != len(expected) {
+		t.Fatalf("Protocol ids must be %v, current: %v", expected, ids)
+	}
+	for i := range expected {
+		if ids[i] != expected[i] {
+			t.Errorf("Protocol ids must be %v, current: %v", expected, ids)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+//
+// Peer package will manage all the communication with
+// the EXTERNAL Peers (libp2p) to exchange password with other Peer
+// same of different owner
+//
+// Relay will focus on the connection with the relays, their health and the failover between them
+package peer
+
+import (
+	"context"
+	"github.com/PeerVault/PeerVault-Service/communication/event"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	relayCheckInterval = 30 * time.Second
+	relayDialTimeout = 10 * time.Second
+	relayBackoffMin = 5 * time.Second
+	relayBackoffMax = 5 * time.Minute
+)
+
+// RelayStatus of a relay configured with --relay
+type RelayStatus struct {
+	Addr string
+	Connected bool
+	Failures int // Consecutive failed connections, reset once connected
+	NextAttempt string `json:",omitempty"`
+	LastError string `json:",omitempty"`
+}
+
+type relayState struct {
+	status RelayStatus
+	info *peer.AddrInfo
+	nextAttempt time.Time
+}
+
+var (
+	relays []*relayState
+	relaysLock sync.Mutex
+)
+
+// Relays used when the recipient cannot be dialed directly, the first relay connected is preferred
+func SetRelayHosts(addrs []string) {
+	relaysLock.Lock()
+	defer relaysLock.Unlock()
+	relays = nil
+	for _, addr := range addrs {
+		r := &relayState{status: RelayStatus{Addr: addr}}
+		info, err := p2pAddrInfo(addr)
+		if err != nil {
+			log.Errorf("Relay %s ignored, invalid multiaddr: %s", addr, err)
+			continue
+		}
+		r.info = info
+		relays = append(relays, r)
+	}
+}
+
+// Address of the relays, the connected ones first
+func relayHosts() []string {
+	relaysLock.Lock()
+	defer relaysLock.Unlock()
+	var connected, others []string
+	for _, r := range relays {
+		if r.status.Connected {
+			connected = append(connected, r.status.Addr)
+		} else {
+			others = append(others, r.status.Addr)
+		}
+	}
+	return append(connected, others...)
+}
+
+// Address of the relay the other peers should use to reach this node
+func activeRelay() string {
+	hosts := relayHosts()
+	if len(hosts) == 0 {
+		return ""
+	}
+	return hosts[0]
+}
+
+func RelayStatuses() []RelayStatus {
+	relaysLock.Lock()
+	defer relaysLock.Unlock()
+	var statuses []RelayStatus
+	for _, r := range relays {
+		statuses = append(statuses, r.status)
+	}
+	return statuses
+}
+
+func isRelay(id peer.ID) bool {
+	relaysLock.Lock()
+	defer relaysLock.Unlock()
+	for _, r := range relays {
+		if r.info.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Connect the relays, then check their connection at every relayCheckInterval
+// A relay disconnected is dialed again with an exponential backoff
+func watchRelays(ctx context.Context) {
+	node.Network().Notify(&network.NotifyBundle{
+		DisconnectedF: func(n network.Network, c network.Conn) {
+			if isRelay(c.RemotePeer()) && n.Connectedness(c.RemotePeer()) != network.Connected {
+				go checkRelays()
+			}
+		},
+	})
+
+	checkRelays()
+	if len(relayHosts()) > 0 && !isRelayConnected() {
+		log.Warning("No relay connected, the peers behind a NAT are unreachable until a relay reconnect")
+	}
+
+	ticker := time.NewTicker(relayCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			checkRelays()
+		}
+	}
+}
+
+func isRelayConnected() bool {
+	relaysLock.Lock()
+	defer relaysLock.Unlock()
+	for _, r := range relays {
+		if r.status.Connected {
+			return true
+		}
+	}
+	return false
+}
+
+func checkRelays() {
+	relaysLock.Lock()
+	current := append([]*relayState{}, relays...)
+	relaysLock.Unlock()
+	for _, r := range current {
+		checkRelay(r)
+	}
+}
+
+func checkRelay(r *relayState) {
+	connected := node.Network().Connectedness(r.info.ID) == network.Connected
+
+	relaysLock.Lock()
+	wasConnected := r.status.Connected
+	r.status.Connected = connected
+	retry := !connected && !time.Now().Before(r.nextAttempt)
+	relaysLock.Unlock()
+
+	if wasConnected && !connected {
+		log.Warningf("Relay %s disconnected", r.status.Addr)
+		writeRelayEvent("peer.relay.disconnected", r)
+	}
+	if !retry {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), relayDialTimeout)
+	defer cancel()
+	err := node.Connect(ctx, *r.info)
+
+	relaysLock.Lock()
+	status := r.status
+	if err != nil {
+		status.Failures++
+		status.LastError = err.Error()
+		r.nextAttempt = time.Now().Add(relayBackoff(status.Failures))
+		status.NextAttempt = r.nextAttempt.UTC().Format(time.RFC3339)
+	} else {
+		status = RelayStatus{Addr: status.Addr, Connected: true}
+		r.nextAttempt = time.Time{}
+	}
+	r.status = status
+	relaysLock.Unlock()
+
+	if err != nil {
+		log.Errorf("Relay %s unreachable, next attempt at %s: %s", status.Addr, status.NextAttempt, err)
+		return
+	}
+	log.Infof("Relay %s connected", status.Addr)
+	writeRelayEvent("peer.relay.connected", r)
+}
+
+// Delay before the next connection to a relay, doubled at every failure
+func relayBackoff(failures int) time.Duration {
+	delay := relayBackoffMin
+	for i := 1; i < failures && delay < relayBackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > relayBackoffMax {
+		delay = relayBackoffMax
+	}
+	return delay
+}
+
+func writeRelayEvent(eventType string, r *relayState) {
+	relaysLock.Lock()
+	data := map[string]string {
+		"Addr": r.status.Addr,
+		"Failures": strconv.Itoa(r.status.Failures),
+	}
+	relaysLock.Unlock()
+	_ = event.Write(event.Message{
+		Type: eventType,
+		Data: data,
+	})
+}
+
+// create peer addr info
+func p2pAddrInfo(addrStr string) (*peer.AddrInfo, error) {
+	addr, err := ma.NewMultiaddr(addrStr)
+	if err != nil {
+		return nil, err
+	}
+	return peer.AddrInfoFromP2pAddr(addr)
+}
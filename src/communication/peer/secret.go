@@ -10,17 +10,24 @@
 package peer
 
 import (
-	"bufio"
 	"encoding/json"
 	"fmt"
+	"github.com/PeerVault/PeerVault-Service/business/approval"
+	"github.com/PeerVault/PeerVault-Service/business/contact"
 	"github.com/PeerVault/PeerVault-Service/business/owner"
 	"github.com/PeerVault/PeerVault-Service/business/secret"
 	"github.com/PeerVault/PeerVault-Service/communication/event"
 	"github.com/PeerVault/PeerVault-Service/crypto"
 	"github.com/PeerVault/PeerVault-Service/database"
+	"github.com/google/uuid"
 	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
 	"go.etcd.io/bbolt"
+	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type ShareRequest struct {
@@ -28,8 +35,12 @@ type ShareRequest struct {
 	Sender string
 	Receiver string
 	Expiration string
-	KeyPath string
+	KeyPath string // Key path or glob of key paths such as staging.*
+	KeyPaths []string `json:",omitempty"` // Several key paths or globs shared together
+	Subscribe bool
+	IncludeFuture bool
 	Approved bool
+	Destination string // Namespace chosen by the receiver on approval
 }
 
 type Share struct {
@@ -38,18 +49,106 @@ type Share struct {
 	Receiver string
 	Expiration string
 	KeyPath string
+	KeyPaths []string `json:",omitempty"`
+	Subscribe bool
+	IncludeFuture bool
+	Approved bool
+	Delivered []string // Key paths already sent to the receiver
+	Results []ShareItemResult // Result reported by the receiver for each secret delivered
+	DeliveryError string `json:",omitempty"` // Error of the last dial to the receiver, empty once it replied
+}
+
+// Subscription kept by the receiver of a share in subscribe mode
+// to accept the later versions pushed by the sender
+type Subscription struct {
+	Uuid string
+	Sender string
+	KeyPath string
+	KeyPaths []string `json:",omitempty"`
+	Destination string // Namespace where the receiver keep the secrets
+	Subscribe bool
+	IncludeFuture bool
+	Paths map[string]string // Key path of the sender to the local key path
 }
 
 type ShareResponse struct {
 	Uuid string
 	Sender string
 	Approved bool
+	KeyPaths []string `json:",omitempty"` // Subset approved by the receiver, every key paths when empty
+}
+
+// ShareUnsubscribe is sent by the receiver to stop the later versions and secrets of a share
+type ShareUnsubscribe struct {
+	Uuid string
 }
 
 type ShareResponseData struct {
 	Uuid string
 	Sender string
-	Secret secret.Secret
+	Secret secret.Secret // Only filled when a single secret is delivered
+	Secrets []secret.Secret
+}
+
+// List every secrets delivered, Secret field is kept for peers sending a single secret
+func (d ShareResponseData) secrets() []secret.Secret {
+	if len(d.Secrets) == 0 && d.Secret.Key != "" {
+		return []secret.Secret{d.Secret}
+	}
+	return d.Secrets
+}
+
+// ShareResult is written back by the receiver on the stream delivering the secrets
+type ShareResult struct {
+	Uuid string
+	Results []ShareItemResult
+}
+
+type ShareItemResult struct {
+	KeyPath string // Key path of the sender
+	Status string // ShareStatusCreated | ShareStatusUpdated | ShareStatusConflict | ShareStatusRefused | ShareStatusOutdated | ShareStatusError
+	SecretPath string `json:",omitempty"` // Key path where the receiver saved the secret
+	Error string `json:",omitempty"`
+}
+
+func (r ShareRequest) keyPaths() []string {
+	return keyPathsOf(r.KeyPath, r.KeyPaths)
+}
+
+func (s Share) keyPaths() []string {
+	return keyPathsOf(s.KeyPath, s.KeyPaths)
+}
+
+func (s Subscription) keyPaths() []string {
+	return keyPathsOf(s.KeyPath, s.KeyPaths)
+}
+
+// KeyPaths list every key paths of the share, KeyPath is kept for peers sharing a single one
+func keyPathsOf(keyPath string, keyPaths []string) []string {
+	if len(keyPaths) > 0 {
+		return keyPaths
+	}
+	if keyPath == "" {
+		return nil
+	}
+	return []string{keyPath}
+}
+
+// Check that every key paths of the subset are part of the key paths
+func isSubset(subset []string, keyPaths []string) bool {
+	for _, s := range subset {
+		found := false
+		for _, keyPath := range keyPaths {
+			if s == keyPath {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
 }
 
 type Error int
@@ -58,39 +157,292 @@ func (k Error) Error() (msg string) {
 	switch k {
 	case ErrorShareNotFound:
 		msg = "The Secret key path, namespace and key name was not found"
+	case ErrorSubscriptionNotFound:
+		msg = "The subscription was not found"
+	case ErrorAccessNotFound:
+		msg = "The access request was not found"
+	case ErrorAccessExpired:
+		msg = "The access request has expired"
+	case ErrorShareKeyPath:
+		msg = "The key paths approved are not part of the share request"
+	case ErrorInviteNotFound:
+		msg = "The invite was not found"
+	case ErrorInviteRefused:
+		msg = "The invite is expired, already redeemed or its token is not valid"
+	case ErrorInviteCode:
+		msg = "The invite code is malformed"
+	case ErrorVerificationNotFound:
+		msg = "The verification was not found or has expired"
+	case ErrorVerificationFailed:
+		msg = "The verification nonce does not match its commitment"
+	case ErrorInfoNotFound:
+		msg = "The profile of the peer was not found"
+	case ErrorInfoSignature:
+		msg = "The profile signature is not valid"
+	case ErrorBackupRefused:
+		msg = "The backup was refused by the holder"
+	case ErrorNoDirectAddr:
+		msg = "The peer has no direct address known"
+	case ErrorRelayInUse:
+		msg = "The relayed connection with the peer is in use"
+	case ErrorNodeNotStarted:
+		msg = "The peer node is not started"
+	case ErrorNoRelay:
+		msg = "No relay is configured"
+	case ErrorPeerBlocked:
+		msg = "The peer is blocked"
+	case ErrorPeerNotAllowed:
+		msg = "The peer is not in the allowlist"
+	case ErrorRateLimited:
+		msg = "The peer opened too many streams"
+	case ErrorPeerUnreachable:
+		msg = "The peer is unreachable"
+	case ErrorProtocolNotSupported:
+		msg = "The peer does not support the protocol"
+	case ErrorRelayDown:
+		msg = "No relay connected to reach the peer"
+	case ErrorInvalidPeerId:
+		msg = "The peer id is invalid"
+	case ErrorMessageTooLarge:
+		msg = "The message is larger than the maximum size"
+	case ErrorMessageRefused:
+		msg = "The message was not accepted by the peer"
+	case ErrorNoReply:
+		msg = "The peer closed the stream without reply"
+	case ErrorTeamInvitationNotFound:
+		msg = "The team invitation was not found"
+	case ErrorTeamNamespaceInUse:
+		msg = "The team namespace is already used by local secrets or another team"
+	case ErrorAccessKeyPath:
+		msg = "The access request must name a single secret, globs are not allowed"
+	case ErrorShareInvalidKeyPath:
+		msg = "The key path is not a valid key path or glob"
+	case ErrorShareNoSecret:
+		msg = "No secret found with the key paths shared"
+	case ErrorShareApproval:
+		msg = "The share is waiting for the approval of the policy"
+	case ErrorUuidInUse:
+		msg = "The uuid is already used by a share or a request of another peer"
 	}
 	return fmt.Sprintf("%s (%d)", msg, k)
 }
 
 const (
 	ErrorShareNotFound = Error(1)
+	ErrorSubscriptionNotFound = Error(2)
+	ErrorAccessNotFound = Error(3)
+	ErrorAccessExpired = Error(4)
+	ErrorShareKeyPath = Error(5)
+	ErrorInviteNotFound = Error(6)
+	ErrorInviteRefused = Error(7)
+	ErrorInviteCode = Error(8)
+	ErrorVerificationNotFound = Error(9)
+	ErrorVerificationFailed = Error(10)
+	ErrorInfoNotFound = Error(11)
+	ErrorInfoSignature = Error(12)
+	ErrorBackupRefused = Error(13)
+	ErrorNoDirectAddr = Error(14)
+	ErrorRelayInUse = Error(15)
+	ErrorNodeNotStarted = Error(16)
+	ErrorNoRelay = Error(17)
+	ErrorPeerBlocked = Error(18)
+	ErrorPeerNotAllowed = Error(19)
+	ErrorRateLimited = Error(20)
+	ErrorPeerUnreachable = Error(21)
+	ErrorProtocolNotSupported = Error(22)
+	ErrorRelayDown = Error(23)
+	ErrorInvalidPeerId = Error(24)
+	ErrorMessageTooLarge = Error(25)
+	ErrorMessageRefused = Error(26)
+	ErrorNoReply = Error(27)
+	ErrorTeamInvitationNotFound = Error(28)
+	ErrorTeamNamespaceInUse = Error(29)
+	ErrorAccessKeyPath = Error(30)
+	ErrorShareInvalidKeyPath = Error(31)
+	ErrorShareNoSecret = Error(32)
+	ErrorShareApproval = Error(33)
+	ErrorUuidInUse = Error(34)
+
+	ShareStatusCreated = "created"
+	ShareStatusUpdated = "updated"
+	ShareStatusConflict = "conflict"
+	ShareStatusRefused = "refused"
+	ShareStatusOutdated = "outdated" // Version older than the one already received, pushed out of order
+	ShareStatusError = "error"
 )
 
 var (
 	requests = make(map[string]ShareRequest)
+	requestsLock sync.Mutex // Requests are changed by the stream handlers and the API
+	updatesLock sync.Mutex // Secrets pushed by the other peers are stored one at a time, the version check and the save must not interleave
 )
 
-func ApproveLocalRequest(uuid string) {
-	if shareRequest, ok := requests[uuid]; ok {
-		shareRequest.Approved = true
-		requests[uuid] = shareRequest
+// Verify the key paths and the approvals then save a share of the local secrets, as on POST /expose/request
+// ErrorShareApproval is returned with the status of the approval when the share must wait for it,
+// the approvers are asked in the background when no request is in progress
+// An invite has no receiver yet, the approval is checked on delivery once the invite is redeemed
+func CreateShare(share Share) (Share, ApprovalStatus, error) {
+	// Receiver may be given by the nickname of a contact
+	share.Receiver = contact.Resolve(share.Receiver)
+
+	// A glob may match nothing yet when future secrets are included
+	keyPaths := share.keyPaths()
+	if len(keyPaths) == 0 {
+		return share, ApprovalStatus{}, ErrorShareInvalidKeyPath
+	}
+	for _, keyPath := range keyPaths {
+		if _, err := path.Match(keyPath, ""); err != nil || keyPath == "" {
+			return share, ApprovalStatus{}, ErrorShareInvalidKeyPath
+		}
+	}
+	secrets, err := secret.FetchSecretsMatching(keyPaths...)
+	if err != nil {
+		return share, ApprovalStatus{}, err
+	}
+	if len(secrets) == 0 && !share.IncludeFuture {
+		return share, ApprovalStatus{}, ErrorShareNoSecret
+	}
+
+	// A single approval covers every key paths of the share
+	if share.Receiver != "" {
+		keyPath := strings.Join(keyPaths, ",")
+		p, r, status, err := FindSecretsApproval(approval.ActionShare, keyPath, share.Receiver, secrets)
+		if err != nil {
+			return share, ApprovalStatus{}, err
+		}
+		if status == approval.StatusExpired {
+			r, err = CreateApprovalRequest(p, approval.ActionShare, keyPath, share.Receiver)
+			if err != nil {
+				return share, ApprovalStatus{}, err
+			}
+			background(func() {
+				RequestApprovals(r, p)
+			})
+			status = approval.StatusPending
+		}
+		if status != approval.StatusGranted {
+			return share, ApprovalStatus{Uuid: r.Uuid, Status: status, Required: p.Required, Approvals: r.Approvals}, ErrorShareApproval
+		}
+	}
+
+	id, err := getPeerIdentity()
+	if err != nil {
+		return share, ApprovalStatus{}, err
+	}
+	share.Uuid = uuid.New().String()
+	share.Sender = id.Id
+	share.Approved = false
+	share.Delivered = nil
+	share.Results = nil
+	share.DeliveryError = ""
+	return share, ApprovalStatus{Status: approval.StatusGranted}, putDbShare(share)
+}
+
+// Ask the receiver to approve the share, the error of the dial is kept on the share
+func RequestShare(share Share) error {
+	ctx, cancel := DialContext()
+	defer cancel()
+	err := Dial(ctx, share.Receiver, PidShareRequest, ShareRequest{
+		Uuid: share.Uuid,
+		Sender: share.Sender,
+		Receiver: share.Receiver,
+		Expiration: share.Expiration,
+		KeyPath: share.KeyPath,
+		KeyPaths: share.KeyPaths,
+		Subscribe: share.Subscribe,
+		IncludeFuture: share.IncludeFuture,
+	})
+	if err != nil {
+		log.Errorf("Share request %s not delivered to %s: %s", share.Uuid, share.Receiver, err)
+		RecordShareError(share.Uuid, err)
+	}
+	return err
+}
+
+// Approve or decline a share request received then answer the sender in the background, as on PUT /expose/request
+// Once approved the secrets are trusted on arrival and saved into the destination namespace
+// An answer not delivered is sent as event secret.share.response.failed
+func RespondShare(response ShareResponse, destination string) error {
+	if response.Approved {
+		if err := ApproveLocalRequest(response.Uuid, destination, response.KeyPaths); err != nil {
+			return err
+		}
+	}
+	background(func() {
+		sendShareResponse(response)
+	})
+	return nil
+}
+
+func sendShareResponse(response ShareResponse) {
+	ctx, cancel := DialContext()
+	defer cancel()
+	if err := Dial(ctx, response.Sender, PidShareResponse, response); err != nil {
+		log.Errorf("Share response %s not delivered to %s: %s", response.Uuid, response.Sender, err)
+		_ = event.Write(event.Message{
+			Type: "secret.share.response.failed",
+			Data: map[string]string {
+				"Sender": response.Sender,
+				"Uuid": response.Uuid,
+				"Approved": strconv.FormatBool(response.Approved),
+				"Error": err.Error(),
+			},
+		})
 	}
 }
 
+// Approve the request locally, secrets will be saved into the destination namespace
+// Only the subset of key paths is accepted when given, otherwise every key paths of the request
+func ApproveLocalRequest(uuid string, destination string, keyPaths []string) error {
+	requestsLock.Lock()
+	defer requestsLock.Unlock()
+	shareRequest, ok := requests[uuid]
+	if !ok {
+		return ErrorShareNotFound
+	}
+	if !isSubset(keyPaths, shareRequest.keyPaths()) {
+		return ErrorShareKeyPath
+	}
+	if len(keyPaths) > 0 {
+		shareRequest.KeyPaths = keyPaths
+	}
+	shareRequest.Approved = true
+	shareRequest.Destination = destination
+	requests[uuid] = shareRequest
+	return nil
+}
+
+// Share request received, or access request sent, waiting for its secrets
+func getRequest(uuid string) (ShareRequest, bool) {
+	requestsLock.Lock()
+	defer requestsLock.Unlock()
+	shareRequest, ok := requests[uuid]
+	return shareRequest, ok
+}
+
+func putRequest(shareRequest ShareRequest) {
+	requestsLock.Lock()
+	defer requestsLock.Unlock()
+	requests[shareRequest.Uuid] = shareRequest
+}
+
+// Remove the request and return it, only one caller get a request removed concurrently
+func takeRequest(uuid string) (ShareRequest, bool) {
+	requestsLock.Lock()
+	defer requestsLock.Unlock()
+	shareRequest, ok := requests[uuid]
+	delete(requests, uuid)
+	return shareRequest, ok
+}
+
 // Receive new request for sharing password
 func secretShareRequestProtocol(s network.Stream) {
 	log.Debug("Peer secretShareRequestProtocol")
 	log.Debugf("remote are: %s\n", s.Conn().RemotePeer())
-	rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
-	buf, err := rw.ReadString('\n')
-	if err != nil {
-		log.Error(err)
-		return
-	}
+	rw := newCodec(s)
 	shareRequest := &ShareRequest{}
 	// Verify and decode share request data
-	decoder := json.NewDecoder(strings.NewReader(buf))
-	err = decoder.Decode(&shareRequest)
+	err := rw.Read(shareRequest)
 	if err != nil {
 		log.Error(err)
 		return
@@ -100,37 +452,34 @@ func secretShareRequestProtocol(s network.Stream) {
 		log.Error("Share request corrupted, sender and remote peer are different")
 		return
 	}
-	requests[shareRequest.Uuid] = *shareRequest
+	putRequest(*shareRequest)
+	err = s.Close()
+	if err != nil {
+		log.Error(err)
+	}
 
+	// Profile of the sender let the receiver know who is asking
 	_ = event.Write(event.Message{
 		Type: "secret.share.request",
-		Data: map[string]string {
-			"Sender": s.Conn().RemotePeer().Pretty(),
+		Data: peerInfoEventData(shareRequest.Sender, map[string]string {
+			"Sender": shareRequest.Sender,
 			"Uuid": shareRequest.Uuid,
-			"SecretPath": shareRequest.KeyPath,
+			"SecretPath": strings.Join(shareRequest.keyPaths(), ","),
 			"Expiration": shareRequest.Expiration,
-		},
+			"Subscribe": strconv.FormatBool(shareRequest.Subscribe),
+			"IncludeFuture": strconv.FormatBool(shareRequest.IncludeFuture),
+		}),
 	})
-	err = s.Close()
-	if err != nil {
-		log.Error(err)
-	}
 }
 
 // Receive response confirmation for password sharing
 func secretShareResponseProtocol(s network.Stream) {
 	log.Debug("Peer secretShareResponseProtocol")
 	log.Debugf("remote are: %s\n", s.Conn().RemotePeer())
-	rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
-	buf, err := rw.ReadString('\n')
-	if err != nil {
-		log.Error(err)
-		return
-	}
+	rw := newCodec(s)
 	shareResponse := &ShareResponse{}
 	// Verify and decode share request data
-	decoder := json.NewDecoder(strings.NewReader(buf))
-	err = decoder.Decode(&shareResponse)
+	err := rw.Read(shareResponse)
 	if err != nil {
 		log.Error(err)
 		return
@@ -146,68 +495,255 @@ func secretShareResponseProtocol(s network.Stream) {
 		}
 		return
 	}
+	if share.Receiver != s.Conn().RemotePeer().Pretty() {
+		log.Error("Share response corrupted, receiver and remote peer are different")
+		return
+	}
 	if shareResponse.Approved == false {
 		_ = event.Write(event.Message{
 			Type: "secret.share.declined",
 			Data: map[string]string {
 				"Receiver": share.Receiver,
-				"SecretPath": share.KeyPath,
+				"SecretPath": strings.Join(share.keyPaths(), ","),
 				"Expiration": share.Expiration,
 			},
 		})
 		return
 	}
-	secretData, err := secret.FetchSecret([]byte(share.KeyPath))
-	o := owner.Owner{}
-	if o.FetchOwner() != nil {
-		log.Error(err)
+	if !isSubset(shareResponse.KeyPaths, share.keyPaths()) {
+		log.Error("Share response corrupted, key paths approved are not part of the share request")
 		return
 	}
-	id, err := o.GetIdentity()
+	if len(shareResponse.KeyPaths) > 0 {
+		share.KeyPaths = shareResponse.KeyPaths
+	}
+	share.Approved = true
+	secrets, err := secret.FetchSecretsMatching(share.keyPaths()...)
 	if err != nil {
 		log.Error(err)
 		return
 	}
-	plainText, err := crypto.DecryptAes(id.GetChildKeyAsByte(), []byte(secretData.Value))
-	secretData.Value = string(plainText)
-	if err != nil {
+	for _, secretData := range secrets {
+		share.Delivered = append(share.Delivered, secretData.Namespace + "." + secretData.Key)
+	}
+	if err := putDbShare(share); err != nil {
 		log.Error(err)
 		return
 	}
+	if err := sendSecrets(share, PidShareSecret, secrets); err != nil {
+		log.Error(err)
+		return
+	}
+	if err := contact.Remember(share.Receiver); err != nil {
+		log.Error(err)
+	}
+}
+
+// Decipher the secrets stored locally and send them together to the receiver of the share
+// The secrets covered by an approval policy are held back until approved
+// The receiver reply on the same stream with the result of each secret
+func sendSecrets(share Share, pid protocol.ID, secrets []secret.Secret) error {
+	secrets, err := approvedSecrets(share, secrets)
+	if err != nil {
+		return err
+	}
+	if len(secrets) == 0 {
+		return nil
+	}
+	o := owner.Owner{}
+	if err := o.FetchOwner(); err != nil {
+		return err
+	}
+	id, err := o.GetIdentity()
+	if err != nil {
+		return err
+	}
 	responseData := &ShareResponseData{
 		Uuid: share.Uuid,
 		Sender: share.Sender,
-		Secret: secretData,
 	}
-	secretJson, _ := json.Marshal(responseData)
-	err = Dial(share.Receiver, PidShareSecret, secretJson)
+	for _, secretData := range secrets {
+		plainText, err := crypto.DecryptAes(id.GetChildKeyAsByte(), []byte(secretData.Value))
+		if err != nil {
+			return err
+		}
+		secretData.Value = string(plainText)
+		responseData.Secrets = append(responseData.Secrets, secretData)
+	}
+	if len(responseData.Secrets) == 1 {
+		responseData.Secret = responseData.Secrets[0]
+	}
+	ctx, cancel := DialContext()
+	defer cancel()
+	result := ShareResult{}
+	err = DialRequest(ctx, share.Receiver, pid, responseData, &result)
+	if err == ErrorNoReply {
+		// Receiver without result reply
+		return nil
+	}
+	if err != nil {
+		RecordShareError(share.Uuid, err)
+		return err
+	}
+	return recordShareResult(share.Uuid, result)
+}
+
+// Keep the latest result of each key path on the share and notify the client
+func recordShareResult(uuid string, result ShareResult) error {
+	share, err := getDbShareRequest([]byte(uuid))
+	if err != nil {
+		return err
+	}
+	share.DeliveryError = ""
+	counts := make(map[string]int)
+	for _, item := range result.Results {
+		counts[item.Status]++
+		if item.Status == ShareStatusOutdated {
+			// The result of the newer version is kept
+			continue
+		}
+		replaced := false
+		for i, previous := range share.Results {
+			if previous.KeyPath == item.KeyPath {
+				share.Results[i] = item
+				replaced = true
+			}
+		}
+		if !replaced {
+			share.Results = append(share.Results, item)
+		}
+	}
+	if err := putDbShare(share); err != nil {
+		return err
+	}
+	_ = event.Write(event.Message{
+		Type: "secret.share.delivered",
+		Data: map[string]string {
+			"Receiver": share.Receiver,
+			"Uuid": share.Uuid,
+			"Created": strconv.Itoa(counts[ShareStatusCreated]),
+			"Updated": strconv.Itoa(counts[ShareStatusUpdated]),
+			"Conflict": strconv.Itoa(counts[ShareStatusConflict]),
+			"Refused": strconv.Itoa(counts[ShareStatusRefused]),
+			"Outdated": strconv.Itoa(counts[ShareStatusOutdated]),
+			"Error": strconv.Itoa(counts[ShareStatusError]),
+		},
+	})
+	return nil
+}
+
+// Keep the error of a dial to the receiver on the share and notify the client
+func RecordShareError(uuid string, dialErr error) {
+	share, err := getDbShareRequest([]byte(uuid))
 	if err != nil {
 		log.Error(err)
 		return
 	}
+	share.DeliveryError = dialErr.Error()
+	if err := putDbShare(share); err != nil {
+		log.Error(err)
+		return
+	}
+	_ = event.Write(event.Message{
+		Type: "secret.share.failed",
+		Data: map[string]string {
+			"Receiver": share.Receiver,
+			"Uuid": share.Uuid,
+			"Error": share.DeliveryError,
+		},
+	})
 }
 
-// Receive the password after share request exchange has been done
-func secretProtocol(s network.Stream) {
-	log.Debug("Peer secretProtocol")
-	log.Debugf("remote are: %s\n", s.Conn().RemotePeer())
+// Reply to the sender with the result of each secret received
+func writeShareResult(rw codec, result ShareResult) {
+	if err := rw.Write(result); err != nil {
+		log.Error(err)
+	}
+}
 
-	rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
-	buf, err := rw.ReadString('\n')
+// Push the new version of a secret to every receiver subscribed to it
+// Secrets created later in a shared namespace are pushed when the share include future secrets
+func pushSecretUpdate(secretData secret.Secret) {
+	shares, err := getDbShares()
 	if err != nil {
 		log.Error(err)
 		return
 	}
+	keyPath := secretData.Namespace + "." + secretData.Key
+	for _, share := range shares {
+		if _, ok := secret.MatchAnyKeyPath(share.keyPaths(), keyPath); !ok || !share.Approved || share.isExpired() {
+			continue
+		}
+		if isDelivered(share, keyPath) {
+			if !share.Subscribe {
+				continue
+			}
+		} else {
+			if !share.IncludeFuture {
+				continue
+			}
+			share.Delivered = append(share.Delivered, keyPath)
+			if err := putDbShare(share); err != nil {
+				log.Error(err)
+				continue
+			}
+		}
+		log.Debugf("Push version %d of %s to %s", secretData.Version, keyPath, share.Receiver)
+		if err := sendSecrets(share, PidShareUpdate, []secret.Secret{secretData}); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// Remove key paths from the secrets delivered of the share, they will be delivered again
+func forgetDelivered(uuid string, keyPaths []string) error {
+	share, err := getDbShareRequest([]byte(uuid))
+	if err == ErrorShareNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	delivered := make([]string, 0, len(share.Delivered))
+	for _, keyPath := range share.Delivered {
+		if _, ok := secret.MatchAnyKeyPath(keyPaths, keyPath); !ok {
+			delivered = append(delivered, keyPath)
+		}
+	}
+	share.Delivered = delivered
+	return putDbShare(share)
+}
+
+// No secret is pushed once the share has expired
+func (s Share) isExpired() bool {
+	expiration, err := time.Parse(time.RFC3339, s.Expiration)
+	return err != nil || time.Now().UTC().After(expiration)
+}
+
+func isDelivered(share Share, keyPath string) bool {
+	for _, delivered := range share.Delivered {
+		if delivered == keyPath {
+			return true
+		}
+	}
+	return false
+}
+
+// Receive the password after share request exchange has been done
+func secretProtocol(s network.Stream) {
+	log.Debug("Peer secretProtocol")
+	log.Debugf("remote are: %s\n", s.Conn().RemotePeer())
+
+	rw := newCodec(s)
 	shareResponseData := &ShareResponseData{}
 	// Verify and decode share request data
-	decoder := json.NewDecoder(strings.NewReader(buf))
-	err = decoder.Decode(&shareResponseData)
+	err := rw.Read(shareResponseData)
 	if err != nil {
 		log.Error(err)
 		return
 	}
-	_ = s.Close()
-	shareRequest, ok := requests[shareResponseData.Uuid]
+	defer s.Close()
+	shareRequest, ok := getRequest(shareResponseData.Uuid)
 	if !ok {
 		log.Errorf("share request not found with uuid %s", shareResponseData.Uuid)
 	}
@@ -215,35 +751,358 @@ func secretProtocol(s network.Stream) {
 		log.Error("This should not append, share request has not been approved")
 		return
 	}
-	if shareRequest.Approved == true {
-		o := owner.Owner{}
-		if o.FetchOwner() != nil {
-			log.Error(err)
-			return
+	if shareRequest.Sender != s.Conn().RemotePeer().Pretty() {
+		log.Error("Share corrupted, sender and remote peer are different")
+		return
+	}
+	subscription := Subscription{
+		Uuid: shareRequest.Uuid,
+		Sender: shareRequest.Sender,
+		KeyPath: shareRequest.KeyPath,
+		KeyPaths: shareRequest.KeyPaths,
+		Destination: destinationNamespace(shareRequest.Destination, shareRequest.Sender),
+		Subscribe: shareRequest.Subscribe,
+		IncludeFuture: shareRequest.IncludeFuture,
+		Paths: make(map[string]string),
+	}
+	result := ShareResult{Uuid: shareRequest.Uuid}
+	for _, secretData := range shareResponseData.secrets() {
+		keyPath := secretData.Namespace + "." + secretData.Key
+		pattern, ok := secret.MatchAnyKeyPath(subscription.keyPaths(), keyPath)
+		if !ok {
+			log.Errorf("Share refused for %s, key path not matching the share request", keyPath)
+			result.Results = append(result.Results, ShareItemResult{KeyPath: keyPath, Status: ShareStatusRefused})
+			continue
 		}
-		id, err := o.GetIdentity()
-		if err != nil {
-			log.Error(err)
-			return
-		}
-		cipherSecretValue, err := crypto.EncryptAes(id.GetChildKeyAsByte(), []byte(shareResponseData.Secret.Value))
-		shareResponseData.Secret.Value = string(cipherSecretValue)
-		log.Debug(shareResponseData.Secret)
-		err = shareResponseData.Secret.CreateSecret()
-		if err != nil {
-			log.Error(err)
-			return
+		relocateSecret(pattern, subscription.Destination, &secretData)
+		secretData.Origin = newOrigin(shareRequest.Sender, shareRequest.Uuid, keyPath, secretData.Version)
+		item := storeSharedItem(&secretData, shareRequest.Uuid, keyPath, false)
+		result.Results = append(result.Results, item)
+		if item.Status == ShareStatusError {
+			continue
 		}
+		localPath := item.SecretPath
+		subscription.Paths[keyPath] = localPath
 		_ = event.Write(event.Message{
 			Type: "secret.share.created",
 			Data: map[string]string {
 				"Sender": shareRequest.Sender,
-				"SecretPath": shareRequest.KeyPath,
-				"Type": string(shareResponseData.Secret.Type),
-				"Description": shareResponseData.Secret.Description,
+				"SecretPath": localPath,
+				"OriginalPath": keyPath,
+				"Type": strconv.Itoa(secretData.Type),
+				"Description": secretData.Description,
+			},
+		})
+	}
+	if shareRequest.Subscribe || shareRequest.IncludeFuture {
+		if err := putDbSubscription(subscription); err != nil {
+			log.Error(err)
+		}
+	}
+	if err := contact.Remember(shareRequest.Sender); err != nil {
+		log.Error(err)
+	}
+	writeShareResult(rw, result)
+}
+
+// Receive a new version of a secret previously shared in subscribe mode
+// or a new secret created in a namespace shared with future secrets included
+func secretUpdateProtocol(s network.Stream) {
+	log.Debug("Peer secretUpdateProtocol")
+	log.Debugf("remote are: %s\n", s.Conn().RemotePeer())
+
+	rw := newCodec(s)
+	shareResponseData := &ShareResponseData{}
+	err := rw.Read(shareResponseData)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	defer s.Close()
+
+	result, ok := storeSecretUpdates(s.Conn().RemotePeer().Pretty(), *shareResponseData)
+	if ok {
+		writeShareResult(rw, result)
+	}
+}
+
+// Store the secrets pushed on a subscription, return false when the update is refused as a whole
+func storeSecretUpdates(remote string, shareResponseData ShareResponseData) (ShareResult, bool) {
+	updatesLock.Lock()
+	defer updatesLock.Unlock()
+	subscription, err := getDbSubscription([]byte(shareResponseData.Uuid))
+	if err != nil {
+		log.Errorf("subscription not found with uuid %s", shareResponseData.Uuid)
+		return ShareResult{}, false
+	}
+	if subscription.Sender != remote {
+		log.Error("Share update corrupted, subscription sender and remote peer are different")
+		return ShareResult{}, false
+	}
+	if subscription.Paths == nil {
+		subscription.Paths = make(map[string]string)
+	}
+	result := ShareResult{Uuid: subscription.Uuid}
+	for _, secretData := range shareResponseData.secrets() {
+		keyPath := secretData.Namespace + "." + secretData.Key
+		refused := ShareItemResult{KeyPath: keyPath, Status: ShareStatusRefused}
+		pattern, ok := secret.MatchAnyKeyPath(subscription.keyPaths(), keyPath)
+		if !ok {
+			log.Errorf("Share update refused, %s is not matching the subscribed key path", keyPath)
+			result.Results = append(result.Results, refused)
+			continue
+		}
+
+		// A new version replace the local copy, a new secret is stored as for the initial share
+		eventType := "secret.share.updated"
+		localPath, known := subscription.Paths[keyPath]
+		if known {
+			if !subscription.Subscribe {
+				log.Errorf("Share update refused, %s is not subscribed to new versions", keyPath)
+				result.Results = append(result.Results, refused)
+				continue
+			}
+			if !isNewerVersion(localPath, subscription.Uuid, secretData.Version) {
+				log.Noticef("Share update ignored, version %d of %s is not newer than the one received", secretData.Version, keyPath)
+				result.Results = append(result.Results, ShareItemResult{KeyPath: keyPath, Status: ShareStatusOutdated, SecretPath: localPath})
+				continue
+			}
+			secretData.Namespace = localPath[:strings.LastIndex(localPath, ".")]
+			secretData.Key = localPath[strings.LastIndex(localPath, ".") + 1:]
+		} else {
+			if !subscription.IncludeFuture {
+				log.Errorf("Share update refused, %s is a new secret", keyPath)
+				result.Results = append(result.Results, refused)
+				continue
+			}
+			eventType = "secret.share.created"
+			relocateSecret(pattern, destinationNamespace(subscription.Destination, subscription.Sender), &secretData)
+		}
+		secretData.Origin = newOrigin(subscription.Sender, subscription.Uuid, keyPath, secretData.Version)
+		item := storeSharedItem(&secretData, subscription.Uuid, keyPath, known)
+		result.Results = append(result.Results, item)
+		if item.Status == ShareStatusError {
+			continue
+		}
+		localPath = item.SecretPath
+		subscription.Paths[keyPath] = localPath
+		_ = event.Write(event.Message{
+			Type: eventType,
+			Data: map[string]string {
+				"Sender": subscription.Sender,
+				"Uuid": subscription.Uuid,
+				"SecretPath": localPath,
+				"OriginalPath": keyPath,
+				"Version": strconv.Itoa(secretData.Version),
 			},
 		})
 	}
+	if err := putDbSubscription(subscription); err != nil {
+		log.Error(err)
+	}
+	return result, true
+}
+
+// List the subscriptions to the shares received
+func FetchSubscriptions() ([]Subscription, error) {
+	db, err := database.GetConnection()
+	if err != nil {
+		return nil, err
+	}
+	subscriptions := []Subscription{}
+
+	err = db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("subscription"))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var subscription Subscription
+			if err := json.Unmarshal(v, &subscription); err != nil {
+				return err
+			}
+			subscriptions = append(subscriptions, subscription)
+			return nil
+		})
+	})
+	return subscriptions, err
+}
+
+// Stop receiving the later versions and secrets of a share
+// The subscription is removed first so the updates are refused even when the sender is unreachable
+func Unsubscribe(uuid string) error {
+	subscription, err := getDbSubscription([]byte(uuid))
+	if err != nil {
+		return err
+	}
+	if err := deleteDbSubscription([]byte(uuid)); err != nil {
+		return err
+	}
+	ctx, cancel := DialContext()
+	defer cancel()
+	if err := Dial(ctx, subscription.Sender, PidShareUnsubscribe, ShareUnsubscribe{Uuid: uuid}); err != nil {
+		log.Errorf("Unsubscribe of share %s not delivered to %s: %s", uuid, subscription.Sender, err)
+	}
+	return nil
+}
+
+// Receive the unsubscribe of a receiver, nothing is pushed anymore on the share
+func shareUnsubscribeProtocol(s network.Stream) {
+	log.Debug("Peer shareUnsubscribeProtocol")
+	log.Debugf("remote are: %s\n", s.Conn().RemotePeer())
+	rw := newCodec(s)
+	unsubscribe := ShareUnsubscribe{}
+	err := rw.Read(&unsubscribe)
+	_ = s.Close()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	share, err := getDbShareRequest([]byte(unsubscribe.Uuid))
+	if err != nil {
+		log.Errorf("share not found with uuid %s", unsubscribe.Uuid)
+		return
+	}
+	if share.Receiver != s.Conn().RemotePeer().Pretty() {
+		log.Error("Unsubscribe corrupted, share receiver and remote peer are different")
+		return
+	}
+	share.Subscribe = false
+	share.IncludeFuture = false
+	if err := putDbShare(share); err != nil {
+		log.Error(err)
+		return
+	}
+	_ = event.Write(event.Message{
+		Type: "secret.share.unsubscribed",
+		Data: map[string]string {
+			"Receiver": share.Receiver,
+			"Uuid": share.Uuid,
+		},
+	})
+}
+
+// Store a secret received and report its result to the sender
+func storeSharedItem(secretData *secret.Secret, uuid string, keyPath string, overwrite bool) ShareItemResult {
+	expectedPath := secretData.Namespace + "." + secretData.Key
+	localPath, err := storeSharedSecret(secretData, uuid, overwrite)
+	if err != nil {
+		log.Error(err)
+		return ShareItemResult{KeyPath: keyPath, Status: ShareStatusError, Error: err.Error()}
+	}
+	status := ShareStatusCreated
+	if overwrite {
+		status = ShareStatusUpdated
+	} else if localPath != expectedPath {
+		status = ShareStatusConflict
+	}
+	return ShareItemResult{KeyPath: keyPath, Status: status, SecretPath: localPath}
+}
+
+func newOrigin(sender string, uuid string, keyPath string, version int) *secret.Origin {
+	return &secret.Origin{
+		Sender: sender,
+		ShareUuid: uuid,
+		ReceivedAt: time.Now().UTC().Format(time.RFC3339),
+		KeyPath: keyPath,
+		Version: version,
+	}
+}
+
+// Check that the version pushed by the sender is newer than the one stored at the local path
+// The updates are pushed concurrently by the sender and may arrive out of order
+func isNewerVersion(localPath string, uuid string, version int) bool {
+	stored, err := secret.FetchSecret([]byte(localPath))
+	if err != nil || stored.Origin == nil || stored.Origin.ShareUuid != uuid {
+		return true
+	}
+	return version > stored.Origin.Version
+}
+
+// Destination namespace chosen by the receiver, shared.<sender> when none was given
+func destinationNamespace(destination string, sender string) string {
+	if destination == "" {
+		return "shared." + sender
+	}
+	return destination
+}
+
+// Move a secret received for a key path or glob into the destination namespace
+// The sub namespaces below the namespace of the key path are kept, such as staging.*
+// delivering staging.api.token into destination.api.token
+func relocateSecret(pattern string, destination string, secretData *secret.Secret) {
+	base := ""
+	if i := strings.LastIndex(pattern, "."); i >= 0 {
+		base = pattern[:i]
+	}
+	switch {
+	case base != "" && secretData.Namespace == base:
+		secretData.Namespace = destination
+	case base != "" && strings.HasPrefix(secretData.Namespace, base + "."):
+		secretData.Namespace = destination + strings.TrimPrefix(secretData.Namespace, base)
+	default:
+		secretData.Namespace = destination + "." + secretData.Namespace
+	}
+}
+
+// Cipher with the owner key and save locally a secret received from another peer
+// Unless overwrite is set, an existing secret is never replaced, both versions are kept and a conflict is notified
+// Return the key path where the secret has been saved
+func storeSharedSecret(secretData *secret.Secret, uuid string, overwrite bool) (string, error) {
+	o := owner.Owner{}
+	if err := o.FetchOwner(); err != nil {
+		return "", err
+	}
+	id, err := o.GetIdentity()
+	if err != nil {
+		return "", err
+	}
+	cipherSecretValue, err := crypto.EncryptAes(id.GetChildKeyAsByte(), []byte(secretData.Value))
+	if err != nil {
+		return "", err
+	}
+	secretData.Value = string(cipherSecretValue)
+
+	keyPath := secretData.Namespace + "." + secretData.Key
+	if !overwrite {
+		existing, err := secret.FetchSecret([]byte(keyPath))
+		if err == nil {
+			conflictKey, err := freeConflictKey(secretData.Namespace, secretData.Key + "-conflict-" + strings.Split(uuid, "-")[0])
+			if err != nil {
+				return "", err
+			}
+			secretData.Key = conflictKey
+			_ = event.Write(event.Message{
+				Type: "secret.share.conflict",
+				Data: map[string]string {
+					"Uuid": uuid,
+					"SecretPath": keyPath,
+					"ConflictPath": secretData.Namespace + "." + secretData.Key,
+					"ExistingVersion": strconv.Itoa(existing.Version),
+				},
+			})
+		} else if err != secret.ErrorSecretNotFound {
+			return "", err
+		}
+	}
+	return secretData.Namespace + "." + secretData.Key, secretData.CreateSecret()
+}
+
+// Key not used yet in the namespace, a later conflict on the same share is suffixed by a counter
+// so every version received is kept
+func freeConflictKey(namespace string, key string) (string, error) {
+	conflictKey := key
+	for i := 2; ; i++ {
+		_, err := secret.FetchSecret([]byte(namespace + "." + conflictKey))
+		if err == secret.ErrorSecretNotFound {
+			return conflictKey, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		conflictKey = key + "-" + strconv.Itoa(i)
+	}
 }
 
 func getDbShareRequest(uuid []byte) (Share, error) {
@@ -269,4 +1128,102 @@ func getDbShareRequest(uuid []byte) (Share, error) {
 	}
 
 	return *share, nil
-}
\ No newline at end of file
+}
+
+func getDbShares() ([]Share, error) {
+	db, err := database.GetConnection()
+	if err != nil {
+		return nil, err
+	}
+	var shares []Share
+
+	err = db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("share"))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var share Share
+			if err := json.Unmarshal(v, &share); err != nil {
+				return err
+			}
+			shares = append(shares, share)
+			return nil
+		})
+	})
+	return shares, err
+}
+
+func putDbShare(share Share) error {
+	db, err := database.GetConnection()
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(&share)
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("share"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(share.Uuid), buf)
+	})
+}
+
+func getDbSubscription(uuid []byte) (Subscription, error) {
+	subscription := &Subscription{}
+	db, err := database.GetConnection()
+	if err != nil {
+		return *subscription, err
+	}
+
+	err = db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("subscription"))
+		if b == nil {
+			return ErrorSubscriptionNotFound
+		}
+		buf := b.Get(uuid)
+		if buf == nil {
+			return ErrorSubscriptionNotFound
+		}
+		return json.Unmarshal(buf, subscription)
+	})
+	return *subscription, err
+}
+
+func putDbSubscription(subscription Subscription) error {
+	db, err := database.GetConnection()
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(&subscription)
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("subscription"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(subscription.Uuid), buf)
+	})
+}
+
+func deleteDbSubscription(uuid []byte) error {
+	db, err := database.GetConnection()
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("subscription"))
+		if b == nil {
+			return nil
+		}
+		return b.Delete(uuid)
+	})
+}
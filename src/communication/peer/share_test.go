@@ -0,0 +1,331 @@
+package peer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/PeerVault/PeerVault-Service/business/owner"
+	"github.com/PeerVault/PeerVault-Service/business/secret"
+	"github.com/PeerVault/PeerVault-Service/crypto"
+	"github.com/google/uuid"
+)
+
+func TestShareFlow(t *testing.T) {
+	instances := newInstances(t, "alice", "bob")
+	defer closeInstances(instances)
+	sender, receiver := instances[0], instances[1]
+
+	sender.run(func() {
+		createTestSecret(t, "staging", "database", "hunter2")
+	})
+	shareUuid := requestTestShare(t, sender, receiver, "staging.database", false)
+
+	// The receiver is notified at once, the profile of the sender not known yet follows
+	request := receiver.waitEvent(t, "secret.share.request")
+	if request.Data["Uuid"] != shareUuid || request.Data["Sender"] != sender.QmPeerId || request.Data["SecretPath"] != "staging.database" {
+		t.Errorf("Share request event must come from the sender, current: %v", request.Data)
+	}
+	info := receiver.waitEvent(t, "peer.info.updated")
+	if info.Data["PeerId"] != sender.QmPeerId || info.Data["Nickname"] != "alice" {
+		t.Errorf("Profile of the sender must be fetched in the background, current: %v", info.Data)
+	}
+	receiver.run(func() {
+		if data := peerInfoEventData(sender.QmPeerId, map[string]string{}); data["Nickname"] != "alice" {
+			t.Errorf("Profile cached must be attached to the next events, current: %v", data)
+		}
+	})
+
+	respondTestShare(t, sender, receiver, shareUuid, true)
+
+	secretPath := "shared." + sender.QmPeerId + ".database"
+	created := receiver.waitEvent(t, "secret.share.created")
+	if created.Data["SecretPath"] != secretPath || created.Data["OriginalPath"] != "staging.database" {
+		t.Errorf("Secret must be saved in the namespace of the sender, current: %v", created.Data)
+	}
+	delivered := sender.waitEvent(t, "secret.share.delivered")
+	if delivered.Data["Created"] != "1" || delivered.Data["Receiver"] != receiver.QmPeerId {
+		t.Errorf("Sender must be notified of the secret created, current: %v", delivered.Data)
+	}
+
+	// The receiver cipher the secret with its own key
+	receiver.run(func() {
+		received, err := secret.FetchSecret([]byte(secretPath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		o := owner.Owner{}
+		if err := o.FetchOwner(); err != nil {
+			t.Fatal(err)
+		}
+		id, err := o.GetIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		plainText, err := crypto.DecryptAes(id.GetChildKeyAsByte(), []byte(received.Value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(plainText) != "hunter2" {
+			t.Errorf("Secret received must have the value shared, current: %s", plainText)
+		}
+		if received.Origin == nil || received.Origin.Sender != sender.QmPeerId || received.Origin.ShareUuid != shareUuid {
+			t.Errorf("Secret received must keep its origin, current: %v", received.Origin)
+		}
+	})
+
+	sender.run(func() {
+		share, err := getDbShareRequest([]byte(shareUuid))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !share.Approved || len(share.Results) != 1 || share.Results[0].Status != ShareStatusCreated {
+			t.Errorf("Share must keep the result of the receiver, current: %v", share)
+		}
+	})
+}
+
+func TestShareDeclined(t *testing.T) {
+	instances := newInstances(t, "alice", "bob")
+	defer closeInstances(instances)
+	sender, receiver := instances[0], instances[1]
+
+	sender.run(func() {
+		createTestSecret(t, "staging", "database", "hunter2")
+	})
+	shareUuid := requestTestShare(t, sender, receiver, "staging.database", false)
+	receiver.waitEvent(t, "secret.share.request")
+	respondTestShare(t, sender, receiver, shareUuid, false)
+
+	declined := sender.waitEvent(t, "secret.share.declined")
+	if declined.Data["Receiver"] != receiver.QmPeerId {
+		t.Errorf("Sender must be notified of the share declined, current: %v", declined.Data)
+	}
+	receiver.run(func() {
+		if _, err := secret.FetchSecret([]byte("shared." + sender.QmPeerId + ".database")); err != secret.ErrorSecretNotFound {
+			t.Errorf("Secret must not be delivered when the share is declined, current: %v", err)
+		}
+	})
+}
+
+func TestShareUnsubscribe(t *testing.T) {
+	instances := newInstances(t, "alice", "bob")
+	defer closeInstances(instances)
+	sender, receiver := instances[0], instances[1]
+
+	sender.run(func() {
+		createTestSecret(t, "staging", "database", "hunter2")
+	})
+	shareUuid := requestTestShare(t, sender, receiver, "staging.database", true)
+	receiver.waitEvent(t, "secret.share.request")
+	respondTestShare(t, sender, receiver, shareUuid, true)
+	receiver.waitEvent(t, "secret.share.created")
+
+	receiver.run(func() {
+		if err := Unsubscribe(shareUuid); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := getDbSubscription([]byte(shareUuid)); err != ErrorSubscriptionNotFound {
+			t.Errorf("Subscription must be removed on unsubscribe, current: %v", err)
+		}
+	})
+	unsubscribed := sender.waitEvent(t, "secret.share.unsubscribed")
+	if unsubscribed.Data["Receiver"] != receiver.QmPeerId {
+		t.Errorf("Sender must be notified of the unsubscribe, current: %v", unsubscribed.Data)
+	}
+	sender.run(func() {
+		share, err := getDbShareRequest([]byte(shareUuid))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if share.Subscribe || share.IncludeFuture {
+			t.Errorf("Share unsubscribed must not push updates anymore, current: %v", share)
+		}
+	})
+}
+
+func TestShareUpdateOutOfOrder(t *testing.T) {
+	instances := newInstances(t, "alice", "bob")
+	defer closeInstances(instances)
+	sender, receiver := instances[0], instances[1]
+
+	sender.run(func() {
+		createTestSecret(t, "staging", "database", "hunter2")
+	})
+	shareUuid := requestTestShare(t, sender, receiver, "staging.database", true)
+	receiver.waitEvent(t, "secret.share.request")
+	respondTestShare(t, sender, receiver, shareUuid, true)
+	receiver.waitEvent(t, "secret.share.created")
+
+	// Each update is pushed by its own listener, the second one may reach the receiver first
+	sender.run(func() {
+		createTestSecret(t, "staging", "database", "second")
+		second, err := secret.FetchSecret([]byte("staging.database"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		createTestSecret(t, "staging", "database", "third")
+		third, err := secret.FetchSecret([]byte("staging.database"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pushSecretUpdate(third)
+		pushSecretUpdate(second)
+	})
+	sender.run(func() {
+		// Updates are delivered synchronously, the last result reports the version ignored
+		delivered := sender.events[len(sender.events) - 1]
+		if delivered.Type != "secret.share.delivered" || delivered.Data["Outdated"] != "1" {
+			t.Errorf("Receiver must report the version pushed out of order, current: %v", delivered)
+		}
+	})
+	receiver.run(func() {
+		received := fetchTestSecret(t, "shared." + sender.QmPeerId + ".database")
+		if received.Value != "third" || received.Origin == nil || received.Origin.Version != 3 {
+			t.Errorf("Older version pushed later must be ignored, current: %s %v", received.Value, received.Origin)
+		}
+	})
+}
+
+func TestShareUpdatePushed(t *testing.T) {
+	instances := newInstances(t, "alice", "bob", "carol")
+	defer closeInstances(instances)
+	sender, receiver, other := instances[0], instances[1], instances[2]
+
+	sender.run(func() {
+		createTestSecret(t, "staging", "database", "hunter2")
+	})
+	subscribed := requestTestShare(t, sender, receiver, "staging.database", true)
+	receiver.waitEvent(t, "secret.share.request")
+	respondTestShare(t, sender, receiver, subscribed, true)
+	receiver.waitEvent(t, "secret.share.created")
+	once := requestTestShare(t, sender, other, "staging.database", false)
+	other.waitEvent(t, "secret.share.request")
+	respondTestShare(t, sender, other, once, true)
+	other.waitEvent(t, "secret.share.created")
+
+	// The new version is pushed to the subscribed receiver only
+	sender.run(func() {
+		createTestSecret(t, "staging", "database", "rotated")
+		updated, err := secret.FetchSecret([]byte("staging.database"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pushSecretUpdate(updated)
+	})
+	updated := receiver.waitEvent(t, "secret.share.updated")
+	if updated.Data["Uuid"] != subscribed || updated.Data["OriginalPath"] != "staging.database" || updated.Data["Version"] != "2" {
+		t.Errorf("Receiver must be notified of the new version, current: %v", updated.Data)
+	}
+	sender.run(func() {
+		share, err := getDbShareRequest([]byte(subscribed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(share.Results) != 1 || share.Results[0].Status != ShareStatusUpdated {
+			t.Errorf("Share must keep the result of the update, current: %v", share.Results)
+		}
+	})
+	receiver.run(func() {
+		received := fetchTestSecret(t, "shared." + sender.QmPeerId + ".database")
+		if received.Value != "rotated" || received.Origin == nil || received.Origin.Version != 2 {
+			t.Errorf("New version must replace the secret received, current: %s %v", received.Value, received.Origin)
+		}
+	})
+	other.run(func() {
+		if received := fetchTestSecret(t, "shared." + sender.QmPeerId + ".database"); received.Value != "hunter2" {
+			t.Errorf("New version must not be pushed without subscription, current: %s", received.Value)
+		}
+	})
+}
+
+func TestShareIncludeFuture(t *testing.T) {
+	instances := newInstances(t, "alice", "bob")
+	defer closeInstances(instances)
+	sender, receiver := instances[0], instances[1]
+
+	sender.run(func() {
+		createTestSecret(t, "staging", "cache", "hunter2")
+	})
+	shareUuid := requestTestShareOf(t, sender, receiver, Share{KeyPath: "staging.*", IncludeFuture: true})
+	request := receiver.waitEvent(t, "secret.share.request")
+	if request.Data["IncludeFuture"] != "true" {
+		t.Errorf("Share request must announce the future secrets, current: %v", request.Data)
+	}
+	respondTestShare(t, sender, receiver, shareUuid, true)
+	sender.waitEvent(t, "secret.share.delivered")
+
+	// Only the secrets created later in the namespace shared are pushed
+	sender.run(func() {
+		createTestSecret(t, "production", "database", "hunter2")
+		createTestSecret(t, "staging", "database", "hunter2")
+		for _, keyPath := range []string{"production.database", "staging.database"} {
+			created, err := secret.FetchSecret([]byte(keyPath))
+			if err != nil {
+				t.Fatal(err)
+			}
+			pushSecretUpdate(created)
+		}
+		share, err := getDbShareRequest([]byte(shareUuid))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(share.Delivered) != 2 || share.Delivered[1] != "staging.database" {
+			t.Errorf("Secret pushed must be recorded as delivered, current: %v", share.Delivered)
+		}
+	})
+	receiver.run(func() {
+		// Updates are delivered synchronously, the secret is stored once pushed
+		created := receiver.events[len(receiver.events) - 1]
+		if created.Type != "secret.share.created" || created.Data["Uuid"] != shareUuid || created.Data["OriginalPath"] != "staging.database" {
+			t.Fatalf("Secret created in the namespace shared must be delivered, current: %v", created)
+		}
+		if received := fetchTestSecret(t, created.Data["SecretPath"]); received.Value != "hunter2" {
+			t.Errorf("Secret delivered must have the value created, current: %s", received.Value)
+		}
+		for _, m := range receiver.events {
+			if m.Data["OriginalPath"] == "production.database" {
+				t.Errorf("Secret outside the namespace shared must not be delivered, current: %v", m)
+			}
+		}
+	})
+}
+
+func TestShareExpired(t *testing.T) {
+	share := Share{Expiration: time.Now().UTC().Add(-time.Minute).Format(time.RFC3339)}
+	if !share.isExpired() {
+		t.Error("Share past its expiration must be expired")
+	}
+	share.Expiration = time.Now().UTC().Add(time.Hour).Format(time.RFC3339)
+	if share.isExpired() {
+		t.Error("Share before its expiration must not be expired")
+	}
+}
+
+func TestShareConflictKept(t *testing.T) {
+	instances := newInstances(t, "alice")
+	defer closeInstances(instances)
+	receiver := instances[0]
+
+	receiver.run(func() {
+		createTestSecret(t, "staging", "database", "local")
+		shareUuid := uuid.New().String()
+		// Every conflict on the same key of the same share keep its own copy
+		paths := make(map[string]bool)
+		for _, value := range []string{"first", "second"} {
+			secretData := secret.Secret{Namespace: "staging", Type: secret.SecretTypePassword, Key: "database", Value: value}
+			localPath, err := storeSharedSecret(&secretData, shareUuid, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			paths[localPath] = true
+		}
+		if len(paths) != 2 || paths["staging.database"] {
+			t.Errorf("Conflicts must be saved next to the local secret without overwrite, current: %v", paths)
+		}
+		for localPath := range paths {
+			if _, err := secret.FetchSecret([]byte(localPath)); err != nil {
+				t.Errorf("Conflict %s must be kept, current: %v", localPath, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,555 @@
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+//
+// Peer package will manage all the communication with
+// the EXTERNAL Peers (libp2p) to exchange password with other Peer
+// same of different owner
+//
+// Team will focus on Protocol regarding team vault membership and secrets
+package peer
+
+import (
+	"encoding/base64"
+	"github.com/PeerVault/PeerVault-Service/business/secret"
+	"github.com/PeerVault/PeerVault-Service/business/team"
+	"github.com/PeerVault/PeerVault-Service/communication/event"
+	"github.com/PeerVault/PeerVault-Service/crypto"
+	"github.com/PeerVault/PeerVault-Service/identity"
+	"github.com/libp2p/go-libp2p-core/network"
+	"strconv"
+	"sync"
+)
+
+// TeamMembership carry the signed membership list to a member
+// with the group key and a copy of every secrets of the team namespace
+type TeamMembership struct {
+	Team team.Team
+	GroupKey string // base64 of the group key, empty for removed members
+	Secrets []secret.Secret // Values are cipher with the group key
+}
+
+// TeamLeave is sent by a member to the admins of a team it leaves
+type TeamLeave struct {
+	TeamUuid string
+}
+
+// TeamSecret carry a new version of team secrets to the other members
+type TeamSecret struct {
+	TeamUuid string
+	Secrets []secret.Secret // Values are cipher with the group key
+}
+
+var (
+	invitations = make(map[string]TeamMembership) // Membership of the teams not joined yet, by team uuid
+	invitationsLock sync.Mutex
+)
+
+// Send the membership list to every member, and notify the removed members
+func PushTeam(t team.Team, removed []string) error {
+	id, err := getPeerIdentity()
+	if err != nil {
+		return err
+	}
+	groupKey, err := t.GetGroupKey(id)
+	if err != nil {
+		return err
+	}
+	secrets, err := secret.FetchSecretsMatching(t.Namespace + ".*")
+	if err != nil {
+		return err
+	}
+	secrets, err = cipherTeamSecrets(id, groupKey, secrets)
+	if err != nil {
+		return err
+	}
+	t.GroupKey = ""
+
+	membership := TeamMembership{
+		Team: t,
+		GroupKey: base64.StdEncoding.EncodeToString(groupKey),
+		Secrets: secrets,
+	}
+	for _, member := range t.Members {
+		if member == id.Id {
+			continue
+		}
+		ctx, cancel := DialContext()
+		err := Dial(ctx, member, PidTeamMembership, membership)
+		cancel()
+		if err != nil {
+			log.Errorf("Team %s membership not delivered to %s", t.Uuid, member)
+			log.Error(err)
+		}
+	}
+
+	removal := TeamMembership{Team: t}
+	for _, member := range removed {
+		ctx, cancel := DialContext()
+		err := Dial(ctx, member, PidTeamMembership, removal)
+		cancel()
+		if err != nil {
+			log.Errorf("Team %s removal not delivered to %s", t.Uuid, member)
+			log.Error(err)
+		}
+	}
+	return nil
+}
+
+// Push the new version of a secret belonging to a team namespace to the other members
+func pushTeamSecret(secretData secret.Secret) {
+	t, err := team.FetchTeamOfNamespace(secretData.Namespace)
+	if err == team.ErrorTeamNotFound {
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	id, err := getPeerIdentity()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if !t.IsMember(id.Id) {
+		return
+	}
+	groupKey, err := t.GetGroupKey(id)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	secrets, err := cipherTeamSecrets(id, groupKey, []secret.Secret{secretData})
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	teamSecret := TeamSecret{
+		TeamUuid: t.Uuid,
+		Secrets: secrets,
+	}
+	for _, member := range t.Members {
+		if member == id.Id {
+			continue
+		}
+		ctx, cancel := DialContext()
+		err := Dial(ctx, member, PidTeamSecret, teamSecret)
+		cancel()
+		if err != nil {
+			log.Errorf("Team secret %s.%s not delivered to %s", secretData.Namespace, secretData.Key, member)
+			log.Error(err)
+		}
+	}
+}
+
+// Receive the membership list of a team, sent by one of its admins
+// A team never seen is only joined once the owner accept its invitation
+func teamMembershipProtocol(s network.Stream) {
+	log.Debug("Peer teamMembershipProtocol")
+	log.Debugf("remote are: %s\n", s.Conn().RemotePeer())
+	rw := newCodec(s)
+	membership := &TeamMembership{}
+	err := rw.Read(membership)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	_ = s.Close()
+
+	incoming := membership.Team
+	if incoming.Signer != s.Conn().RemotePeer().Pretty() {
+		log.Error("Team membership corrupted, signer and remote peer are different")
+		return
+	}
+	if err := incoming.Verify(); err != nil {
+		log.Error(err)
+		return
+	}
+
+	id, err := getPeerIdentity()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	local, err := team.FetchTeam(incoming.Uuid)
+	if err == team.ErrorTeamNotFound {
+		if incoming.IsMember(id.Id) {
+			inviteTeam(*membership)
+		}
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	// An existing team can only be changed by one of its current admins
+	if incoming.Version <= local.Version {
+		log.Errorf("Team %s membership version %d is outdated", incoming.Uuid, incoming.Version)
+		return
+	}
+	if !local.IsAdmin(incoming.Signer) {
+		log.Errorf("Team %s membership signed by %s who is not admin", incoming.Uuid, incoming.Signer)
+		return
+	}
+	if incoming.Namespace != local.Namespace {
+		log.Errorf("Team %s membership refused, the namespace %s can not be changed", incoming.Uuid, local.Namespace)
+		return
+	}
+
+	if !incoming.IsMember(id.Id) {
+		if err := local.Delete(); err != nil {
+			log.Error(err)
+			return
+		}
+		_ = event.Write(event.Message{
+			Type: "team.removed",
+			Data: map[string]string {
+				"Uuid": incoming.Uuid,
+				"Name": incoming.Name,
+				"Namespace": incoming.Namespace,
+				"Signer": incoming.Signer,
+			},
+		})
+		return
+	}
+	if err := joinTeam(id, *membership); err != nil {
+		log.Error(err)
+	}
+}
+
+// Keep the invitation to a team until the owner accept or decline it
+// The team is refused when its namespace is already used locally
+func inviteTeam(membership TeamMembership) {
+	t := membership.Team
+	if err := checkTeamNamespace(t); err != nil {
+		log.Errorf("Team %s invitation of %s refused: %s", t.Uuid, t.Signer, err)
+		_ = event.Write(event.Message{
+			Type: "team.refused",
+			Data: map[string]string {
+				"Uuid": t.Uuid,
+				"Name": t.Name,
+				"Namespace": t.Namespace,
+				"Signer": t.Signer,
+				"Error": err.Error(),
+			},
+		})
+		return
+	}
+	invitationsLock.Lock()
+	previous, ok := invitations[t.Uuid]
+	if ok && previous.Team.Version >= t.Version {
+		invitationsLock.Unlock()
+		return
+	}
+	invitations[t.Uuid] = membership
+	invitationsLock.Unlock()
+
+	// Profile of the admin let the owner know who is inviting
+	_ = event.Write(event.Message{
+		Type: "team.invitation",
+		Data: peerInfoEventData(t.Signer, map[string]string {
+			"Uuid": t.Uuid,
+			"Name": t.Name,
+			"Namespace": t.Namespace,
+			"Signer": t.Signer,
+			"Members": strconv.Itoa(len(t.Members)),
+		}),
+	})
+}
+
+// Namespace of a team joined must not hold local secrets nor overlap the namespace of another team,
+// the secrets of the team would overwrite them
+func checkTeamNamespace(t team.Team) error {
+	if !secret.IsValidNamespace(t.Namespace) {
+		return ErrorTeamNamespaceInUse
+	}
+	teams, err := team.FetchTeams()
+	if err != nil {
+		return err
+	}
+	for _, other := range teams {
+		if other.Uuid != t.Uuid && (other.MatchNamespace(t.Namespace) || t.MatchNamespace(other.Namespace)) {
+			return ErrorTeamNamespaceInUse
+		}
+	}
+	secrets, err := secret.FetchSecretsMatching(t.Namespace + ".*")
+	if err != nil {
+		return err
+	}
+	if len(secrets) > 0 {
+		return ErrorTeamNamespaceInUse
+	}
+	return nil
+}
+
+// List the invitations to teams not answered yet
+func FetchTeamInvitations() []team.Team {
+	invitationsLock.Lock()
+	defer invitationsLock.Unlock()
+	teams := []team.Team{}
+	for _, membership := range invitations {
+		teams = append(teams, membership.Team)
+	}
+	return teams
+}
+
+// Accept or decline the invitation to a team
+// On acceptance the team and its secrets are saved, unless its namespace is used locally meanwhile
+func RespondTeamInvitation(uuid string, accepted bool) error {
+	invitationsLock.Lock()
+	membership, ok := invitations[uuid]
+	invitationsLock.Unlock()
+	if !ok {
+		return ErrorTeamInvitationNotFound
+	}
+	if accepted {
+		if err := checkTeamNamespace(membership.Team); err != nil {
+			return err
+		}
+	}
+	invitationsLock.Lock()
+	delete(invitations, uuid)
+	invitationsLock.Unlock()
+	if !accepted {
+		return nil
+	}
+	id, err := getPeerIdentity()
+	if err != nil {
+		return err
+	}
+	return joinTeam(id, membership)
+}
+
+// Save the membership list with its group key and the secrets of the team
+func joinTeam(id identity.PeerIdentity, membership TeamMembership) error {
+	t := membership.Team
+	groupKey, err := base64.StdEncoding.DecodeString(membership.GroupKey)
+	if err != nil {
+		return err
+	}
+	if err := t.SetGroupKey(id, groupKey); err != nil {
+		return err
+	}
+	if err := t.Save(); err != nil {
+		return err
+	}
+	storeTeamSecrets(id, t, t.Signer, groupKey, membership.Secrets)
+	_ = event.Write(event.Message{
+		Type: "team.updated",
+		Data: map[string]string {
+			"Uuid": t.Uuid,
+			"Name": t.Name,
+			"Namespace": t.Namespace,
+			"Signer": t.Signer,
+			"Version": strconv.Itoa(t.Version),
+			"Members": strconv.Itoa(len(t.Members)),
+		},
+	})
+	return nil
+}
+
+// Leave a team, its admins are notified in the background so they stop pushing the secrets
+// The local copy of the membership is removed even when an admin is unreachable
+func LeaveTeam(t team.Team) error {
+	id, err := getPeerIdentity()
+	if err != nil {
+		return err
+	}
+	if err := t.Delete(); err != nil {
+		return err
+	}
+	background(func() {
+		notifyTeamLeave(id, t)
+	})
+	return nil
+}
+
+func notifyTeamLeave(id identity.PeerIdentity, t team.Team) {
+	leave := TeamLeave{TeamUuid: t.Uuid}
+	for _, admin := range t.Admins {
+		if admin == id.Id {
+			continue
+		}
+		ctx, cancel := DialContext()
+		err := Dial(ctx, admin, PidTeamLeave, leave)
+		cancel()
+		if err != nil {
+			log.Errorf("Team %s leave not delivered to %s", t.Uuid, admin)
+			log.Error(err)
+		}
+	}
+}
+
+// Receive the leave of a member, the admin remove it and rotate the group key
+func teamLeaveProtocol(s network.Stream) {
+	log.Debug("Peer teamLeaveProtocol")
+	log.Debugf("remote are: %s\n", s.Conn().RemotePeer())
+	rw := newCodec(s)
+	leave := &TeamLeave{}
+	err := rw.Read(leave)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	_ = s.Close()
+
+	t, err := team.FetchTeam(leave.TeamUuid)
+	if err != nil {
+		log.Errorf("team not found with uuid %s", leave.TeamUuid)
+		return
+	}
+	sender := s.Conn().RemotePeer().Pretty()
+	if !t.IsMember(sender) {
+		return
+	}
+	id, err := getPeerIdentity()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if !t.IsAdmin(id.Id) {
+		log.Errorf("Team %s leave of %s refused, the local peer is not admin", t.Uuid, sender)
+		return
+	}
+	t.RemoveMember(sender)
+	t.Version++
+
+	// The member gone must not be able to read the next team secrets
+	if err := t.RotateGroupKey(id); err != nil {
+		log.Error(err)
+		return
+	}
+	if err := t.Sign(id); err != nil {
+		log.Error(err)
+		return
+	}
+	if err := t.Save(); err != nil {
+		log.Error(err)
+		return
+	}
+	_ = event.Write(event.Message{
+		Type: "team.member.left",
+		Data: map[string]string {
+			"Uuid": t.Uuid,
+			"Name": t.Name,
+			"Member": sender,
+		},
+	})
+	if err := PushTeam(t, nil); err != nil {
+		log.Error(err)
+	}
+}
+
+// Receive new version of secrets from another member of a team
+func teamSecretProtocol(s network.Stream) {
+	log.Debug("Peer teamSecretProtocol")
+	log.Debugf("remote are: %s\n", s.Conn().RemotePeer())
+	rw := newCodec(s)
+	teamSecret := &TeamSecret{}
+	err := rw.Read(teamSecret)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	_ = s.Close()
+
+	t, err := team.FetchTeam(teamSecret.TeamUuid)
+	if err != nil {
+		log.Errorf("team not found with uuid %s", teamSecret.TeamUuid)
+		return
+	}
+	sender := s.Conn().RemotePeer().Pretty()
+	if !t.IsMember(sender) {
+		log.Errorf("Team secret refused, %s is not member of team %s", sender, t.Uuid)
+		return
+	}
+	id, err := getPeerIdentity()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	groupKey, err := t.GetGroupKey(id)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	for _, secretData := range storeTeamSecrets(id, t, sender, groupKey, teamSecret.Secrets) {
+		_ = event.Write(event.Message{
+			Type: "team.secret.updated",
+			Data: map[string]string {
+				"Sender": sender,
+				"Uuid": t.Uuid,
+				"SecretPath": secretData.Namespace + "." + secretData.Key,
+			},
+		})
+	}
+}
+
+// Replace the owner key cipher of secrets with the group key cipher
+func cipherTeamSecrets(id identity.PeerIdentity, groupKey []byte, secrets []secret.Secret) ([]secret.Secret, error) {
+	result := make([]secret.Secret, 0, len(secrets))
+	for _, secretData := range secrets {
+		plainText, err := crypto.DecryptAes(id.GetChildKeyAsByte(), []byte(secretData.Value))
+		if err != nil {
+			return nil, err
+		}
+		cipherText, err := crypto.EncryptAes(groupKey, plainText)
+		if err != nil {
+			return nil, err
+		}
+		secretData.Value = string(cipherText)
+		result = append(result, secretData)
+	}
+	return result, nil
+}
+
+// Replace the group key cipher of secrets with the owner key cipher and save them locally
+// A secret that can not be deciphered with the current group key is refused, the others are still stored
+// A version not newer than the one already received from the same member is a delayed push, it is ignored
+// Return the secrets stored
+func storeTeamSecrets(id identity.PeerIdentity, t team.Team, sender string, groupKey []byte, secrets []secret.Secret) []secret.Secret {
+	updatesLock.Lock()
+	defer updatesLock.Unlock()
+	stored := make([]secret.Secret, 0, len(secrets))
+	for _, secretData := range secrets {
+		keyPath := secretData.Namespace + "." + secretData.Key
+		if !t.MatchNamespace(secretData.Namespace) {
+			log.Errorf("Team secret refused, %s is outside of team namespace %s", secretData.Namespace, t.Namespace)
+			continue
+		}
+		if !isNewerTeamVersion(keyPath, t.Uuid, sender, secretData.Version) {
+			log.Noticef("Team secret ignored, version %d of %s is not newer than the one received from %s", secretData.Version, keyPath, sender)
+			continue
+		}
+		plainText, err := crypto.DecryptAes(groupKey, []byte(secretData.Value))
+		if err != nil {
+			log.Errorf("Team secret %s refused: %s", keyPath, err)
+			continue
+		}
+		cipherText, err := crypto.EncryptAes(id.GetChildKeyAsByte(), plainText)
+		if err != nil {
+			log.Errorf("Team secret %s not stored: %s", keyPath, err)
+			continue
+		}
+		secretData.Value = string(cipherText)
+		secretData.Origin = newOrigin(sender, t.Uuid, keyPath, secretData.Version)
+		if err := secretData.CreateSecretQuietly(); err != nil {
+			log.Errorf("Team secret %s not stored: %s", keyPath, err)
+			continue
+		}
+		stored = append(stored, secretData)
+	}
+	return stored
+}
+
+// Check that the version pushed by a member is newer than the last one received from it
+// The versions of each member follow its own vault, the versions of two members are not compared
+func isNewerTeamVersion(keyPath string, teamUuid string, sender string, version int) bool {
+	stored, err := secret.FetchSecret([]byte(keyPath))
+	if err != nil || stored.Origin == nil || stored.Origin.ShareUuid != teamUuid || stored.Origin.Sender != sender {
+		return true
+	}
+	return version > stored.Origin.Version
+}
@@ -0,0 +1,149 @@
+package peer
+
+import (
+	"testing"
+
+	"github.com/PeerVault/PeerVault-Service/business/secret"
+	"github.com/PeerVault/PeerVault-Service/business/team"
+	"github.com/google/uuid"
+)
+
+func TestTeamInvitation(t *testing.T) {
+	instances := newInstances(t, "alice", "bob")
+	defer closeInstances(instances)
+	admin, member := instances[0], instances[1]
+
+	teamUuid := pushTestTeam(t, admin, "ops", member)
+	invitation := member.waitEvent(t, "team.invitation")
+	if invitation.Data["Uuid"] != teamUuid || invitation.Data["Signer"] != admin.QmPeerId {
+		t.Errorf("Team invitation event must carry the team and its admin, current: %v", invitation.Data)
+	}
+	info := member.waitEvent(t, "peer.info.updated")
+	if info.Data["PeerId"] != admin.QmPeerId || info.Data["Nickname"] != "alice" {
+		t.Errorf("Profile of the admin must be fetched in the background, current: %v", info.Data)
+	}
+
+	// Nothing is saved until the owner accept the invitation
+	member.run(func() {
+		if _, err := team.FetchTeam(teamUuid); err != team.ErrorTeamNotFound {
+			t.Errorf("Team must not be saved before the invitation is accepted, current: %v", err)
+		}
+		if _, err := secret.FetchSecret([]byte("ops.token")); err != secret.ErrorSecretNotFound {
+			t.Errorf("Team secrets must not be saved before the invitation is accepted, current: %v", err)
+		}
+		if err := RespondTeamInvitation(teamUuid, true); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := team.FetchTeam(teamUuid); err != nil {
+			t.Errorf("Team must be saved once the invitation is accepted, current: %v", err)
+		}
+		if _, err := secret.FetchSecret([]byte("ops.token")); err != nil {
+			t.Errorf("Team secrets must be saved once the invitation is accepted, current: %v", err)
+		}
+	})
+
+	// The admins remove the member leaving the team
+	member.run(func() {
+		teamData, err := team.FetchTeam(teamUuid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := LeaveTeam(teamData); err != nil {
+			t.Fatal(err)
+		}
+	})
+	admin.waitEvent(t, "team.member.left")
+	admin.run(func() {
+		teamData, err := team.FetchTeam(teamUuid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if teamData.IsMember(member.QmPeerId) || teamData.Version != 2 {
+			t.Errorf("Member leaving must be removed from the team, current: %v", teamData.Members)
+		}
+	})
+}
+
+func TestTeamInvitationNamespaceInUse(t *testing.T) {
+	instances := newInstances(t, "alice", "bob")
+	defer closeInstances(instances)
+	admin, member := instances[0], instances[1]
+
+	member.run(func() {
+		createTestSecret(t, "production", "database", "local")
+	})
+	teamUuid := pushTestTeam(t, admin, "production", member)
+	refused := member.waitEvent(t, "team.refused")
+	if refused.Data["Namespace"] != "production" {
+		t.Errorf("Team refused event must carry the namespace, current: %v", refused.Data)
+	}
+
+	member.run(func() {
+		if err := RespondTeamInvitation(teamUuid, true); err != ErrorTeamInvitationNotFound {
+			t.Errorf("Team owning a namespace used locally must be refused, current: %v", err)
+		}
+		if len(FetchTeamInvitations()) != 0 {
+			t.Errorf("Team owning a namespace used locally must not be kept as invitation")
+		}
+	})
+}
+
+func TestTeamSecretOutOfOrder(t *testing.T) {
+	instances := newInstances(t, "alice", "bob")
+	defer closeInstances(instances)
+	admin, member := instances[0], instances[1]
+
+	teamUuid := pushTestTeam(t, admin, "ops", member)
+	member.waitEvent(t, "team.invitation")
+	member.run(func() {
+		if err := RespondTeamInvitation(teamUuid, true); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// Each update is pushed by its own listener, the second one may reach the member first
+	admin.run(func() {
+		createTestSecret(t, "ops", "token", "second")
+		second, err := secret.FetchSecret([]byte("ops.token"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		createTestSecret(t, "ops", "token", "third")
+		third, err := secret.FetchSecret([]byte("ops.token"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pushTeamSecret(third)
+		pushTeamSecret(second)
+	})
+	member.waitEvent(t, "team.secret.updated")
+	member.run(func() {
+		received := fetchTestSecret(t, "ops.token")
+		if received.Value != "third" || received.Origin == nil || received.Origin.Version != 3 {
+			t.Errorf("Older team secret pushed later must be ignored, current: %s %v", received.Value, received.Origin)
+		}
+	})
+}
+
+func TestTeamOverlapping(t *testing.T) {
+	instances := newInstances(t, "alice")
+	defer closeInstances(instances)
+	admin := instances[0]
+
+	admin.run(func() {
+		teamData := team.Team{Uuid: uuid.New().String(), Name: "ops", Namespace: "ops.prod", Version: 1}
+		if err := teamData.Save(); err != nil {
+			t.Fatal(err)
+		}
+		for _, namespace := range []string{"ops", "ops.prod", "ops.prod.db"} {
+			if _, err := team.FetchTeamOverlapping(namespace); err != nil {
+				t.Errorf("Namespace %s must overlap the team on ops.prod, current: %v", namespace, err)
+			}
+		}
+		for _, namespace := range []string{"op", "ops.production", "staging"} {
+			if _, err := team.FetchTeamOverlapping(namespace); err != team.ErrorTeamNotFound {
+				t.Errorf("Namespace %s must not overlap the team on ops.prod, current: %v", namespace, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,430 @@
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+//
+// Peer package will manage all the communication with
+// the EXTERNAL Peers (libp2p) to exchange password with other Peer
+// same of different owner
+//
+// Vault will focus on Protocol regarding the replication of the vault between the devices of the owner
+package peer
+
+import (
+	"fmt"
+	"github.com/PeerVault/PeerVault-Service/business/device"
+	"github.com/PeerVault/PeerVault-Service/business/secret"
+	"github.com/PeerVault/PeerVault-Service/business/vault"
+	"github.com/PeerVault/PeerVault-Service/communication/event"
+	"github.com/PeerVault/PeerVault-Service/crypto"
+	"github.com/PeerVault/PeerVault-Service/identity"
+	"github.com/libp2p/go-libp2p-core/network"
+	"strconv"
+)
+
+// VaultSync is sent to another device to receive the changes not known yet
+type VaultSync struct {
+	Known map[string]int // Latest sequence received from each origin device
+}
+
+// VaultSyncResult count the changes applied from the other devices
+type VaultSyncResult struct {
+	Devices int
+	Updated int
+	Conflicts int
+}
+
+// Record the change of a local secret in the change log and push it to the other devices
+func recordVaultChange(keyPath string, secretData *secret.Secret) {
+	id, err := getPeerIdentity()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if id.VaultKey == "" {
+		log.Debug("Device has no vault key, the change is not replicated")
+		return
+	}
+
+	var cipherSecret *secret.Secret
+	if secretData != nil {
+		s, err := toVaultKey(id, *secretData)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		cipherSecret = &s
+	}
+	change, err := vault.RecordLocal(id.Id, keyPath, cipherSecret)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	go pushVaultChanges(id, []vault.Change{change})
+}
+
+// Record the secrets stored before the replication was available, so a new device receive them on its first sync
+func bootstrapVault() {
+	// Values are required to cipher the secrets with the vault key
+	secrets, err := secret.FetchSecretsMatching("*")
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	for _, s := range secrets {
+		keyPath := s.Namespace + "." + s.Key
+		entry, err := vault.FetchEntry(keyPath)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		if entry.ChangeKey == "" {
+			secretData := s
+			recordVaultChange(keyPath, &secretData)
+		}
+	}
+}
+
+// Request the changes not known yet to every other device of the owner
+func SyncVault() (VaultSyncResult, error) {
+	result := VaultSyncResult{}
+	id, err := getPeerIdentity()
+	if err != nil {
+		return result, err
+	}
+	if id.VaultKey == "" {
+		return result, device.ErrorNoMasterProof
+	}
+	l, err := device.FetchDeviceList(id)
+	if err != nil {
+		return result, err
+	}
+
+	for _, d := range l.Devices {
+		if d.PeerId == id.Id {
+			continue
+		}
+		known, err := vault.Known()
+		if err != nil {
+			return result, err
+		}
+		var changes []vault.Change
+		ctx, cancel := DialContext()
+		err = DialRequest(ctx, d.PeerId, PidVaultSync, VaultSync{Known: known}, &changes)
+		cancel()
+		if err != nil && err != ErrorNoReply {
+			log.Errorf("Vault not synchronized with %s: %s", d.PeerId, err)
+			continue
+		}
+		updated, conflicts := applyVaultChanges(id, d.PeerId, changes)
+		result.Devices++
+		result.Updated += updated
+		result.Conflicts += conflicts
+	}
+
+	_ = event.Write(event.Message{
+		Type: "vault.synced",
+		Data: map[string]string {
+			"Devices": strconv.Itoa(result.Devices),
+			"Updated": strconv.Itoa(result.Updated),
+			"Conflicts": strconv.Itoa(result.Conflicts),
+		},
+	})
+	return result, nil
+}
+
+// Synchronize the vault in the background, every device is dialed in turn and the result is sent as event
+func StartSyncVault() error {
+	id, err := getPeerIdentity()
+	if err != nil {
+		return err
+	}
+	if id.VaultKey == "" {
+		return device.ErrorNoMasterProof
+	}
+	background(func() {
+		if _, err := SyncVault(); err != nil {
+			log.Error(err)
+		}
+	})
+	return nil
+}
+
+// Send changes to the other devices of the owner
+func pushVaultChanges(id identity.PeerIdentity, changes []vault.Change) {
+	l, err := device.FetchDeviceList(id)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	for _, d := range l.Devices {
+		if d.PeerId == id.Id {
+			continue
+		}
+		ctx, cancel := DialContext()
+		err := Dial(ctx, d.PeerId, PidVaultChange, changes)
+		cancel()
+		if err != nil {
+			log.Errorf("Vault changes not delivered to %s, they will be sent on its next sync", d.PeerId)
+			log.Error(err)
+		}
+	}
+}
+
+// Apply the changes received from a device, return the count of secrets updated and conflicts
+func applyVaultChanges(id identity.PeerIdentity, sender string, changes []vault.Change) (int, int) {
+	updated, conflicts := 0, 0
+	for _, change := range changes {
+		if change.Origin == id.Id {
+			continue
+		}
+		local, err := vault.FetchEntry(change.KeyPath)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		result, err := vault.Apply(change)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		switch result {
+		case vault.ApplyUpdated:
+			if err := replicateChange(id, change); err != nil {
+				log.Error(err)
+				continue
+			}
+			updated++
+		case vault.ApplyConflict:
+			conflict, err := keepConflict(id, local, change)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			if conflict {
+				conflicts++
+			}
+		}
+	}
+
+	if updated > 0 || conflicts > 0 {
+		_ = event.Write(event.Message{
+			Type: "vault.synced",
+			Data: map[string]string {
+				"PeerId": sender,
+				"Updated": strconv.Itoa(updated),
+				"Conflicts": strconv.Itoa(conflicts),
+			},
+		})
+	}
+	return updated, conflicts
+}
+
+// Replace the local secret by the version of the change
+func replicateChange(id identity.PeerIdentity, change vault.Change) error {
+	if change.Deleted || change.Secret == nil {
+		return secret.DeleteSecretReplicated(change.KeyPath)
+	}
+	s, err := fromVaultKey(id, *change.Secret)
+	if err != nil {
+		return err
+	}
+	return s.ReplicateSecret()
+}
+
+// Keep both versions of a secret changed concurrently on two devices
+// Every device choose the same version for the key path, an update win over a delete
+// and the greatest value win between two updates, the other version is saved next to it
+// When the local version win, a new local change let the other devices converge on it
+func keepConflict(id identity.PeerIdentity, entry vault.Entry, change vault.Change) (bool, error) {
+	var remote *secret.Secret
+	if change.Secret != nil {
+		s, err := fromVaultKey(id, *change.Secret)
+		if err != nil {
+			return false, err
+		}
+		remote = &s
+	}
+	var local *secret.Secret
+	s, err := secret.FetchSecret([]byte(change.KeyPath))
+	if err != nil && err != secret.ErrorSecretNotFound {
+		return false, err
+	}
+	if err == nil {
+		local = &s
+	}
+
+	switch {
+	case remote == nil && local == nil:
+		// Deleted on both devices
+		return false, nil
+	case local == nil:
+		return false, remote.ReplicateSecret()
+	case remote == nil:
+		return false, keepLocal(id, change.KeyPath, *local)
+	case sameValue(id, *local, *remote):
+		return false, nil
+	}
+
+	kept, other, otherOrigin, otherCounter := *local, *remote, change.Origin, change.Clock[change.Origin]
+	if plainValue(id, *remote) > plainValue(id, *local) {
+		// A secret never replicated yet was changed by the device itself
+		localOrigin := entry.Origin()
+		if localOrigin == "" {
+			localOrigin = id.Id
+		}
+		kept, other, otherOrigin, otherCounter = *remote, *local, localOrigin, entry.Clock[localOrigin]
+		if err := kept.ReplicateSecret(); err != nil {
+			return false, err
+		}
+	} else if err := keepLocal(id, change.KeyPath, kept); err != nil {
+		return false, err
+	}
+
+	// Named after the change of the other version, so every device save it at the same key path
+	if len(otherOrigin) > 6 {
+		otherOrigin = otherOrigin[len(otherOrigin)-6:]
+	}
+	other.Key = fmt.Sprintf("%s-conflict-%s-%d", other.Key, otherOrigin, otherCounter)
+	if err := other.CreateSecretQuietly(); err != nil {
+		return false, err
+	}
+	_ = event.Write(event.Message{
+		Type: "vault.conflict",
+		Data: map[string]string {
+			"KeyPath": change.KeyPath,
+			"ConflictKeyPath": other.Namespace + "." + other.Key,
+			"Origin": change.Origin,
+		},
+	})
+	return true, nil
+}
+
+// Record the local version again, its clock is after both versions in conflict
+func keepLocal(id identity.PeerIdentity, keyPath string, s secret.Secret) error {
+	cipherSecret, err := toVaultKey(id, s)
+	if err != nil {
+		return err
+	}
+	change, err := vault.RecordLocal(id.Id, keyPath, &cipherSecret)
+	if err != nil {
+		return err
+	}
+	go pushVaultChanges(id, []vault.Change{change})
+	return nil
+}
+
+func plainValue(id identity.PeerIdentity, s secret.Secret) string {
+	plainText, err := crypto.DecryptAes(id.GetChildKeyAsByte(), []byte(s.Value))
+	if err != nil {
+		return ""
+	}
+	return string(plainText)
+}
+
+func sameValue(id identity.PeerIdentity, a secret.Secret, b secret.Secret) bool {
+	plainA, err := crypto.DecryptAes(id.GetChildKeyAsByte(), []byte(a.Value))
+	if err != nil {
+		return false
+	}
+	plainB, err := crypto.DecryptAes(id.GetChildKeyAsByte(), []byte(b.Value))
+	if err != nil {
+		return false
+	}
+	return string(plainA) == string(plainB)
+}
+
+// Cipher the value with the vault key, shared by every device derived from the same seed
+func toVaultKey(id identity.PeerIdentity, s secret.Secret) (secret.Secret, error) {
+	plainText, err := crypto.DecryptAes(id.GetChildKeyAsByte(), []byte(s.Value))
+	if err != nil {
+		return s, err
+	}
+	cipherText, err := crypto.EncryptAes(id.GetVaultKeyAsByte(), plainText)
+	if err != nil {
+		return s, err
+	}
+	s.Value = string(cipherText)
+	return s, nil
+}
+
+// Cipher the value with the child key of the device, as every local secret
+func fromVaultKey(id identity.PeerIdentity, s secret.Secret) (secret.Secret, error) {
+	plainText, err := crypto.DecryptAes(id.GetVaultKeyAsByte(), []byte(s.Value))
+	if err != nil {
+		return s, err
+	}
+	cipherText, err := crypto.EncryptAes(id.GetChildKeyAsByte(), plainText)
+	if err != nil {
+		return s, err
+	}
+	s.Value = string(cipherText)
+	return s, nil
+}
+
+// Only the devices in the device list of the owner can replicate the vault
+func isOwnerDevice(id identity.PeerIdentity, QmPeerId string) bool {
+	l, err := device.FetchDeviceList(id)
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	return l.HasDevice(QmPeerId)
+}
+
+// Reply with the changes not known by the other device
+func vaultSyncProtocol(s network.Stream) {
+	log.Debug("Peer vaultSyncProtocol")
+	log.Debugf("remote are: %s\n", s.Conn().RemotePeer())
+	defer s.Close()
+	rw := newCodec(s)
+	sync := VaultSync{}
+	if err := rw.Read(&sync); err != nil {
+		log.Error(err)
+		return
+	}
+
+	id, err := getPeerIdentity()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	remote := s.Conn().RemotePeer().Pretty()
+	if !isOwnerDevice(id, remote) {
+		log.Errorf("Vault sync refused, %s is not a device of the owner", remote)
+		return
+	}
+	changes, err := vault.ChangesSince(sync.Known)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if err := rw.Write(changes); err != nil {
+		log.Error(err)
+	}
+}
+
+// Receive the changes pushed by another device
+func vaultChangeProtocol(s network.Stream) {
+	log.Debug("Peer vaultChangeProtocol")
+	log.Debugf("remote are: %s\n", s.Conn().RemotePeer())
+	rw := newCodec(s)
+	var changes []vault.Change
+	err := rw.Read(&changes)
+	_ = s.Close()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	id, err := getPeerIdentity()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	remote := s.Conn().RemotePeer().Pretty()
+	if !isOwnerDevice(id, remote) {
+		log.Errorf("Vault changes refused, %s is not a device of the owner", remote)
+		return
+	}
+	applyVaultChanges(id, remote, changes)
+}
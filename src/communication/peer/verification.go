@@ -0,0 +1,329 @@
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+//
+// Peer package will manage all the communication with
+// the EXTERNAL Peers (libp2p) to exchange password with other Peer
+// same of different owner
+//
+// Verification will focus on Protocol regarding the short authentication string
+// compared by both users before trusting a contact
+package peer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/PeerVault/PeerVault-Service/business/contact"
+	"github.com/PeerVault/PeerVault-Service/communication/event"
+	"github.com/PeerVault/PeerVault-Service/crypto"
+	"github.com/google/uuid"
+	"github.com/libp2p/go-libp2p-core/network"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	verificationDelay = 10 * time.Minute // Delay for both users to compare the short authentication string
+)
+
+// Verification in progress with a peer, the short authentication string is the same on both sides
+// unless someone stands between the two peers
+type Verification struct {
+	Uuid string
+	PeerId string
+	Digits string
+	Emoji []string
+	Confirmed bool // Confirmed by the local user
+	RemoteConfirmed bool // Confirmed by the user of the remote peer
+	Expiration string
+}
+
+// VerifyMessage is exchanged on a single stream, the initiator commit to its nonce,
+// the responder reveal its nonce, then the initiator reveal the nonce committed
+type VerifyMessage struct {
+	Uuid string
+	Commitment string `json:",omitempty"`
+	Nonce string `json:",omitempty"`
+}
+
+type VerifyConfirm struct {
+	Uuid string
+	Match bool
+}
+
+var (
+	verifications = make(map[string]Verification)
+	verificationsLock sync.Mutex // Verifications are changed by the stream handlers and the API
+)
+
+// Start the verification of a peer, the short authentication string is notified on both sides
+func StartVerification(QmPeerId string) (Verification, error) {
+	ctx, cancel := RequestContext()
+	defer cancel()
+	stream, err := openStream(ctx, QmPeerId, PidVerify)
+	if err != nil {
+		return Verification{}, err
+	}
+	defer stream.Close()
+	setStreamDeadline(ctx, stream)
+	rw := newCodec(stream)
+
+	nonce, err := newNonce()
+	if err != nil {
+		return Verification{}, err
+	}
+	message := VerifyMessage{
+		Uuid: uuid.New().String(),
+		Commitment: base64.StdEncoding.EncodeToString(crypto.Commitment(nonce)),
+	}
+	if err := rw.Write(message); err != nil {
+		return Verification{}, streamError(ctx, QmPeerId, err)
+	}
+	reply := VerifyMessage{}
+	if err := rw.Read(&reply); err != nil {
+		return Verification{}, streamError(ctx, QmPeerId, err)
+	}
+	remoteNonce, err := base64.StdEncoding.DecodeString(reply.Nonce)
+	if err != nil || reply.Uuid != message.Uuid {
+		return Verification{}, ErrorVerificationFailed
+	}
+	if err := rw.Write(VerifyMessage{Uuid: message.Uuid, Nonce: base64.StdEncoding.EncodeToString(nonce)}); err != nil {
+		return Verification{}, streamError(ctx, QmPeerId, err)
+	}
+
+	conn := stream.Conn()
+	localKey, err := conn.LocalPrivateKey().GetPublic().Bytes()
+	if err != nil {
+		return Verification{}, err
+	}
+	remoteKey, err := conn.RemotePublicKey().Bytes()
+	if err != nil {
+		return Verification{}, err
+	}
+	return newVerification(message.Uuid, QmPeerId, localKey, remoteKey, nonce, remoteNonce), nil
+}
+
+// Confirm, or deny, that the short authentication string displayed is the same on the remote peer
+func ConfirmVerification(uuid string, match bool) error {
+	v, ok := getVerification(uuid)
+	if !ok {
+		return ErrorVerificationNotFound
+	}
+	confirm := VerifyConfirm{Uuid: uuid, Match: match}
+	ctx, cancel := RequestContext()
+	defer cancel()
+	if err := Dial(ctx, v.PeerId, PidVerifyConfirm, confirm); err != nil {
+		return err
+	}
+	if !match {
+		failVerification(v)
+		return nil
+	}
+	// The remote confirmation may have been received meanwhile
+	v, ok = updateVerification(uuid, func(v *Verification) {
+		v.Confirmed = true
+	})
+	if !ok {
+		return ErrorVerificationNotFound
+	}
+	if v.RemoteConfirmed {
+		return completeVerification(v)
+	}
+	return nil
+}
+
+// List the verifications in progress
+func FetchVerifications() []Verification {
+	verificationsLock.Lock()
+	defer verificationsLock.Unlock()
+	list := []Verification{}
+	for uuid, v := range verifications {
+		if isVerificationExpired(v) {
+			delete(verifications, uuid)
+			continue
+		}
+		list = append(list, v)
+	}
+	return list
+}
+
+// Receive a verification started by another peer
+func verifyProtocol(s network.Stream) {
+	log.Debug("Peer verifyProtocol")
+	log.Debugf("remote are: %s\n", s.Conn().RemotePeer())
+	defer s.Close()
+	rw := newCodec(s)
+
+	message := VerifyMessage{}
+	if err := rw.Read(&message); err != nil {
+		log.Error(err)
+		return
+	}
+	commitment, err := base64.StdEncoding.DecodeString(message.Commitment)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if err := rw.Write(VerifyMessage{Uuid: message.Uuid, Nonce: base64.StdEncoding.EncodeToString(nonce)}); err != nil {
+		log.Error(err)
+		return
+	}
+	reveal := VerifyMessage{}
+	if err := rw.Read(&reveal); err != nil {
+		log.Error(err)
+		return
+	}
+	remoteNonce, err := base64.StdEncoding.DecodeString(reveal.Nonce)
+	if err != nil || reveal.Uuid != message.Uuid || !bytes.Equal(crypto.Commitment(remoteNonce), commitment) {
+		log.Error("Verification corrupted, the nonce revealed does not match its commitment")
+		return
+	}
+
+	conn := s.Conn()
+	localKey, err := conn.LocalPrivateKey().GetPublic().Bytes()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	remoteKey, err := conn.RemotePublicKey().Bytes()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	newVerification(message.Uuid, conn.RemotePeer().Pretty(), remoteKey, localKey, remoteNonce, nonce)
+}
+
+// Receive the confirmation of the remote user
+func verifyConfirmProtocol(s network.Stream) {
+	log.Debug("Peer verifyConfirmProtocol")
+	log.Debugf("remote are: %s\n", s.Conn().RemotePeer())
+	rw := newCodec(s)
+	confirm := VerifyConfirm{}
+	err := rw.Read(&confirm)
+	_ = s.Close()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	v, ok := getVerification(confirm.Uuid)
+	if !ok || v.PeerId != s.Conn().RemotePeer().Pretty() {
+		log.Errorf("verification not found with uuid %s", confirm.Uuid)
+		return
+	}
+	if !confirm.Match {
+		failVerification(v)
+		return
+	}
+	v, ok = updateVerification(v.Uuid, func(v *Verification) {
+		v.RemoteConfirmed = true
+	})
+	if ok && v.Confirmed {
+		if err := completeVerification(v); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// Derive and keep the short authentication string, then notify the client to display it
+func newVerification(uuid string, QmPeerId string, initiatorKey []byte, responderKey []byte, initiatorNonce []byte, responderNonce []byte) Verification {
+	digits, emoji := crypto.ShortAuthenticationString(initiatorKey, responderKey, initiatorNonce, responderNonce)
+	v := Verification{
+		Uuid: uuid,
+		PeerId: QmPeerId,
+		Digits: digits,
+		Emoji: emoji,
+		Expiration: time.Now().UTC().Add(verificationDelay).Format(time.RFC3339),
+	}
+	verificationsLock.Lock()
+	verifications[uuid] = v
+	verificationsLock.Unlock()
+	_ = event.Write(event.Message{
+		Type: "contact.verification.sas",
+		Data: map[string]string {
+			"PeerId": v.PeerId,
+			"Uuid": v.Uuid,
+			"Digits": v.Digits,
+			"Emoji": strings.Join(v.Emoji, " "),
+			"Expiration": v.Expiration,
+		},
+	})
+	return v
+}
+
+func completeVerification(v Verification) error {
+	deleteVerification(v.Uuid)
+	c, err := contact.MarkVerified(v.PeerId)
+	if err != nil {
+		return err
+	}
+	_ = event.Write(event.Message{
+		Type: "contact.verified",
+		Data: map[string]string {
+			"PeerId": c.PeerId,
+			"Nickname": c.Nickname,
+			"Uuid": v.Uuid,
+		},
+	})
+	return nil
+}
+
+func failVerification(v Verification) {
+	deleteVerification(v.Uuid)
+	_ = event.Write(event.Message{
+		Type: "contact.verification.failed",
+		Data: map[string]string {
+			"PeerId": v.PeerId,
+			"Uuid": v.Uuid,
+		},
+	})
+}
+
+func isVerificationExpired(v Verification) bool {
+	expiration, err := time.Parse(time.RFC3339, v.Expiration)
+	return err != nil || time.Now().UTC().After(expiration)
+}
+
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, 32)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+// Verification in progress, an expired one is removed
+func getVerification(uuid string) (Verification, bool) {
+	verificationsLock.Lock()
+	defer verificationsLock.Unlock()
+	v, ok := verifications[uuid]
+	if !ok || isVerificationExpired(v) {
+		delete(verifications, uuid)
+		return v, false
+	}
+	return v, true
+}
+
+// Change the verification in progress, the confirmations of both sides are never lost
+func updateVerification(uuid string, update func(v *Verification)) (Verification, bool) {
+	verificationsLock.Lock()
+	defer verificationsLock.Unlock()
+	v, ok := verifications[uuid]
+	if !ok {
+		return v, false
+	}
+	update(&v)
+	verifications[uuid] = v
+	return v, true
+}
+
+func deleteVerification(uuid string) {
+	verificationsLock.Lock()
+	defer verificationsLock.Unlock()
+	delete(verifications, uuid)
+}
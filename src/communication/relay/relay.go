@@ -0,0 +1,219 @@
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+//
+// Package relay will manage the embedded circuit relay, so a team can host its own relay
+// The relay mode run without owner nor vault, only the libp2p node relaying the peers
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	pvCrypto "github.com/PeerVault/PeerVault-Service/crypto"
+	"github.com/libp2p/go-libp2p"
+	circuit "github.com/libp2p/go-libp2p-circuit"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/op/go-logging"
+)
+
+var (
+	log = logging.MustGetLogger("peerVaultLogger")
+	node host.Host
+	config Config
+	startedAt time.Time
+	accepted int64
+	refused int64
+)
+
+const (
+	DefaultListenAddr = "/ip4/0.0.0.0/tcp/23003" // Fixed port so the peers can configure the relay multiaddr
+)
+
+// Config of the relay given by the command line
+type Config struct {
+	ListenAddrs []string
+	KeyPath string // File of the relay private key, the PeerId of the relay stay the same after restart
+	SwarmKeyPath string // Swarm key of the private network relayed, empty for the public network
+	Allowlist []string // QmPeerId allowed to use the relay, empty to allow every peer
+	MaxConnections int // 0 for unlimited
+	MaxCircuits int // 0 keep the default limit of libp2p
+}
+
+// Stats of the relay
+type Stats struct {
+	PeerId string
+	Addrs []string
+	StartedAt string
+	PrivateNetwork bool
+	Connections int
+	Circuits int // Circuits currently relayed
+	Accepted int64 // Connections accepted since the start
+	Refused int64 // Connections refused by the allowlist or the limits since the start
+}
+
+// Start the relay hop node, the process never return
+func Listen(c Config) {
+	config = c
+	pvt, err := loadKey(config.KeyPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config.MaxCircuits > 0 {
+		circuit.HopStreamLimit = config.MaxCircuits
+	}
+
+	options := []libp2p.Option{
+		libp2p.Identity(pvt),
+		libp2p.ListenAddrStrings(config.ListenAddrs...),
+		libp2p.EnableRelay(circuit.OptHop),
+	}
+	if config.SwarmKeyPath != "" {
+		protector, err := pvCrypto.NewSwarmProtector(config.SwarmKeyPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		options = append(options, libp2p.PrivateNetwork(protector))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	node, err = libp2p.New(ctx, options...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	node.Network().Notify(&network.NotifyBundle{
+		ConnectedF: gate,
+	})
+	gateStreams(node.Network())
+	startedAt = time.Now().UTC()
+
+	log.Info("listen as relay")
+	for _, addr := range node.Addrs() {
+		log.Infof("%s/p2p/%s", addr, node.ID().Pretty())
+	}
+
+	select {}
+}
+
+// Close the connections of the peers not allowed, or above the connection limit
+func gate(n network.Network, c network.Conn) {
+	if !isAllowed(c.RemotePeer()) {
+		log.Debugf("Relay refused to %s, not in the allowlist", c.RemotePeer().Pretty())
+		atomic.AddInt64(&refused, 1)
+		go c.Close()
+		return
+	}
+	if config.MaxConnections > 0 && len(n.Conns()) > config.MaxConnections {
+		log.Warningf("Relay refused to %s, %d connections reached", c.RemotePeer().Pretty(), config.MaxConnections)
+		atomic.AddInt64(&refused, 1)
+		go c.Close()
+		return
+	}
+	atomic.AddInt64(&accepted, 1)
+}
+
+// Reset the inbound streams of the peers not allowed
+// The connection is closed by gate after the notification, a hop stream may be opened before
+func gateStreams(n network.Network) {
+	swarm, ok := n.(interface{ StreamHandler() network.StreamHandler })
+	if !ok {
+		log.Warning("Relay cannot gate the inbound streams, only the connections are closed")
+		return
+	}
+	handler := swarm.StreamHandler()
+	n.SetStreamHandler(func(s network.Stream) {
+		if !isAllowed(s.Conn().RemotePeer()) {
+			log.Debugf("Relay reset stream of %s, not in the allowlist", s.Conn().RemotePeer().Pretty())
+			_ = s.Reset()
+			return
+		}
+		handler(s)
+	})
+}
+
+func isAllowed(id peer.ID) bool {
+	if len(config.Allowlist) == 0 {
+		return true
+	}
+	for _, allowed := range config.Allowlist {
+		if allowed == id.Pretty() {
+			return true
+		}
+	}
+	return false
+}
+
+// Load the private key of the relay, created the first time
+// Without key path an ephemeral key is used and the PeerId change at every start
+func loadKey(keyPath string) (crypto.PrivKey, error) {
+	if keyPath == "" {
+		log.Warning("No relay key given with --relay-key, the PeerId of the relay change at every start")
+		pvt, _, err := crypto.GenerateKeyPair(crypto.Ed25519, 0)
+		return pvt, err
+	}
+	buf, err := ioutil.ReadFile(keyPath)
+	if err == nil {
+		return crypto.UnmarshalPrivateKey(buf)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	pvt, _, err := crypto.GenerateKeyPair(crypto.Ed25519, 0)
+	if err != nil {
+		return nil, err
+	}
+	buf, err = crypto.MarshalPrivateKey(pvt)
+	if err != nil {
+		return nil, err
+	}
+	return pvt, ioutil.WriteFile(keyPath, buf, 0600)
+}
+
+func GetStats() Stats {
+	stats := Stats{
+		Accepted: atomic.LoadInt64(&accepted),
+		Refused: atomic.LoadInt64(&refused),
+	}
+	if node == nil {
+		return stats
+	}
+	stats.PeerId = node.ID().Pretty()
+	stats.StartedAt = startedAt.Format(time.RFC3339)
+	stats.PrivateNetwork = config.SwarmKeyPath != ""
+	for _, addr := range node.Addrs() {
+		stats.Addrs = append(stats.Addrs, addr.String() + "/p2p/" + node.ID().Pretty())
+	}
+	for _, c := range node.Network().Conns() {
+		stats.Connections++
+		for _, s := range c.GetStreams() {
+			// Each circuit is made of the hop stream of the source and the stop stream opened to the destination
+			if s.Protocol() == circuit.ProtoID && s.Stat().Direction == network.DirOutbound {
+				stats.Circuits++
+			}
+		}
+	}
+	return stats
+}
+
+// ControllerStats Statistics of the relay
+// GET : Connections, circuits relayed and refused connections
+func ControllerStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	resultJSON, _ := json.Marshal(GetStats())
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resultJSON)
+}
@@ -13,6 +13,7 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -122,6 +123,22 @@ func IsChildFromMaster(child *bip32.Key, master *bip32.Key) bool {
 	return bytes.Equal(parentFP[:4], child.PublicKey().FingerPrint)
 }
 
+// Create the vault key shared by every device of the owner
+// Derived from the master key, it is the same on each device restored from the seed
+func CreateVaultKey(master *bip32.Key) []byte {
+	mac := hmac.New(sha256.New, master.Key)
+	mac.Write([]byte("PeerVault vault key"))
+	return mac.Sum(nil)
+}
+
+// Create the key of the backups from the vault key
+// Backups stored on other peers are not readable with the vault key alone
+func CreateBackupKey(vaultKey []byte) []byte {
+	mac := hmac.New(sha256.New, vaultKey)
+	mac.Write([]byte("PeerVault backup key"))
+	return mac.Sum(nil)
+}
+
 // Convert a Secp256 BIP32 Child key intp Crypto Libp2p PrivKey struct
 // Node key also known as Device Key will be used to identify a specific peer
 func BipKeyToLibp2p(child *bip32.Key) (crypto.PrivKey, error) {
@@ -186,6 +203,47 @@ func DecryptAes(key []byte, in []byte) ([]byte, error) {
 	return plainText, nil
 }
 
+//
+// Short Authentication String
+//
+var sasEmoji = []string{
+	"🐶", "🐱", "🦁", "🐎", "🦄", "🐷", "🐘", "🐰",
+	"🐼", "🐓", "🐧", "🐢", "🐟", "🐙", "🦋", "🌷",
+	"🌳", "🌵", "🍄", "🌏", "🌙", "☁️", "🔥", "🍌",
+	"🍎", "🍓", "🌽", "🍕", "🎂", "❤️", "😀", "🤖",
+	"🎩", "👓", "🔧", "🎅", "👍", "☂️", "⌛", "⏰",
+	"🎁", "💡", "📕", "✏️", "📎", "✂️", "🔒", "🔑",
+	"🔨", "☎️", "🏁", "🚂", "🚲", "✈️", "🚀", "🏆",
+	"⚽", "🎸", "🎺", "🔔", "⚓", "🎧", "📁", "📌",
+}
+
+// Commitment sent before revealing a nonce, so the nonce cannot be chosen after the other one is known
+func Commitment(nonce []byte) []byte {
+	commitment := sha256.Sum256(nonce)
+	return commitment[:]
+}
+
+// Derive the short authentication string compared by both users, as 6 digits and 5 emoji
+// Both identity keys and both nonces must be given in the same order on each side
+func ShortAuthenticationString(initiatorKey []byte, responderKey []byte, initiatorNonce []byte, responderNonce []byte) (string, []string) {
+	hasher := sha256.New()
+	for _, part := range [][]byte{initiatorKey, responderKey, initiatorNonce, responderNonce} {
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(part)))
+		hasher.Write(length)
+		hasher.Write(part)
+	}
+	hash := hasher.Sum(nil)
+
+	digits := fmt.Sprintf("%06d", binary.BigEndian.Uint32(hash[0:4]) % 1000000)
+	bits := binary.BigEndian.Uint64(hash[4:12])
+	var emoji []string
+	for i := 0; i < 5; i++ {
+		emoji = append(emoji, sasEmoji[(bits >> uint(58 - 6 * i)) & 63])
+	}
+	return digits, emoji
+}
+
 //
 // Hashes
 //
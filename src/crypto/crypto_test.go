@@ -102,4 +102,21 @@ func TestEncryptAes(t *testing.T) {
 	}
 
 	t.Logf("Decrypted output %s", decryptedValue)
-}
\ No newline at end of file
+}
+
+func TestShortAuthenticationString(t *testing.T) {
+	digits, emoji := ShortAuthenticationString([]byte("alice"), []byte("bob"), []byte("nonce1"), []byte("nonce2"))
+	if len(digits) != 6 || len(emoji) != 5 {
+		t.Errorf("SAS must be 6 digits and 5 emoji, current: %s %v", digits, emoji)
+	}
+
+	sameDigits, _ := ShortAuthenticationString([]byte("alice"), []byte("bob"), []byte("nonce1"), []byte("nonce2"))
+	if digits != sameDigits {
+		t.Errorf("SAS must be the same on both sides. Expected %s, Actual %s", digits, sameDigits)
+	}
+
+	otherDigits, _ := ShortAuthenticationString([]byte("mallory"), []byte("bob"), []byte("nonce1"), []byte("nonce2"))
+	if digits == otherDigits {
+		t.Errorf("SAS must change with the identity keys, current: %s", digits)
+	}
+}
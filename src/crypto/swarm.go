@@ -0,0 +1,40 @@
+// Copyright (c) 2020, Pierre Tomasina
+// Use of this source code is governed by a GNU AGPLv3
+// license that can be found in the LICENSE file.
+//
+// Crypto package will manage the cryptography of the Vault
+// - Swarm key of the libp2p private network shared by the nodes of a team
+package crypto
+
+import (
+	"io"
+	"os"
+
+	ipnet "github.com/libp2p/go-libp2p-core/pnet"
+	pnet "github.com/libp2p/go-libp2p-pnet"
+)
+
+// Protector of the private network, the nodes without the same swarm key cannot complete a handshake
+func NewSwarmProtector(swarmKeyPath string) (ipnet.Protector, error) {
+	f, err := os.Open(swarmKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return pnet.NewProtector(f)
+}
+
+// Create the swarm key file of a new private network, an existing file is never replaced
+func CreateSwarmKey(swarmKeyPath string) error {
+	key, err := pnet.GenerateV1PSK()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(swarmKeyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, key)
+	return err
+}
@@ -45,6 +45,11 @@ func Close() {
 	_ = dbConnectionRw.Close()
 }
 
+// Use a database already opened, such as the database of each peer in the tests
+func SetConnection(db *bbolt.DB) {
+	dbConnectionRw = db
+}
+
 func GetConnection() (*bbolt.DB, error) {
 	if dbConnectionRw == nil {
 		if err := Open(); err != nil {
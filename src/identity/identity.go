@@ -6,10 +6,13 @@
 package identity
 
 import (
+	"bytes"
 	b64 "encoding/base64"
 	"encoding/json"
+	"errors"
 	"github.com/PeerVault/PeerVault-Service/crypto"
 	"github.com/op/go-logging"
+	"github.com/tyler-smith/go-bip32"
 
 	p2pCrypto "github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/peer"
@@ -17,6 +20,7 @@ import (
 
 var (
 	log = logging.MustGetLogger("peerVaultLogger")
+	ErrorMasterProof = errors.New("The device is not derived from the master key of the owner")
 )
 
 type PeerIdentity struct {
@@ -25,6 +29,16 @@ type PeerIdentity struct {
 	ChildKey string // Key represents a bip32 extended key 33bytes into string
 	PrivKey  string
 	PubKey   string
+	MasterProof *MasterProof `json:",omitempty"` // Only for devices created or restored from the seed with master proof
+	VaultKey string `json:",omitempty"` // Key shared by the devices of the owner to replicate the vault
+}
+
+// MasterProof prove that the device key is a child of the owner master key,
+// the master key itself is never kept on the device
+type MasterProof struct {
+	MasterPubKey string // Compressed public key of the master key
+	ChildPubKey string // Serialized bip32 public key of the device, its fingerprint link it to the master key
+	Signature string // Signature of the peer id by the master key
 }
 
 func GetIdentity(QmPeerId string) (PeerIdentity, error) {
@@ -63,6 +77,29 @@ func (p PeerIdentity) GetCryptoPrivateKey() (p2pCrypto.PrivKey, error) {
 	return pvtKey, nil
 }
 
+// Sign data with the private key of the peer
+func (p PeerIdentity) Sign(data []byte) ([]byte, error) {
+	pvtKey, err := p.GetCryptoPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	return pvtKey.Sign(data)
+}
+
+// Verify the signature of data made by the private key of QmPeerId
+// The public key is extracted from the peer id itself
+func Verify(QmPeerId string, data []byte, signature []byte) (bool, error) {
+	id, err := peer.IDB58Decode(QmPeerId)
+	if err != nil {
+		return false, err
+	}
+	pubKey, err := id.ExtractPublicKey()
+	if err != nil {
+		return false, err
+	}
+	return pubKey.Verify(data, signature)
+}
+
 func CreateIdentity(name string, privKey p2pCrypto.PrivKey, childKey []byte) (PeerIdentity, error) {
 	ID, err := peer.IDFromPrivateKey(privKey)
 	if err != nil {
@@ -88,6 +125,85 @@ func CreateIdentity(name string, privKey p2pCrypto.PrivKey, childKey []byte) (Pe
 	}, nil
 }
 
+// Sign the peer id with the master key, the proof is shared with the other devices of the owner
+func (p *PeerIdentity) SetMasterProof(master *bip32.Key, child *bip32.Key) error {
+	masterKey, err := p2pCrypto.UnmarshalSecp256k1PrivateKey(master.Key)
+	if err != nil {
+		return err
+	}
+	signature, err := masterKey.Sign([]byte(p.Id))
+	if err != nil {
+		return err
+	}
+	p.MasterProof = &MasterProof{
+		MasterPubKey: b64.StdEncoding.EncodeToString(master.PublicKey().Key),
+		ChildPubKey: child.PublicKey().B58Serialize(),
+		Signature: b64.StdEncoding.EncodeToString(signature),
+	}
+	return nil
+}
+
+func (p *PeerIdentity) SetVaultKey(master *bip32.Key) {
+	p.VaultKey = b64.StdEncoding.EncodeToString(crypto.CreateVaultKey(master))
+}
+
+func (p *PeerIdentity) GetVaultKeyAsByte() []byte {
+	vaultKey, _ := b64.StdEncoding.DecodeString(p.VaultKey)
+	return vaultKey
+}
+
+func (p *PeerIdentity) GetBackupKeyAsByte() []byte {
+	return crypto.CreateBackupKey(p.GetVaultKeyAsByte())
+}
+
+// Verify that the peer is a device of the owner of the master public key
+// The master signature of the peer id, the bip32 relationship and the device key must all match
+func VerifyMasterProof(QmPeerId string, proof MasterProof) error {
+	masterPubKey, err := b64.StdEncoding.DecodeString(proof.MasterPubKey)
+	if err != nil {
+		return err
+	}
+	masterKey, err := p2pCrypto.UnmarshalSecp256k1PublicKey(masterPubKey)
+	if err != nil {
+		return err
+	}
+	signature, err := b64.StdEncoding.DecodeString(proof.Signature)
+	if err != nil {
+		return err
+	}
+	valid, err := masterKey.Verify([]byte(QmPeerId), signature)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return ErrorMasterProof
+	}
+
+	child, err := bip32.B58Deserialize(proof.ChildPubKey)
+	if err != nil {
+		return err
+	}
+	if !crypto.IsChildFromMaster(child, &bip32.Key{Key: masterPubKey}) {
+		return ErrorMasterProof
+	}
+	id, err := peer.IDB58Decode(QmPeerId)
+	if err != nil {
+		return err
+	}
+	pubKey, err := id.ExtractPublicKey()
+	if err != nil {
+		return err
+	}
+	pubBytes, err := pubKey.Raw()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(pubBytes, child.Key) {
+		return ErrorMasterProof
+	}
+	return nil
+}
+
 func (p PeerIdentity) SaveIdentity() error {
 	idJson, err := json.MarshalIndent(p, "", " ")
 	if err != nil {
@@ -102,6 +218,21 @@ func (p PeerIdentity) SaveIdentity() error {
 	return keychain.Put(p.Id, idJson, "Owner", false)
 }
 
+// Replace the identity kept, such as an identity completed with its master proof
+func (p PeerIdentity) UpdateIdentity() error {
+	idJson, err := json.MarshalIndent(p, "", " ")
+	if err != nil {
+		return err
+	}
+
+	keychain := crypto.Keychain{}
+	err = keychain.CreateOrOpen()
+	if err != nil {
+		return err
+	}
+	return keychain.Put(p.Id, idJson, "Owner", true)
+}
+
 func DeleteIdentity(QmPeerId string) error {
 	keychain := crypto.Keychain{}
 	err := keychain.CreateOrOpen()
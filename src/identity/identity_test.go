@@ -0,0 +1,35 @@
+package identity
+
+import (
+	"testing"
+
+	"github.com/PeerVault/PeerVault-Service/crypto"
+)
+
+func TestVerifyMasterProof(t *testing.T) {
+	seed := &crypto.Seed{}
+	seed.CreateSeed()
+	master, _ := seed.CreateMasterKey()
+	child, _ := crypto.CreateChildKey(master)
+	pvtKey, _ := crypto.BipKeyToLibp2p(child)
+	device, err := CreateIdentity("laptop", pvtKey, child.Key)
+	if err != nil {
+		t.Errorf("Identity creation fail, %s", err.Error())
+	}
+	if err := device.SetMasterProof(master, child); err != nil {
+		t.Errorf("Master proof creation fail, %s", err.Error())
+	}
+	if err := VerifyMasterProof(device.Id, *device.MasterProof); err != nil {
+		t.Errorf("Master proof must be valid, %s", err.Error())
+	}
+
+	other := &crypto.Seed{}
+	other.CreateSeed()
+	otherMaster, _ := other.CreateMasterKey()
+	otherChild, _ := crypto.CreateChildKey(otherMaster)
+	otherKey, _ := crypto.BipKeyToLibp2p(otherChild)
+	impostor, _ := CreateIdentity("impostor", otherKey, otherChild.Key)
+	if err := VerifyMasterProof(impostor.Id, *device.MasterProof); err == nil {
+		t.Errorf("Master proof of another device must be refused")
+	}
+}
@@ -10,10 +10,12 @@ import (
 	"github.com/PeerVault/PeerVault-Service/communication/control"
 	"github.com/PeerVault/PeerVault-Service/communication/event"
 	"github.com/PeerVault/PeerVault-Service/communication/peer"
+	"github.com/PeerVault/PeerVault-Service/communication/relay"
 	"github.com/PeerVault/PeerVault-Service/crypto"
 	"github.com/PeerVault/PeerVault-Service/database"
 	"github.com/op/go-logging"
 	"os"
+	"strings"
 )
 
 var (
@@ -27,14 +29,56 @@ func main() {
 	debugMode := flag.Bool("dev", false, "Enable dev mode")
 	apiAddress := flag.String("apiAddr", "localhost:4444", "http api service address")
 	wsAddress := flag.String("wsAddr", "localhost:5555", "WebSocket event service address")
-	relayHost := flag.String("relay", "", "Relay Host URL")
+	relayHost := flag.String("relay", "", "Comma separated relay multiaddrs, the first one reachable is used")
+	listenAddrs := flag.String("listen", "", "Comma separated multiaddrs listened for direct connections such as /ip4/0.0.0.0/tcp/0, empty for relay only, "+relay.DefaultListenAddr+" in relay mode")
+	natPortMap := flag.Bool("nat-port-map", false, "Open the listened ports on the router with UPnP or NAT-PMP")
+	mdns := flag.Bool("mdns", false, "Enable discovery of the peers on the local network")
 	logLevel := flag.Int("log", 9, "Log level, 3=error,warning 6=notice,info, 9=debug")
 	dbFilePath := flag.String("bbolt", "", "Location of bbolt DB file")
 	logFilePath := flag.String("logfile", "", "Location of log file")
+	gate := flag.String("gate", "open", "Peers allowed to open streams, open for every peer not blocked, allowlist for the known contacts only")
+	streamRate := flag.Int("stream-rate", 30, "Inbound streams per minute of a peer not trusted, 0 for unlimited")
+	swarmKey := flag.String("swarm-key", "", "Location of the swarm key file, only the nodes with the same key can connect")
+	swarmKeyGen := flag.Bool("swarm-key-gen", false, "Create the swarm key file given with --swarm-key then exit")
+	relayMode := flag.Bool("relay-mode", false, "Run as a circuit relay for the other peers, without owner nor vault")
+	relayKey := flag.String("relay-key", "", "Location of the relay private key file, created the first time")
+	relayAllow := flag.String("relay-allow", "", "Comma separated PeerIds allowed to use the relay, empty to allow every peer")
+	relayMaxConns := flag.Int("relay-max-conns", 0, "Maximum connections of the relay, 0 for unlimited")
+	relayMaxCircuits := flag.Int("relay-max-circuits", 0, "Maximum circuits relayed at the same time, 0 for the libp2p default")
 	flag.Parse()
 
 	configureLogger(*logFilePath, *logLevel)
 
+	if *swarmKeyGen {
+		if *swarmKey == "" {
+			log.Fatal("Please provide the swarm key file path with --swarm-key option")
+		}
+		if err := crypto.CreateSwarmKey(*swarmKey); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Swarm key created in %s, share it with the nodes of the private network", *swarmKey)
+		return
+	}
+
+	if *relayMode {
+		// The peers configure the multiaddr of the relay, a random port cannot be used
+		if *listenAddrs == "" {
+			*listenAddrs = relay.DefaultListenAddr
+		}
+		config := relay.Config{
+			ListenAddrs: strings.Split(*listenAddrs, ","),
+			KeyPath: *relayKey,
+			SwarmKeyPath: *swarmKey,
+			MaxConnections: *relayMaxConns,
+			MaxCircuits: *relayMaxCircuits,
+		}
+		if *relayAllow != "" {
+			config.Allowlist = strings.Split(*relayAllow, ",")
+		}
+		runRelay(apiAddress, config)
+		return
+	}
+
 	if *relayHost == "" {
 		log.Fatal("Please provide relay host with --relay option")
 	}
@@ -52,7 +96,25 @@ func main() {
 		log.Fatal("Error during opening bbolt database")
 	}
 
-	run(wsAddress, apiAddress, relayHost)
+	if *mdns {
+		peer.EnableMdns()
+	}
+	if *natPortMap {
+		if *listenAddrs == "" {
+			log.Fatal("Option --nat-port-map needs the addresses listened with --listen option")
+		}
+		peer.EnableNatPortMap()
+	}
+	if *swarmKey != "" {
+		peer.SetSwarmKey(*swarmKey)
+	}
+	if *gate != peer.GateOpen && *gate != peer.GateAllowlist {
+		log.Fatal("Option --gate must be open or allowlist")
+	}
+	peer.SetGateMode(*gate)
+	peer.SetStreamRate(*streamRate)
+
+	run(wsAddress, apiAddress, relayHost, listenAddrs)
 }
 
 func configureLogger(logFilePath string, logLevel int) {
@@ -94,7 +156,7 @@ func configureLogger(logFilePath string, logLevel int) {
 	logging.SetBackend(backendLogLeveled)
 }
 
-func run(wsAddress *string, apiAddress *string, relayHost *string) {
+func run(wsAddress *string, apiAddress *string, relayHost *string, listenAddrs *string) {
 	// Start websocket events
 	go event.Listen(wsAddress)
 
@@ -102,8 +164,21 @@ func run(wsAddress *string, apiAddress *string, relayHost *string) {
 	go control.Listen(apiAddress)
 
 	// Start peer
-	peer.SetRelayHost(*relayHost)
+	peer.SetRelayHosts(strings.Split(*relayHost, ","))
+	if *listenAddrs != "" {
+		peer.SetListenAddrs(strings.Split(*listenAddrs, ","))
+	}
 	go peer.Listen()
 
 	select {}
 }
+
+func runRelay(apiAddress *string, config relay.Config) {
+	// Start API
+	go control.ListenRelay(apiAddress)
+
+	// Start relay
+	go relay.Listen(config)
+
+	select {}
+}